@@ -0,0 +1,252 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/benitogf/katamari"
+)
+
+// Rule : grants actions on the keys that match a path
+//
+// Path: key pattern, a "*" segment matches any segment and a "{name}"
+// segment matches any segment that is not a glob, capturing its value
+//
+// Actions: read, write and/or delete
+//
+// Roles: roles granted by the rule, or roles that inherit them, any authenticated role if empty
+//
+// Owner: name of a captured segment that must be the account of the token
+//
+// Public: grants the actions to requests without a token
+type Rule struct {
+	Path    string   `json:"path"`
+	Actions []string `json:"actions"`
+	Roles   []string `json:"roles,omitempty"`
+	Owner   string   `json:"owner,omitempty"`
+	Public  bool     `json:"public,omitempty"`
+}
+
+// Decision : result of the evaluation of the rules
+//
+// Allowed: an action is allowed if at least one rule grants it
+//
+// Rule: index of the rule that granted the action, -1 if denied
+//
+// Reasons: why each rule that matched the key and action didn't grant it
+type Decision struct {
+	Allowed bool     `json:"allowed"`
+	Rule    int      `json:"rule"`
+	Reasons []string `json:"reasons"`
+}
+
+// ACL : access control list evaluated against the token claims,
+// keys that don't match any rule are denied
+type ACL struct {
+	auth  *TokenAuth
+	rules []Rule
+}
+
+var actions = map[string]bool{
+	katamari.ActionRead:   true,
+	katamari.ActionWrite:  true,
+	katamari.ActionDelete: true,
+}
+
+// segments of a rule path, errors on invalid patterns
+func segments(path string) ([]string, error) {
+	if path == "" || strings.Contains(path, "//") {
+		return nil, errors.New("invalid rule path " + path)
+	}
+	return strings.Split(path, "/"), nil
+}
+
+func (rule Rule) validate() error {
+	parts, err := segments(rule.Path)
+	if err != nil {
+		return err
+	}
+	if len(rule.Actions) == 0 {
+		return errors.New("rule " + rule.Path + " has no actions")
+	}
+	for _, action := range rule.Actions {
+		if !actions[action] {
+			return errors.New("unknown action " + action)
+		}
+	}
+	if rule.Owner == "" {
+		return nil
+	}
+	for _, part := range parts {
+		if part == "{"+rule.Owner+"}" {
+			return nil
+		}
+	}
+
+	return errors.New("rule " + rule.Path + " doesn't capture the owner " + rule.Owner)
+}
+
+// match a key against the rule path, returns the captured segments
+func (rule Rule) match(key string) (map[string]string, bool) {
+	parts, _ := segments(rule.Path)
+	keyParts := strings.Split(key, "/")
+	if len(parts) != len(keyParts) {
+		return nil, false
+	}
+
+	captured := map[string]string{}
+	for i, part := range parts {
+		switch {
+		case part == "*":
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			if strings.Contains(keyParts[i], "*") {
+				return nil, false
+			}
+			captured[part[1:len(part)-1]] = keyParts[i]
+		case part != keyParts[i]:
+			return nil, false
+		}
+	}
+
+	return captured, true
+}
+
+func (rule Rule) grants(action string) bool {
+	for _, granted := range rule.Actions {
+		if granted == action {
+			return true
+		}
+	}
+	return false
+}
+
+// NewACL : validates the rules and returns an access control list that
+// gets the claims of the requests from the token auth
+func NewACL(auth *TokenAuth, rules []Rule) (*ACL, error) {
+	for _, rule := range rules {
+		err := rule.validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &ACL{auth: auth, rules: rules}, nil
+}
+
+// LoadRules : read a list of rules from a json file
+func LoadRules(file string) ([]Rule, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// Explain : evaluate an action on a key for a role and account without
+// a request, an empty role is an unauthenticated caller
+func (acl *ACL) Explain(role string, account string, key string, action string) Decision {
+	decision := Decision{Rule: -1, Reasons: []string{}}
+	for i, rule := range acl.rules {
+		captured, ok := rule.match(key)
+		if !ok || !rule.grants(action) {
+			continue
+		}
+		name := "rule " + strconv.Itoa(i) + " (" + rule.Path + ")"
+		if role == "" && !rule.Public {
+			decision.Reasons = append(decision.Reasons, name+" requires a token")
+			continue
+		}
+		if role != "" && !rule.Public && len(rule.Roles) > 0 && !acl.hasRole(role, rule.Roles) {
+			decision.Reasons = append(decision.Reasons, name+" requires the role "+strings.Join(rule.Roles, " or "))
+			continue
+		}
+		if rule.Owner != "" && captured[rule.Owner] != account {
+			decision.Reasons = append(decision.Reasons, name+" requires the owner "+captured[rule.Owner])
+			continue
+		}
+		decision.Allowed = true
+		decision.Rule = i
+		return decision
+	}
+
+	if len(decision.Reasons) == 0 {
+		decision.Reasons = append(decision.Reasons, "no rule grants "+action+" on "+key)
+	}
+	return decision
+}
+
+// Audit : evaluate an action on a key with the token claims of the request,
+// can be used as the AuditKey function of the server
+func (acl *ACL) Audit(r *http.Request, key string, action string) bool {
+	role, account, err := acl.auth.Audit(r)
+	if err != nil {
+		role, account = "", ""
+	}
+
+	return acl.Explain(role, account, key, action).Allowed
+}
+
+// ExplainHandler : dry run of the rules for a role, account, key and action
+// given as query parameters (root only access)
+func (acl *ACL) ExplainHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := acl.auth.Authenticate(r)
+	if err != nil || token.Claims("role").(string) != "root" {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Method not suported for your role")
+		return
+	}
+
+	action := r.FormValue("action")
+	if !actions[action] {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", errors.New("unknown action "+action))
+		return
+	}
+
+	decision := acl.Explain(r.FormValue("role"), r.FormValue("account"), r.FormValue("key"), action)
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(&decision)
+}
+
+// Router : set the acl as the key audit of the server and add the explain route
+func (acl *ACL) Router(server *katamari.Server) {
+	server.AuditKey = acl.Audit
+	server.Router.HandleFunc("/acl/explain", acl.ExplainHandler).Methods("GET")
+}
+
+// hasRole : the role is one of the roles or inherits one of them
+func (acl *ACL) hasRole(role string, roles []string) bool {
+	if contains(roles, role) {
+		return true
+	}
+	if acl.auth == nil {
+		return false
+	}
+	for _, other := range roles {
+		if acl.auth.HasRole(role, other) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benitogf/katamari"
+	"github.com/benitogf/katamari/messages"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+var testRules = []Rule{
+	{Path: "users/{account}/*", Actions: []string{"read", "write", "delete"}, Owner: "account"},
+	{Path: "users/*/*", Actions: []string{"read"}, Roles: []string{"root"}},
+	{Path: "admin/*", Actions: []string{"read", "write", "delete"}, Roles: []string{"root"}},
+	{Path: "news/*", Actions: []string{"read"}, Public: true},
+}
+
+func register(t *testing.T, server *katamari.Server, account string) string {
+	payload := []byte(`{"name":"` + account + `","account":"` + account + `","password":"000","email":"` + account + `@test.test","phone":"123123123"}`)
+	req := httptest.NewRequest("POST", "/register", bytes.NewBuffer(payload))
+	w := httptest.NewRecorder()
+	server.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var c Credentials
+	require.NoError(t, json.NewDecoder(w.Result().Body).Decode(&c))
+	return c.Token
+}
+
+func request(server *katamari.Server, method string, path string, token string, data string) *http.Response {
+	var body *bytes.Buffer
+	if data != "" {
+		body = bytes.NewBufferString(`{"data":"` + messages.Encode([]byte(data)) + `"}`)
+	} else {
+		body = bytes.NewBuffer(nil)
+	}
+	req := httptest.NewRequest(method, path, body)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	server.Router.ServeHTTP(w, req)
+	return w.Result()
+}
+
+func TestACLExplain(t *testing.T) {
+	_, err := NewACL(nil, []Rule{{Path: "users/*", Actions: []string{"read"}, Owner: "account"}})
+	require.Error(t, err)
+	_, err = NewACL(nil, []Rule{{Path: "users/*", Actions: []string{"list"}}})
+	require.Error(t, err)
+
+	dir, err := ioutil.TempDir("", "katamari")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "acl.json")
+	data, err := json.Marshal(testRules)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(file, data, 0600))
+	rules, err := LoadRules(file)
+	require.NoError(t, err)
+	require.Equal(t, testRules, rules)
+	acl, err := NewACL(nil, rules)
+	require.NoError(t, err)
+
+	decision := acl.Explain("user", "bob", "users/bob/1", "write")
+	require.True(t, decision.Allowed)
+	require.Equal(t, 0, decision.Rule)
+
+	decision = acl.Explain("user", "bob", "users/alice/1", "read")
+	require.False(t, decision.Allowed)
+	require.Equal(t, -1, decision.Rule)
+	require.Equal(t, []string{
+		"rule 0 (users/{account}/*) requires the owner alice",
+		"rule 1 (users/*/*) requires the role root",
+	}, decision.Reasons)
+
+	require.True(t, acl.Explain("root", "root", "users/alice/1", "read").Allowed)
+	require.False(t, acl.Explain("root", "root", "users/alice/1", "write").Allowed)
+	require.False(t, acl.Explain("user", "bob", "users/*/*", "read").Allowed)
+	require.True(t, acl.Explain("user", "bob", "users/bob/*", "read").Allowed)
+	require.True(t, acl.Explain("", "", "news/1", "read").Allowed)
+	require.Equal(t, []string{"rule 2 (admin/*) requires a token"}, acl.Explain("", "", "admin/1", "read").Reasons)
+	require.Equal(t, []string{"no rule grants write on other"}, acl.Explain("root", "root", "other", "write").Reasons)
+}
+
+func TestACL(t *testing.T) {
+	authStore := &katamari.MemoryStorage{}
+	require.NoError(t, authStore.Start(katamari.StorageOpt{}))
+	go katamari.WatchStorageNoop(authStore)
+	auth := New(NewJwtStore("a-secret-key", time.Minute*10), authStore)
+	acl, err := NewACL(auth, testRules)
+	require.NoError(t, err)
+	server := &katamari.Server{}
+	server.Silence = true
+	server.Router = mux.NewRouter()
+	auth.Router(server)
+	acl.Router(server)
+	server.Start("localhost:0")
+	defer server.Close(os.Interrupt)
+
+	root := register(t, server, "root")
+	bob := register(t, server, "bob")
+
+	require.Equal(t, http.StatusOK, request(server, "POST", "/users/bob/1", bob, `{"name":"bob"}`).StatusCode)
+	require.Equal(t, http.StatusUnauthorized, request(server, "POST", "/users/alice/1", bob, `{"name":"bob"}`).StatusCode)
+	require.Equal(t, http.StatusUnauthorized, request(server, "POST", "/admin/1", bob, `{"name":"bob"}`).StatusCode)
+	require.Equal(t, http.StatusOK, request(server, "POST", "/admin/1", root, `{"name":"root"}`).StatusCode)
+	require.Equal(t, http.StatusUnauthorized, request(server, "GET", "/admin/1", bob, "").StatusCode)
+	require.Equal(t, http.StatusOK, request(server, "GET", "/admin/1", root, "").StatusCode)
+	require.Equal(t, http.StatusOK, request(server, "GET", "/users/bob/1", root, "").StatusCode)
+	require.Equal(t, http.StatusUnauthorized, request(server, "DELETE", "/users/bob/1", root, "").StatusCode)
+
+	// the key listing only includes the readable keys
+	var stats katamari.Stats
+	require.NoError(t, json.NewDecoder(request(server, "GET", "/", bob, "").Body).Decode(&stats))
+	require.Equal(t, []string{"users/bob/1"}, stats.Keys)
+	require.NoError(t, json.NewDecoder(request(server, "GET", "/", root, "").Body).Decode(&stats))
+	require.Equal(t, []string{"admin/1", "users/bob/1"}, stats.Keys)
+
+	// multiplexed subscriptions are audited with the token of the connection
+	u := url.URL{Scheme: "ws", Host: server.Address, Path: "/_mux"}
+	wsClient, _, err := websocket.DefaultDialer.Dial(u.String(), http.Header{"Sec-WebSocket-Protocol": {bob}})
+	require.NoError(t, err)
+	defer wsClient.Close()
+	require.NoError(t, wsClient.WriteJSON(messages.Command{Op: "subscribe", Key: "admin/*"}))
+	_, message, err := wsClient.ReadMessage()
+	require.NoError(t, err)
+	require.Contains(t, string(message), "katamari: this request is not authorized")
+	require.NoError(t, wsClient.WriteJSON(messages.Command{ID: "1", Op: "set", Key: "users/bob/*", Data: messages.Encode([]byte(`{}`))}))
+	_, message, err = wsClient.ReadMessage()
+	require.NoError(t, err)
+	var reply messages.Reply
+	require.NoError(t, json.Unmarshal(message, &reply))
+	require.Equal(t, "1", reply.ID)
+	require.Empty(t, reply.Error)
+
+	// dry run
+	resp := request(server, "GET", "/acl/explain?role=user&account=bob&key=admin/1&action=read", bob, "")
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = request(server, "GET", "/acl/explain?role=user&account=bob&key=admin/1&action=read", root, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var decision Decision
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&decision))
+	require.False(t, decision.Allowed)
+	require.Equal(t, []string{"rule 2 (admin/*) requires the role root"}, decision.Reasons)
+}
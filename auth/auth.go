@@ -8,6 +8,8 @@ import (
 	"net/http"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/benitogf/katamari"
 	"github.com/benitogf/katamari/objects"
@@ -18,28 +20,77 @@ import (
 
 // User :
 type User struct {
-	Name     string `json:"name"`
-	Email    string `json:"email"`
-	Phone    string `json:"phone"`
-	Account  string `json:"account"`
-	Password string `json:"password,omitempty"`
-	Role     string `json:"role"`
+	Name      string `json:"name"`
+	Email     string `json:"email"`
+	Phone     string `json:"phone"`
+	Account   string `json:"account"`
+	Password  string `json:"password,omitempty"`
+	Role      string `json:"role"`
+	Verified  bool   `json:"verified,omitempty"`
+	TwoFactor bool   `json:"twoFactor,omitempty"`
 }
 
 // Credentials :
 type Credentials struct {
-	Account  string `json:"account"`
-	Password string `json:"password,omitempty"`
-	Token    string `json:"token"`
-	Role     string `json:"role"`
+	Account   string `json:"account"`
+	Password  string `json:"password,omitempty"`
+	Token     string `json:"token"`
+	Refresh   string `json:"refresh,omitempty"`
+	Role      string `json:"role"`
+	Challenge string `json:"challenge,omitempty"`
+	Code      string `json:"code,omitempty"`
 }
 
 // TokenAuth :
+//
+// RefreshExpire: lifetime of the refresh tokens, a week by default
+//
+// DefaultRole: role of the registered users and of the created users
+// that don't request one, "user" by default
+//
+// MaxLoginAttempts: failed logins of an account before it's locked out, 5 by default
+//
+// MaxIPLoginAttempts: failed logins from an ip before it's locked out, 20 by default
+//
+// LoginBackoff: wait after the first failed login, doubled on each failure, 500ms by default
+//
+// LockoutDuration: lockout time and window of the failed logins, 15 minutes by default
+//
+// Mailer: sends the password reset and email verification tokens
+//
+// RequireVerified: only users with a verified email can login, root excluded
+//
+// ResetExpire: lifetime of the password reset tokens, an hour by default
+//
+// VerifyExpire: lifetime of the email verification tokens, a day by default
+//
+// ResetMessage: subject and body of the password reset emails
+//
+// VerifyMessage: subject and body of the email verification emails
+//
+// TwoFactorIssuer: issuer shown by the authenticator apps, "katamari" by default
+//
+// TwoFactorExpire: time to send the code after the password, 5 minutes by default
 type TokenAuth struct {
 	tokenStore          *JwtStore
 	store               katamari.Database
 	getter              TokenGetter
 	UnauthorizedHandler http.HandlerFunc
+	RefreshExpire       time.Duration
+	DefaultRole         string
+	MaxLoginAttempts    int
+	MaxIPLoginAttempts  int
+	LoginBackoff        time.Duration
+	LockoutDuration     time.Duration
+	Mailer              Mailer
+	RequireVerified     bool
+	ResetExpire         time.Duration
+	VerifyExpire        time.Duration
+	ResetMessage        Message
+	VerifyMessage       Message
+	TwoFactorIssuer     string
+	TwoFactorExpire     time.Duration
+	attemptsMutex       sync.Mutex
 	client              *http.Client
 }
 
@@ -122,6 +173,21 @@ func New(tokenStore *JwtStore, store katamari.Database) *TokenAuth {
 	}
 	t.getter = NewHeaderBearerTokenGetter("Authorization")
 	t.UnauthorizedHandler = DefaultUnauthorizedHandler
+	t.RefreshExpire = 7 * 24 * time.Hour
+	t.DefaultRole = "user"
+	t.MaxLoginAttempts = 5
+	t.MaxIPLoginAttempts = 20
+	t.LoginBackoff = 500 * time.Millisecond
+	t.LockoutDuration = 15 * time.Minute
+	t.ResetExpire = time.Hour
+	t.VerifyExpire = 24 * time.Hour
+	t.ResetMessage = defaultResetMessage
+	t.VerifyMessage = defaultVerifyMessage
+	t.TwoFactorIssuer = "katamari"
+	t.TwoFactorExpire = 5 * time.Minute
+	tokenStore.revoked = t.revoked
+	t.loadKeys()
+	tokenStore.persist = t.saveKeys
 	return t
 }
 
@@ -145,16 +211,24 @@ func (t *TokenAuth) Authenticate(r *http.Request) (Token, error) {
 	if err != nil {
 		return nil, err
 	}
+	// single use tokens can't authenticate requests
+	if token.Claims("purpose") != nil || token.Claims("aud") != nil {
+		return nil, errInvalidToken
+	}
 	return token, nil
 }
 
-// Audit : get websocket token, return token claims
-func (t *TokenAuth) Audit(r *http.Request) (string, string, error) {
-	// get the header from a websocket connection
-	// https://stackoverflow.com/questions/22383089/is-it-possible-to-use-bearer-authentication-for-websocket-upgrade-requests
-	if r.Header.Get("Upgrade") == "websocket" && r.Header.Get("Sec-WebSocket-Protocol") != "" {
+// bearer : use the token of a websocket protocol header as the authorization
+// https://stackoverflow.com/questions/22383089/is-it-possible-to-use-bearer-authentication-for-websocket-upgrade-requests
+func bearer(r *http.Request) {
+	if r.Header.Get("Upgrade") == "websocket" && r.Header.Get("Sec-WebSocket-Protocol") != "" && r.Header.Get("Authorization") == "" {
 		r.Header.Add("Authorization", "Bearer "+strings.Replace(r.Header.Get("Sec-WebSocket-Protocol"), "bearer, ", "", 1))
 	}
+}
+
+// Audit : get websocket token, return token claims
+func (t *TokenAuth) Audit(r *http.Request) (string, string, error) {
+	bearer(r)
 	token, err := t.Authenticate(r)
 	if err != nil {
 		return "", "", err
@@ -164,6 +238,33 @@ func (t *TokenAuth) Audit(r *http.Request) (string, string, error) {
 	return role, account, nil
 }
 
+// Identify : account of the token claims, empty if the request isn't authenticated
+// can be used as the Identify function of the server for scoped filters
+func (t *TokenAuth) Identify(r *http.Request) string {
+	_, account, err := t.Audit(r)
+	if err != nil {
+		return ""
+	}
+	return account
+}
+
+// Session : account and expiry of the token of a request, fails once the token
+// expires or is revoked, can be used as the Session function of the server
+func (t *TokenAuth) Session(r *http.Request) (string, time.Time, error) {
+	bearer(r)
+	// requests without a token have no session
+	if t.getter.GetTokenFromRequest(r) == "" {
+		return "", time.Time{}, nil
+	}
+	token, err := t.Authenticate(r)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	account := token.Claims("iss").(string)
+	expires := time.Unix(0, int64(token.Claims("exp").(float64)))
+	return account, expires, nil
+}
+
 // Authorize method
 func (t *TokenAuth) getUser(account string) (User, error) {
 	var user User
@@ -216,20 +317,6 @@ func getCredentials(r *http.Request) (Credentials, error) {
 	return credentials, nil
 }
 
-func (t *TokenAuth) checkCredentials(credentials Credentials) (User, error) {
-	user, err := t.getUser(credentials.Account)
-	if err != nil {
-		return user, errors.New("user not found")
-	}
-
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(credentials.Password))
-	if err != nil {
-		return user, errors.New("wrong password")
-	}
-
-	return user, nil
-}
-
 // Profile returns to the client the correspondent user profile for the token provided
 func (t *TokenAuth) Profile(pivotIP string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -263,7 +350,7 @@ func (t *TokenAuth) Profile(pivotIP string) func(w http.ResponseWriter, r *http.
 	}
 }
 
-// Authorize will claim a token on POST and refresh the claim on PUT
+// Authorize will claim a token on POST and rotate the refresh token on PUT
 func (t *TokenAuth) Authorize(pivotIP string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
@@ -276,44 +363,55 @@ func (t *TokenAuth) Authorize(pivotIP string) func(w http.ResponseWriter, r *htt
 			fmt.Fprint(w, err.Error())
 			return
 		}
-		user, err := t.getUser(credentials.Account)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprint(w, err.Error())
-			return
-		}
 		switch r.Method {
 		case "POST":
-			_, err = t.checkCredentials(credentials)
+			// the second step of a login sends the challenge and code instead of the password
+			step := t.login
+			if credentials.Challenge != "" {
+				step = t.secondStep
+			}
+			user, wait, err := step(credentials, remoteIP(r))
+			if err == errTooManyAttempts {
+				tooManyAttempts(w, wait)
+				return
+			}
 			if err != nil {
 				w.WriteHeader(http.StatusForbidden)
 				fmt.Fprint(w, err.Error())
 				return
 			}
-			break
-		case "PUT":
-			if credentials.Token != "" {
-				oldToken, err := t.tokenStore.CheckToken(credentials.Token)
-				if err == nil {
-					w.WriteHeader(http.StatusNotModified)
-					fmt.Fprint(w, errors.New("token not expired"))
-					return
-				}
-
-				if oldToken.Claims("iss").(string) != credentials.Account {
-					w.WriteHeader(http.StatusBadRequest)
-					fmt.Fprint(w, errors.New("token doesn't match the account"))
-					return
-				}
-
-				if err.Error() != "Token expired" {
-					w.WriteHeader(http.StatusNotModified)
-					fmt.Fprint(w, err)
+			// root can't be locked out, it marks the existing users as verified
+			if t.RequireVerified && !user.Verified && user.Role != "root" {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, errNotVerified)
+				return
+			}
+			if user.TwoFactor && credentials.Challenge == "" {
+				credentials, err = t.challenge(user)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					fmt.Fprint(w, err.Error())
 					return
 				}
-			} else {
-				w.WriteHeader(http.StatusBadRequest)
-				fmt.Fprint(w, errors.New("empty token"))
+				w.Header().Add("content-type", "application/json")
+				w.WriteHeader(http.StatusAccepted)
+				enc := json.NewEncoder(w)
+				enc.Encode(&credentials)
+				return
+			}
+			credentials, err = t.issue(user, randomID(16))
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprint(w, err.Error())
+				return
+			}
+			break
+		case "PUT":
+			// every failure is the same so the accounts can't be probed
+			credentials, err = t.rotate(credentials.Account, credentials.Refresh)
+			if err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprint(w, err)
 				return
 			}
 			break
@@ -322,12 +420,6 @@ func (t *TokenAuth) Authorize(pivotIP string) func(w http.ResponseWriter, r *htt
 			fmt.Fprintf(w, "Method not suported")
 			return
 		}
-		newToken := t.tokenStore.NewToken()
-		newToken.SetClaim("iss", credentials.Account)
-		newToken.SetClaim("role", user.Role)
-		credentials.Password = ""
-		credentials.Role = user.Role
-		credentials.Token = newToken.String()
 		w.Header().Add("content-type", "application/json")
 		enc := json.NewEncoder(w)
 		enc.Encode(&credentials)
@@ -347,33 +439,10 @@ func (t *TokenAuth) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if user.Account == "" || user.Name == "" || user.Password == "" || user.Email == "" || user.Phone == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "%s", errors.New("new user data incomplete"))
-		return
-	}
-
-	if !userRegexp.MatchString(user.Account) {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "%s", errors.New("account cannot contain special characters, only numbers or lowercase letters and character count must be between 2 and 15"))
-		return
-	}
-
-	if len(user.Password) < 3 || len(user.Password) > 88 {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "%s", errors.New("password character count must be between 2 and 88"))
-		return
-	}
-
-	if !userRegexp.MatchString(user.Phone) {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "%s", errors.New("phone cannot contain special characters othen than '-' and character count must be between 6 and 15"))
-		return
-	}
-
-	if !emailRegexp.MatchString(user.Email) {
+	err = validateUser(user)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "%s", errors.New("invalid email address"))
+		fmt.Fprintf(w, "%s", err)
 		return
 	}
 
@@ -385,37 +454,39 @@ func (t *TokenAuth) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.MinCost)
+	user.Role = t.DefaultRole
+	user.Verified = false
+	role, otherRole := roles[user.Account]
+	if otherRole {
+		user.Role = role
+	}
+	err = t.setUser(user, false)
+
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprint(w, err.Error())
 		return
 	}
 
-	user.Password = string(hash)
-	user.Role = "user"
-	role, otherRole := roles[user.Account]
-	if otherRole {
-		user.Role = role
+	if t.Mailer != nil {
+		err = t.sendVerification(user)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err.Error())
+			return
+		}
 	}
-	dataBytes := new(bytes.Buffer)
-	json.NewEncoder(dataBytes).Encode(user)
-	_, err = t.store.Set("users/"+user.Account, string(dataBytes.Bytes()))
 
+	// unverified users get their tokens once they verify the email and login
+	credentials := Credentials{Account: user.Account, Role: user.Role}
+	if !t.RequireVerified || user.Role == "root" {
+		credentials, err = t.issue(user, randomID(16))
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprint(w, err.Error())
 		return
 	}
-
-	newToken := t.tokenStore.NewToken()
-	newToken.SetClaim("iss", user.Account)
-	newToken.SetClaim("role", user.Role)
-	credentials := Credentials{
-		Account: user.Account,
-		Token:   newToken.String(),
-		Role:    user.Role,
-	}
 	w.WriteHeader(http.StatusOK)
 	enc := json.NewEncoder(w)
 	enc.Encode(&credentials)
@@ -430,13 +501,12 @@ func (t *TokenAuth) NewPassword(w http.ResponseWriter, r *http.Request) {
 		role = token.Claims("role").(string)
 	}
 
-	// root authorization
-	if role != "root" {
+	account := mux.Vars(r)["account"]
+	if !authorized || !t.Can(role, PermissionUsers, "users/"+account) {
 		w.WriteHeader(http.StatusForbidden)
 		fmt.Fprintf(w, "Method not suported for your role")
 		return
 	}
-	account := mux.Vars(r)["account"]
 
 	user, err := t.getUser(account)
 	if err != nil {
@@ -444,6 +514,12 @@ func (t *TokenAuth) NewPassword(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, err.Error())
 		return
 	}
+	// only root can manage root users
+	if user.Role == "root" && role != "root" {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Method not suported for your role")
+		return
+	}
 	switch r.Method {
 	case "PUT":
 		dec := json.NewDecoder(r.Body)
@@ -518,8 +594,7 @@ func (t *TokenAuth) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// root authorization
-	if role != "root" {
+	if !t.Can(role, PermissionUsers, "users/*") {
 		w.WriteHeader(http.StatusForbidden)
 		fmt.Fprintf(w, "Method not suported for your role")
 		return
@@ -535,31 +610,21 @@ func (t *TokenAuth) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if user.Account == "" || user.Name == "" || user.Password == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "%s", errors.New("new user data incomplete"))
-		return
-	}
-
-	if !userRegexp.MatchString(user.Account) {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "%s", errors.New("account cannot contain special characters, only numbers or lowercase letters and character count must be between 2 and 15"))
+	user, err = t.create(user, role, false)
+	if _, ok := err.(forbidden); ok {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "%s", err)
 		return
 	}
-
-	if len(user.Password) < 3 || len(user.Password) > 88 {
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "%s", errors.New("password character count must be between 2 and 88"))
+		fmt.Fprintf(w, "%s", err)
 		return
 	}
 
-	_, err = t.getUser(user.Account)
-
-	if err == nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "%s", errors.New("account name taken"))
-		return
-	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(&user)
 }
 
 // Users will send the user list to a root user
@@ -572,8 +637,7 @@ func (t *TokenAuth) Users(pivotIP string) func(w http.ResponseWriter, r *http.Re
 			role = token.Claims("role").(string)
 		}
 
-		// root authorization
-		if !authorized || role != "root" {
+		if !authorized || !t.Can(role, PermissionUsers, "users/*") {
 			w.WriteHeader(http.StatusForbidden)
 			fmt.Fprintf(w, "Method not suported for your role")
 			return
@@ -605,13 +669,12 @@ func (t *TokenAuth) User(w http.ResponseWriter, r *http.Request) {
 		role = token.Claims("role").(string)
 	}
 
-	// root authorization
-	if !authorized || role != "root" {
+	account := mux.Vars(r)["account"]
+	if !authorized || !t.Can(role, PermissionUsers, "users/"+account) {
 		w.WriteHeader(http.StatusForbidden)
 		fmt.Fprintf(w, "Method not suported for your role")
 		return
 	}
-	account := mux.Vars(r)["account"]
 
 	user, err := t.getUser(account)
 	if err != nil {
@@ -619,6 +682,12 @@ func (t *TokenAuth) User(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, err.Error())
 		return
 	}
+	// only root can manage root users
+	if user.Role == "root" && role != "root" {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Method not suported for your role")
+		return
+	}
 	switch r.Method {
 	case "GET":
 		user.Password = ""
@@ -633,6 +702,7 @@ func (t *TokenAuth) User(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintf(w, "%s", err)
 			return
 		}
+		t.store.Del("totp/" + user.Account)
 		w.WriteHeader(http.StatusNoContent)
 		fmt.Fprintf(w, "deleted "+account)
 		break
@@ -645,8 +715,18 @@ func (t *TokenAuth) User(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprint(w, errors.New("Invalid user data"))
 			return
 		}
-		if userData.Email != "" {
+		if userData.Email != "" && userData.Email != user.Email {
 			user.Email = userData.Email
+			user.Verified = false
+		}
+		// only root can verify an email without a token
+		if userData.Verified {
+			if role != "root" {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintf(w, "Method not suported for your role")
+				return
+			}
+			user.Verified = true
 		}
 		if userData.Name != "" {
 			user.Name = userData.Name
@@ -655,7 +735,18 @@ func (t *TokenAuth) User(w http.ResponseWriter, r *http.Request) {
 			user.Phone = userData.Phone
 		}
 		if userData.Role != "" {
-			user.Role = userData.Role
+			assigned, err := t.assign(userData.Role, role)
+			if _, ok := err.(forbidden); ok {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintf(w, "%s", err)
+				return
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "%s", err)
+				return
+			}
+			user.Role = assigned
 		}
 		dataBytes := new(bytes.Buffer)
 		json.NewEncoder(dataBytes).Encode(user)
@@ -683,12 +774,28 @@ func (t *TokenAuth) Router(server *katamari.Server) {
 	server.Router.HandleFunc("/authorize", t.Authorize(server.Pivot))
 	server.Router.HandleFunc("/profile", t.Profile(server.Pivot))
 	server.Router.HandleFunc("/users", t.Users(server.Pivot)).Methods("GET")
+	server.Router.HandleFunc("/users/export", t.Export(server.Pivot)).Methods("GET")
+	server.Router.HandleFunc("/users/import", t.Import).Methods("POST")
 	server.Router.HandleFunc("/user/{account:[a-zA-Z\\d]+}", t.User).Methods("GET", "POST", "DELETE")
 	server.Router.HandleFunc("/password/{account:[a-zA-Z\\d]+}", t.NewPassword).Methods("PUT")
 	server.Router.HandleFunc("/register", t.Register).Methods("POST")
+	server.Router.HandleFunc("/.well-known/jwks.json", t.JWKS).Methods("GET")
+	server.Router.HandleFunc("/logout", revoking(server, t.Logout)).Methods("POST")
+	server.Router.HandleFunc("/reset", revoking(server, t.Reset)).Methods("POST", "PUT")
+	server.Router.HandleFunc("/verify", t.VerifyEmail).Methods("POST", "PUT")
+	server.Router.HandleFunc("/logout/all", revoking(server, t.LogoutAll)).Methods("POST")
 	server.Router.HandleFunc("/create", t.Create).Methods("POST")
+	server.Router.HandleFunc("/totp", t.TwoFactor).Methods("POST", "PUT")
+	server.Router.HandleFunc("/totp/{account:[a-zA-Z\\d]+}", t.ResetTwoFactor).Methods("DELETE")
+	server.Router.HandleFunc("/lockouts", t.Lockouts).Methods("GET")
+	server.Router.HandleFunc("/lockout/{kind:account|ip|reset|reset-ip}/{id}", t.ClearLockout).Methods("DELETE")
+	server.Router.HandleFunc("/roles", t.Roles).Methods("GET")
+	server.Router.HandleFunc("/role/{name:[a-zA-Z\\d_]+}", t.RoleHandler).Methods("GET", "POST", "DELETE")
 	server.Router.HandleFunc("/available", t.Available(server.Pivot)).Queries("account", "{[a-zA-Z\\d]}").Methods("GET")
 
+	if server.Session == nil {
+		server.Session = t.Session
+	}
 	t.client = server.Client
 	pivot.Router(server.Router, t.store, server.Client, server.Pivot, []string{"users/*"})
 }
@@ -105,6 +105,10 @@ func TestRegisterAndAuthorize(t *testing.T) {
 	}
 
 	token := c.Token
+	refresh := c.Refresh
+	if refresh == "" {
+		t.Errorf("Expected a refresh token in the credentials response %s", c)
+	}
 	if token == regToken {
 		t.Errorf("Expected register and authorize to provide different tokens")
 	}
@@ -168,7 +172,7 @@ func TestRegisterAndAuthorize(t *testing.T) {
 	}
 
 	// refresh user doesn't match token
-	payload = []byte(`{"account":"notadmin","token":"` + token + `"}`)
+	payload = []byte(`{"account":"notadmin","refresh":"` + refresh + `"}`)
 	req, err = http.NewRequest("PUT", "/authorize", bytes.NewBuffer(payload))
 	if err != nil {
 		t.Errorf("Request creation failed %s", err.Error())
@@ -177,12 +181,26 @@ func TestRegisterAndAuthorize(t *testing.T) {
 	server.Router.ServeHTTP(w, req)
 	response = w.Result()
 
-	if response.StatusCode != http.StatusBadRequest {
-		t.Errorf("Expected response code %d. Got %d\n", http.StatusBadRequest, response.StatusCode)
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected response code %d. Got %d\n", http.StatusUnauthorized, response.StatusCode)
+	}
+
+	// the expired token can't be used to refresh
+	payload = []byte(`{"account":"root","refresh":"` + token + `"}`)
+	req, err = http.NewRequest("PUT", "/authorize", bytes.NewBuffer(payload))
+	if err != nil {
+		t.Errorf("Request creation failed %s", err.Error())
+	}
+	w = httptest.NewRecorder()
+	server.Router.ServeHTTP(w, req)
+	response = w.Result()
+
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected response code %d. Got %d\n", http.StatusUnauthorized, response.StatusCode)
 	}
 
 	// refresh
-	payload = []byte(`{"account":"root","token":"` + token + `"}`)
+	payload = []byte(`{"account":"root","refresh":"` + refresh + `"}`)
 	req, err = http.NewRequest("PUT", "/authorize", bytes.NewBuffer(payload))
 	if err != nil {
 		t.Errorf("Request creation failed %s", err.Error())
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/benitogf/jwt"
@@ -9,13 +10,16 @@ import (
 
 // JwtStore :
 type JwtStore struct {
-	tokenKey    []byte
+	mutex       sync.RWMutex
+	keys        []*SigningKey
 	expireAfter time.Duration
+	revoked     func(token *JwtToken) bool
+	persist     func(keys []*SigningKey)
 }
 
 // JwtToken :
 type JwtToken struct {
-	tokenKey []byte
+	signer interface{}
 	jwt.Token
 }
 
@@ -46,41 +50,64 @@ func (t *JwtToken) IsExpired() bool {
 
 // String :
 func (t *JwtToken) String() string {
-	tokenStr, _ := t.Token.SignedString(t.tokenKey)
+	tokenStr, _ := t.Token.SignedString(t.signer)
 	return tokenStr
 }
 
 // NewToken :
-func (s *JwtStore) NewToken() *JwtToken {
-	token := jwt.New(jwt.GetSigningMethod("HS256"))
+func (s *JwtStore) NewToken() (*JwtToken, error) {
+	key := s.signer()
+	method := jwt.GetSigningMethod(key.Method)
+	if method == nil {
+		return nil, errors.New("unsupported signing method " + key.Method)
+	}
+	token := jwt.New(method)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
 	claims := token.Claims.(jwt.MapClaims)
-	claims["exp"] = time.Now().Add(s.expireAfter).UnixNano()
+	now := time.Now()
+	claims["exp"] = now.Add(s.expireAfter).UnixNano()
+	claims["issued"] = now.UnixNano()
+	claims["jti"] = randomID(16)
 	t := &JwtToken{
-		tokenKey: s.tokenKey,
-		Token:    *token,
+		signer: key.Private,
+		Token:  *token,
 	}
-	return t
+	return t, nil
 }
 
 // CheckToken :
 func (s *JwtStore) CheckToken(token string) (Token, error) {
+	var key *SigningKey
 	t, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-		return s.tokenKey, nil
+		kid, _ := token.Header["kid"].(string)
+		key = s.key(kid)
+		if key == nil {
+			return nil, errors.New("unknown signing key")
+		}
+		if token.Method.Alg() != key.Method {
+			return nil, errors.New("unexpected signing method")
+		}
+		return key.verifier(), nil
 	})
 	if err != nil {
 		return nil, err
 	}
-	jtoken := &JwtToken{s.tokenKey, *t}
+	jtoken := &JwtToken{key.Private, *t}
 	if jtoken.IsExpired() {
 		return jtoken, errors.New("Token expired")
 	}
+	if s.revoked != nil && s.revoked(jtoken) {
+		return jtoken, errors.New("Token revoked")
+	}
 	return jtoken, nil
 }
 
 // NewJwtStore :
 func NewJwtStore(tokenKey string, expireAfter time.Duration) *JwtStore {
 	return &JwtStore{
-		[]byte(tokenKey),
-		expireAfter,
+		keys:        []*SigningKey{{Method: "HS256", Private: []byte(tokenKey)}},
+		expireAfter: expireAfter,
 	}
 }
@@ -0,0 +1,415 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/benitogf/katamari/objects"
+)
+
+// SigningKey : key used to sign and verify tokens
+//
+// ID: identifies the key in the kid header of the tokens and the jwks
+//
+// Method: HS256, RS256, ES256 or EdDSA
+//
+// Private: []byte secret for HS256, *rsa.PrivateKey, *ecdsa.PrivateKey or ed25519.PrivateKey
+type SigningKey struct {
+	ID      string
+	Method  string
+	Private interface{}
+	created time.Time
+	retired time.Time
+}
+
+// storedKey : signing key of a rotation kept in the auth database, the
+// private key is a pkcs8 pem or the base64 secret for HS256
+type storedKey struct {
+	ID      string `json:"id"`
+	Method  string `json:"method"`
+	Private string `json:"private"`
+	Created int64  `json:"created"`
+	Retired int64  `json:"retired"`
+}
+
+// JWK : public key in the json web key format
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS : set of public keys
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// validate the key type against the method
+func (key *SigningKey) validate() error {
+	valid := false
+	switch private := key.Private.(type) {
+	case []byte:
+		valid = key.Method == "HS256" && len(private) > 0
+	case *rsa.PrivateKey:
+		valid = key.Method == "RS256"
+	case *ecdsa.PrivateKey:
+		valid = key.Method == "ES256" && private.Curve == elliptic.P256()
+	case ed25519.PrivateKey:
+		valid = key.Method == "EdDSA" && len(private) == ed25519.PrivateKeySize
+	}
+	if !valid {
+		return errors.New("invalid signing key " + key.ID + " for " + key.Method)
+	}
+	if key.Method != "HS256" && key.ID == "" {
+		return errors.New("asymmetric signing keys require an id")
+	}
+
+	return nil
+}
+
+// verifier : key used to verify the signature
+func (key *SigningKey) verifier() interface{} {
+	switch private := key.Private.(type) {
+	case *rsa.PrivateKey:
+		return &private.PublicKey
+	case *ecdsa.PrivateKey:
+		return &private.PublicKey
+	case ed25519.PrivateKey:
+		return private.Public()
+	}
+
+	return key.Private
+}
+
+func encodeInt(value *big.Int, size int) string {
+	data := value.Bytes()
+	if len(data) < size {
+		data = append(make([]byte, size-len(data)), data...)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// jwk : public key of the signing key, false for secrets
+func (key *SigningKey) jwk() (JWK, bool) {
+	jwk := JWK{Kid: key.ID, Use: "sig", Alg: key.Method}
+	switch public := key.verifier().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = encodeInt(public.N, 0)
+		jwk.E = encodeInt(big.NewInt(int64(public.E)), 0)
+	case *ecdsa.PublicKey:
+		jwk.Kty = "EC"
+		jwk.Crv = "P-256"
+		jwk.X = encodeInt(public.X, 32)
+		jwk.Y = encodeInt(public.Y, 32)
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	default:
+		return jwk, false
+	}
+
+	return jwk, true
+}
+
+// GenerateKey : new signing key for RS256, ES256 or EdDSA with a random id
+func GenerateKey(method string) (SigningKey, error) {
+	key := SigningKey{ID: randomID(8), Method: method}
+	var err error
+	switch method {
+	case "RS256":
+		key.Private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		key.Private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "EdDSA":
+		_, key.Private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		err = errors.New("unsupported signing method " + method)
+	}
+
+	return key, err
+}
+
+// ParseKey : signing key from a pem encoded private key (pkcs8, pkcs1 or ec)
+func ParseKey(id string, data []byte) (SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return SigningKey{}, errors.New("invalid pem data")
+	}
+	var private crypto.PrivateKey
+	private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		private, err = x509.ParseECPrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return SigningKey{}, errors.New("unsupported private key")
+	}
+
+	key := SigningKey{ID: id, Private: private}
+	switch private.(type) {
+	case *rsa.PrivateKey:
+		key.Method = "RS256"
+	case *ecdsa.PrivateKey:
+		key.Method = "ES256"
+	case ed25519.PrivateKey:
+		key.Method = "EdDSA"
+	}
+
+	return key, key.validate()
+}
+
+// NewJwtKeyStore : token store signing with the last key, every key
+// can verify tokens until it's retired by a rotation
+func NewJwtKeyStore(expireAfter time.Duration, keys ...SigningKey) (*JwtStore, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("a signing key is required")
+	}
+	store := &JwtStore{expireAfter: expireAfter}
+	for _, key := range keys {
+		key := key
+		err := key.validate()
+		if err != nil {
+			return nil, err
+		}
+		store.keys = append(store.keys, &key)
+	}
+
+	return store, nil
+}
+
+// signer : active key used to sign new tokens
+func (s *JwtStore) signer() *SigningKey {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.keys[len(s.keys)-1]
+}
+
+// expired : the key was retired before the tokens it signed expired
+func (s *JwtStore) expired(key *SigningKey, now time.Time) bool {
+	return !key.retired.IsZero() && now.Sub(key.retired) > s.expireAfter
+}
+
+// key : key with the id that can verify tokens
+func (s *JwtStore) key(id string) *SigningKey {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	now := time.Now()
+	for _, key := range s.keys {
+		if key.ID == id && !s.expired(key, now) {
+			return key
+		}
+	}
+	return nil
+}
+
+// Rotate : sign new tokens with the key, the previous keys verify the
+// tokens they signed until those expire and then are removed
+func (s *JwtStore) Rotate(key SigningKey) error {
+	err := key.validate()
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	for _, current := range s.keys {
+		if current.ID == key.ID {
+			s.mutex.Unlock()
+			return errors.New("duplicated signing key id " + key.ID)
+		}
+	}
+
+	now := time.Now()
+	key.created = now
+	keys := []*SigningKey{}
+	for _, current := range s.keys {
+		if current.retired.IsZero() {
+			current.retired = now
+		}
+		if !s.expired(current, now) {
+			keys = append(keys, current)
+		}
+	}
+	s.keys = append(keys, &key)
+	persist := s.persist
+	keys = append([]*SigningKey{}, s.keys...)
+	s.mutex.Unlock()
+
+	if persist != nil {
+		persist(keys)
+	}
+	return nil
+}
+
+// restore : add the keys of previous rotations, the last one signs the new tokens
+func (s *JwtStore) restore(keys []*SigningKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	for _, key := range keys {
+		if s.expired(key, now) {
+			continue
+		}
+		known := false
+		for _, current := range s.keys {
+			known = known || current.ID == key.ID
+		}
+		if !known {
+			s.keys = append(s.keys, key)
+		}
+	}
+}
+
+// RotateEvery : rotate to a new generated key of the method on an
+// interval, returns a function to stop the rotation
+func (s *JwtStore) RotateEvery(interval time.Duration, method string) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				key, err := GenerateKey(method)
+				if err == nil {
+					s.Rotate(key)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
+
+// JWKS : public keys of the store, secrets are not included
+func (s *JwtStore) JWKS() JWKS {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	set := JWKS{Keys: []JWK{}}
+	now := time.Now()
+	for _, key := range s.keys {
+		if s.expired(key, now) {
+			continue
+		}
+		jwk, ok := key.jwk()
+		if ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
+
+// JWKS : serve the public keys used to verify the tokens
+func (t *TokenAuth) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=300")
+	enc := json.NewEncoder(w)
+	enc.Encode(t.tokenStore.JWKS())
+}
+
+// saveKeys : keep the keys of the rotations in the auth database, the retired
+// keys are removed once the tokens they signed expire
+func (t *TokenAuth) saveKeys(keys []*SigningKey) {
+	for _, key := range keys {
+		if key.created.IsZero() {
+			continue
+		}
+		stored := storedKey{ID: key.ID, Method: key.Method, Created: key.created.UnixNano()}
+		switch private := key.Private.(type) {
+		case []byte:
+			stored.Private = base64.StdEncoding.EncodeToString(private)
+		default:
+			der, err := x509.MarshalPKCS8PrivateKey(private)
+			if err != nil {
+				continue
+			}
+			stored.Private = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+		}
+		if !key.retired.IsZero() {
+			stored.Retired = key.retired.UnixNano()
+		}
+		data, err := json.Marshal(stored)
+		if err != nil {
+			continue
+		}
+		if key.retired.IsZero() {
+			t.store.Set("keys/"+key.ID, string(data))
+			continue
+		}
+		ttl := t.tokenStore.expireAfter - time.Since(key.retired)
+		if ttl <= 0 {
+			t.store.Del("keys/" + key.ID)
+			continue
+		}
+		t.store.SetTTL("keys/"+key.ID, string(data), ttl)
+	}
+}
+
+// loadKeys : restore the keys of previous rotations from the auth database
+func (t *TokenAuth) loadKeys() {
+	raw, err := t.store.Get("keys/*")
+	if err != nil {
+		return
+	}
+	var objs []objects.Object
+	err = json.Unmarshal(raw, &objs)
+	if err != nil {
+		return
+	}
+	now := time.Now().UTC().UnixNano()
+	keys := []*SigningKey{}
+	for _, obj := range objs {
+		if obj.Expires != 0 && now > obj.Expires {
+			continue
+		}
+		var stored storedKey
+		err = json.Unmarshal([]byte(obj.Data), &stored)
+		if err != nil {
+			continue
+		}
+		key := SigningKey{ID: stored.ID, Method: stored.Method}
+		if stored.Method == "HS256" {
+			key.Private, err = base64.StdEncoding.DecodeString(stored.Private)
+		} else {
+			key, err = ParseKey(stored.ID, []byte(stored.Private))
+		}
+		if err != nil || key.Method != stored.Method {
+			continue
+		}
+		key.created = time.Unix(0, stored.Created)
+		if stored.Retired != 0 {
+			key.retired = time.Unix(0, stored.Retired)
+		}
+		keys = append(keys, &key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].created.Before(keys[j].created)
+	})
+	t.tokenStore.restore(keys)
+}
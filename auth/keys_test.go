@@ -0,0 +1,223 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/benitogf/jwt"
+	"github.com/benitogf/katamari"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+// publicKey rebuilds a public key from a jwk like a service verifying offline
+func publicKey(t *testing.T, jwk JWK) interface{} {
+	decode := func(value string) []byte {
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		require.NoError(t, err)
+		return data
+	}
+	switch jwk.Kty {
+	case "RSA":
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(decode(jwk.N)),
+			E: int(new(big.Int).SetBytes(decode(jwk.E)).Int64()),
+		}
+	case "EC":
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(decode(jwk.X)),
+			Y:     new(big.Int).SetBytes(decode(jwk.Y)),
+		}
+	case "OKP":
+		return ed25519.PublicKey(decode(jwk.X))
+	}
+	return nil
+}
+
+func TestSigningMethods(t *testing.T) {
+	for _, method := range []string{"RS256", "ES256", "EdDSA"} {
+		key, err := GenerateKey(method)
+		require.NoError(t, err)
+		store, err := NewJwtKeyStore(time.Minute, key)
+		require.NoError(t, err)
+
+		token, err := store.NewToken()
+		require.NoError(t, err)
+		token.SetClaim("iss", "root")
+		signed := token.String()
+		checked, err := store.CheckToken(signed)
+		require.NoError(t, err)
+		require.Equal(t, "root", checked.Claims("iss"))
+
+		jwks := store.JWKS()
+		require.Len(t, jwks.Keys, 1)
+		require.Equal(t, key.ID, jwks.Keys[0].Kid)
+		require.Equal(t, method, jwks.Keys[0].Alg)
+		verified, err := jwt.Parse(signed, func(token *jwt.Token) (interface{}, error) {
+			require.Equal(t, key.ID, token.Header["kid"])
+			return publicKey(t, jwks.Keys[0]), nil
+		})
+		require.NoError(t, err)
+		require.True(t, verified.Valid)
+	}
+
+	_, err := GenerateKey("none")
+	require.Error(t, err)
+	_, err = NewJwtKeyStore(time.Minute, SigningKey{ID: "a", Method: "ES256", Private: []byte("secret")})
+	require.Error(t, err)
+	unknown := &JwtStore{keys: []*SigningKey{{Method: "HS1024", Private: []byte("secret")}}, expireAfter: time.Minute}
+	_, err = unknown.NewToken()
+	require.Error(t, err)
+}
+
+func TestParseKey(t *testing.T) {
+	key, err := GenerateKey("ES256")
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key.Private)
+	require.NoError(t, err)
+	parsed, err := ParseKey("pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	require.NoError(t, err)
+	require.Equal(t, "ES256", parsed.Method)
+	require.Equal(t, "pem", parsed.ID)
+	_, err = ParseKey("pem", []byte("invalid"))
+	require.Error(t, err)
+}
+
+func TestKeyRotation(t *testing.T) {
+	first, err := GenerateKey("EdDSA")
+	require.NoError(t, err)
+	store, err := NewJwtKeyStore(200*time.Millisecond, first)
+	require.NoError(t, err)
+	token, err := store.NewToken()
+	require.NoError(t, err)
+	old := token.String()
+
+	second, err := GenerateKey("ES256")
+	require.NoError(t, err)
+	require.NoError(t, store.Rotate(second))
+	require.Error(t, store.Rotate(second))
+	current, err := store.NewToken()
+	require.NoError(t, err)
+	require.Equal(t, second.ID, current.Header["kid"])
+	_, err = store.CheckToken(old)
+	require.NoError(t, err)
+	require.Len(t, store.JWKS().Keys, 2)
+
+	// retired keys are removed once their tokens expired
+	time.Sleep(300 * time.Millisecond)
+	third, err := GenerateKey("RS256")
+	require.NoError(t, err)
+	require.NoError(t, store.Rotate(third))
+	jwks := store.JWKS()
+	require.Len(t, jwks.Keys, 2)
+	require.Equal(t, second.ID, jwks.Keys[0].Kid)
+	require.Equal(t, third.ID, jwks.Keys[1].Kid)
+	_, err = store.CheckToken(old)
+	require.Error(t, err)
+
+	// a token signed with another method for a known key id is rejected
+	forged := jwt.New(jwt.SigningMethodHS256)
+	forged.Header["kid"] = third.ID
+	forged.Claims.(jwt.MapClaims)["exp"] = time.Now().Add(time.Minute).UnixNano()
+	signed, err := forged.SignedString([]byte(third.ID))
+	require.NoError(t, err)
+	_, err = store.CheckToken(signed)
+	require.Error(t, err)
+
+	stop := store.RotateEvery(50*time.Millisecond, "ES256")
+	time.Sleep(120 * time.Millisecond)
+	stop()
+	current, err = store.NewToken()
+	require.NoError(t, err)
+	require.NotEqual(t, third.ID, current.Header["kid"])
+}
+
+func TestJWKSRoute(t *testing.T) {
+	authStore := &katamari.MemoryStorage{}
+	require.NoError(t, authStore.Start(katamari.StorageOpt{}))
+	go katamari.WatchStorageNoop(authStore)
+	key, err := GenerateKey("RS256")
+	require.NoError(t, err)
+	store, err := NewJwtKeyStore(time.Minute, key)
+	require.NoError(t, err)
+	auth := New(store, authStore)
+	server := &katamari.Server{}
+	server.Silence = true
+	server.Router = mux.NewRouter()
+	auth.Router(server)
+	server.Start("localhost:0")
+	defer server.Close(os.Interrupt)
+
+	token := register(t, server, "root")
+	req := httptest.NewRequest("GET", "/.well-known/jwks.json", nil)
+	w := httptest.NewRecorder()
+	server.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var jwks JWKS
+	require.NoError(t, json.NewDecoder(w.Result().Body).Decode(&jwks))
+	require.Len(t, jwks.Keys, 1)
+	require.Equal(t, "RSA", jwks.Keys[0].Kty)
+	verified, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+		return publicKey(t, jwks.Keys[0]), nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "root", verified.Claims.(jwt.MapClaims)["iss"])
+}
+
+func TestKeyPersistence(t *testing.T) {
+	authStore := &katamari.MemoryStorage{}
+	require.NoError(t, authStore.Start(katamari.StorageOpt{}))
+	go katamari.WatchStorageNoop(authStore)
+	first, err := GenerateKey("EdDSA")
+	require.NoError(t, err)
+	store, err := NewJwtKeyStore(200*time.Millisecond, first)
+	require.NoError(t, err)
+	New(store, authStore)
+	second, err := GenerateKey("ES256")
+	require.NoError(t, err)
+	require.NoError(t, store.Rotate(second))
+	token, err := store.NewToken()
+	require.NoError(t, err)
+	signed := token.String()
+
+	// a restarted store signs with the rotated key and verifies its tokens
+	restarted, err := NewJwtKeyStore(200*time.Millisecond, first)
+	require.NoError(t, err)
+	New(restarted, authStore)
+	current, err := restarted.NewToken()
+	require.NoError(t, err)
+	require.Equal(t, second.ID, current.Header["kid"])
+	_, err = restarted.CheckToken(signed)
+	require.NoError(t, err)
+
+	// retired keys are pruned once their tokens expired
+	third, err := GenerateKey("RS256")
+	require.NoError(t, err)
+	require.NoError(t, restarted.Rotate(third))
+	time.Sleep(300 * time.Millisecond)
+	jwks := restarted.JWKS()
+	require.Len(t, jwks.Keys, 1)
+	require.Equal(t, third.ID, jwks.Keys[0].Kid)
+	_, err = restarted.CheckToken(signed)
+	require.Error(t, err)
+	other, err := NewJwtKeyStore(200*time.Millisecond, first)
+	require.NoError(t, err)
+	New(other, authStore)
+	require.Len(t, other.JWKS().Keys, 2)
+	current, err = other.NewToken()
+	require.NoError(t, err)
+	require.Equal(t, third.ID, current.Header["kid"])
+}
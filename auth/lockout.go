@@ -0,0 +1,273 @@
+package auth
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/benitogf/katamari/objects"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// kinds of login and reset attempts tracked
+const (
+	attemptAccount = "account"
+	attemptIP      = "ip"
+	attemptReset   = "reset"
+	attemptResetIP = "reset-ip"
+)
+
+// Attempts : failed logins of an account or an ip, stored in the auth
+// database until the lockout window passes without failures
+//
+// Retry: time (unix nanoseconds) before which new attempts are rejected
+type Attempts struct {
+	Kind     string `json:"kind"`
+	ID       string `json:"id"`
+	Failures int    `json:"failures"`
+	Last     int64  `json:"last"`
+	Retry    int64  `json:"retry"`
+}
+
+var (
+	errInvalidCredentials = errors.New("invalid credentials")
+	errTooManyAttempts    = errors.New("too many attempts")
+	// compared when the account doesn't exist so both failures take the same time
+	dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.MinCost)
+)
+
+func attemptsKey(kind string, id string) string {
+	return "attempts/" + kind + "/" + hex.EncodeToString([]byte(id))
+}
+
+// remoteIP : ip of the request without the port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// getAttempts : failed attempts of an account or ip, empty if the window expired
+func (t *TokenAuth) getAttempts(kind string, id string) Attempts {
+	attempts := Attempts{Kind: kind, ID: id}
+	raw, err := t.store.Get(attemptsKey(kind, id))
+	if err != nil {
+		return attempts
+	}
+	obj, err := objects.Decode(raw)
+	if err != nil || (obj.Expires != 0 && time.Now().UTC().UnixNano() > obj.Expires) {
+		return attempts
+	}
+	json.Unmarshal([]byte(obj.Data), &attempts)
+	return attempts
+}
+
+// delay : exponential backoff after a number of failures, the lockout
+// duration once the limit is reached
+func (t *TokenAuth) delay(failures int, limit int) time.Duration {
+	if failures >= limit {
+		return t.LockoutDuration
+	}
+	backoff := t.LoginBackoff
+	for i := 1; i < failures && backoff < t.LockoutDuration; i++ {
+		backoff *= 2
+	}
+	if backoff > t.LockoutDuration {
+		return t.LockoutDuration
+	}
+	return backoff
+}
+
+// count : store a failed attempt and the time of the next allowed one
+func (t *TokenAuth) count(attempts Attempts, now time.Time, limit int) Attempts {
+	attempts.Failures++
+	attempts.Last = now.UnixNano()
+	attempts.Retry = now.Add(t.delay(attempts.Failures, limit)).UnixNano()
+	data, err := json.Marshal(attempts)
+	if err == nil {
+		t.store.SetTTL(attemptsKey(attempts.Kind, attempts.ID), string(data), t.LockoutDuration)
+	}
+	return attempts
+}
+
+// retry : time left before the attempts allow a new one
+func retry(now time.Time, attempts ...Attempts) time.Duration {
+	wait := time.Duration(0)
+	for _, a := range attempts {
+		if left := time.Duration(a.Retry - now.UnixNano()); left > wait {
+			wait = left
+		}
+	}
+	return wait
+}
+
+// reserve : count an attempt of the account from the ip as failed before checking
+// it so parallel attempts wait for the result, returns the attempts of the ip before
+// and after the reservation or the time left before an attempt is allowed
+func (t *TokenAuth) reserve(account string, ip string) (Attempts, Attempts, time.Duration) {
+	t.attemptsMutex.Lock()
+	defer t.attemptsMutex.Unlock()
+	now := time.Now()
+	accountAttempts := t.getAttempts(attemptAccount, account)
+	ipAttempts := t.getAttempts(attemptIP, ip)
+	wait := retry(now, accountAttempts, ipAttempts)
+	if wait > 0 {
+		return Attempts{}, Attempts{}, wait
+	}
+	t.count(accountAttempts, now, t.MaxLoginAttempts)
+	reserved := t.count(ipAttempts, now, t.MaxIPLoginAttempts)
+	return ipAttempts, reserved, 0
+}
+
+// throttle : count a reset request of the account from the ip with the limits of
+// the logins, returns the time left before a request is allowed
+func (t *TokenAuth) throttle(account string, ip string) time.Duration {
+	t.attemptsMutex.Lock()
+	defer t.attemptsMutex.Unlock()
+	now := time.Now()
+	accountAttempts := t.getAttempts(attemptReset, account)
+	ipAttempts := t.getAttempts(attemptResetIP, ip)
+	wait := retry(now, accountAttempts, ipAttempts)
+	if wait > 0 {
+		return wait
+	}
+	t.count(accountAttempts, now, t.MaxLoginAttempts)
+	t.count(ipAttempts, now, t.MaxIPLoginAttempts)
+	return 0
+}
+
+// release : undo the reservation of a successful attempt, the failures of the
+// account are cleared and the ip gets back its previous attempts, or one less
+// failure if other attempts were counted since the reservation
+func (t *TokenAuth) release(account string, previous Attempts, reserved Attempts) {
+	t.attemptsMutex.Lock()
+	defer t.attemptsMutex.Unlock()
+	t.store.Del(attemptsKey(attemptAccount, account))
+	current := t.getAttempts(attemptIP, reserved.ID)
+	if current.Retry == reserved.Retry {
+		current = previous
+	} else {
+		current.Failures--
+	}
+	if current.Failures <= 0 {
+		t.store.Del(attemptsKey(attemptIP, reserved.ID))
+		return
+	}
+	data, err := json.Marshal(current)
+	if err == nil {
+		t.store.SetTTL(attemptsKey(attemptIP, reserved.ID), string(data), t.LockoutDuration)
+	}
+}
+
+// login : check the credentials throttling the failed attempts of the account
+// and ip, unknown accounts and wrong passwords fail with the same error
+func (t *TokenAuth) login(credentials Credentials, ip string) (User, time.Duration, error) {
+	previous, reserved, wait := t.reserve(credentials.Account, ip)
+	if wait > 0 {
+		return User{}, wait, errTooManyAttempts
+	}
+
+	user, err := t.getUser(credentials.Account)
+	hash := []byte(user.Password)
+	if err != nil {
+		hash = dummyHash
+	}
+	err = bcrypt.CompareHashAndPassword(hash, []byte(credentials.Password))
+	if err != nil || user.Account == "" {
+		return user, 0, errInvalidCredentials
+	}
+
+	t.release(credentials.Account, previous, reserved)
+	return user, 0, nil
+}
+
+// getLockouts : accounts and ips with failed attempts
+func (t *TokenAuth) getLockouts() ([]Attempts, error) {
+	lockouts := []Attempts{}
+	raw, err := t.store.Get("attempts/*/*")
+	if err != nil {
+		return nil, err
+	}
+	var objs []objects.Object
+	err = json.Unmarshal(raw, &objs)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().UnixNano()
+	for _, obj := range objs {
+		if obj.Expires != 0 && now > obj.Expires {
+			continue
+		}
+		var attempts Attempts
+		err = json.Unmarshal([]byte(obj.Data), &attempts)
+		if err == nil {
+			lockouts = append(lockouts, attempts)
+		}
+	}
+	return lockouts, nil
+}
+
+// Lockouts : send the failed attempts of the accounts and ips (root only access)
+func (t *TokenAuth) Lockouts(w http.ResponseWriter, r *http.Request) {
+	role, _, err := t.Audit(r)
+	if err != nil || role != "root" {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Method not suported for your role")
+		return
+	}
+
+	lockouts, err := t.getLockouts()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(&lockouts)
+}
+
+// ClearLockout : remove the failed attempts of an account or ip (root only access)
+func (t *TokenAuth) ClearLockout(w http.ResponseWriter, r *http.Request) {
+	role, _, err := t.Audit(r)
+	if err != nil || role != "root" {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Method not suported for your role")
+		return
+	}
+
+	kind := mux.Vars(r)["kind"]
+	if kind != attemptAccount && kind != attemptIP && kind != attemptReset && kind != attemptResetIP {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", errors.New("unknown lockout kind "+kind))
+		return
+	}
+
+	err = t.store.Del(attemptsKey(kind, mux.Vars(r)["id"]))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tooManyAttempts : respond to a throttled login or reset
+func tooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	seconds := int64(wait / time.Second)
+	if wait%time.Second != 0 {
+		seconds++
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	w.WriteHeader(http.StatusTooManyRequests)
+	fmt.Fprint(w, errTooManyAttempts)
+}
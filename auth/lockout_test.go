@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func login(server http.Handler, ip string, account string, password string) *http.Response {
+	req := httptest.NewRequest("POST", "/authorize", bytes.NewBufferString(`{"account":"`+account+`","password":"`+password+`"}`))
+	req.RemoteAddr = ip + ":1234"
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	return w.Result()
+}
+
+func TestLoginErrors(t *testing.T) {
+	server, _ := newTestAuth(t, nil)
+	defer server.Close(os.Interrupt)
+	register(t, server, "root")
+
+	unknown := login(server.Router, "10.0.0.1", "nobody", "000")
+	wrong := login(server.Router, "10.0.0.2", "root", "111")
+	require.Equal(t, http.StatusForbidden, unknown.StatusCode)
+	require.Equal(t, http.StatusForbidden, wrong.StatusCode)
+	unknownBody, _ := ioutil.ReadAll(unknown.Body)
+	wrongBody, _ := ioutil.ReadAll(wrong.Body)
+	require.Equal(t, "invalid credentials", string(unknownBody))
+	require.Equal(t, string(unknownBody), string(wrongBody))
+}
+
+func TestLoginBackoff(t *testing.T) {
+	server, auth := newTestAuth(t, nil)
+	defer server.Close(os.Interrupt)
+	auth.LoginBackoff = 100 * time.Millisecond
+	auth.LockoutDuration = 600 * time.Millisecond
+	auth.MaxLoginAttempts = 3
+	root := register(t, server, "root")
+
+	require.Equal(t, http.StatusForbidden, login(server.Router, "10.0.0.1", "root", "111").StatusCode)
+	// the backoff applies even with the right password
+	throttled := login(server.Router, "10.0.0.1", "root", "000")
+	require.Equal(t, http.StatusTooManyRequests, throttled.StatusCode)
+	require.Equal(t, "1", throttled.Header.Get("Retry-After"))
+	time.Sleep(120 * time.Millisecond)
+	require.Equal(t, http.StatusForbidden, login(server.Router, "10.0.0.2", "root", "111").StatusCode)
+	time.Sleep(120 * time.Millisecond)
+	require.Equal(t, http.StatusTooManyRequests, login(server.Router, "10.0.0.3", "root", "000").StatusCode)
+	time.Sleep(120 * time.Millisecond)
+	require.Equal(t, http.StatusForbidden, login(server.Router, "10.0.0.4", "root", "111").StatusCode)
+
+	// locked out
+	time.Sleep(300 * time.Millisecond)
+	require.Equal(t, http.StatusTooManyRequests, login(server.Router, "10.0.0.5", "root", "000").StatusCode)
+	response := call(t, server.Router, "GET", "/lockouts", root, "")
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	var lockouts []Attempts
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&lockouts))
+	found := false
+	for _, lockout := range lockouts {
+		if lockout.Kind == "account" {
+			found = true
+			require.Equal(t, "root", lockout.ID)
+			require.Equal(t, 3, lockout.Failures)
+		}
+	}
+	require.True(t, found)
+
+	// cleared by root
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "DELETE", "/lockout/account/root", "", "").StatusCode)
+	require.Equal(t, http.StatusNoContent, call(t, server.Router, "DELETE", "/lockout/account/root", root, "").StatusCode)
+	require.Equal(t, http.StatusOK, login(server.Router, "10.0.0.5", "root", "000").StatusCode)
+
+	// the window expires
+	require.Equal(t, http.StatusForbidden, login(server.Router, "10.0.0.5", "root", "111").StatusCode)
+	time.Sleep(650 * time.Millisecond)
+	require.Equal(t, http.StatusOK, login(server.Router, "10.0.0.5", "root", "000").StatusCode)
+}
+
+func TestLoginIPLockout(t *testing.T) {
+	server, auth := newTestAuth(t, nil)
+	defer server.Close(os.Interrupt)
+	auth.LoginBackoff = time.Millisecond
+	auth.MaxIPLoginAttempts = 3
+	root := register(t, server, "root")
+	register(t, server, "bob")
+
+	for _, account := range []string{"a1", "a2", "a3"} {
+		require.Equal(t, http.StatusForbidden, login(server.Router, "10.0.0.9", account, "000").StatusCode)
+		time.Sleep(5 * time.Millisecond)
+	}
+	require.Equal(t, http.StatusTooManyRequests, login(server.Router, "10.0.0.9", "bob", "000").StatusCode)
+	require.Equal(t, http.StatusOK, login(server.Router, "10.0.0.8", "bob", "000").StatusCode)
+	require.Equal(t, http.StatusNoContent, call(t, server.Router, "DELETE", "/lockout/ip/10.0.0.9", root, "").StatusCode)
+	require.Equal(t, http.StatusOK, login(server.Router, "10.0.0.9", "bob", "000").StatusCode)
+}
+
+func TestLoginParallel(t *testing.T) {
+	server, auth := newTestAuth(t, nil)
+	defer server.Close(os.Interrupt)
+	register(t, server, "root")
+
+	// parallel attempts wait for the one being checked
+	var wg sync.WaitGroup
+	statuses := make([]int, 10)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i] = login(server.Router, "10.0.0."+strconv.Itoa(i), "root", "111").StatusCode
+		}(i)
+	}
+	wg.Wait()
+	failed := 0
+	for _, status := range statuses {
+		if status == http.StatusForbidden {
+			failed++
+			continue
+		}
+		require.Equal(t, http.StatusTooManyRequests, status)
+	}
+	require.Equal(t, 1, failed)
+	require.Equal(t, 1, auth.getAttempts(attemptAccount, "root").Failures)
+
+	// a successful attempt gives back the attempt reserved for the ip
+	require.NoError(t, auth.store.Del(attemptsKey(attemptAccount, "root")))
+	require.Equal(t, http.StatusOK, login(server.Router, "10.0.0.20", "root", "000").StatusCode)
+	require.Equal(t, 0, auth.getAttempts(attemptIP, "10.0.0.20").Failures)
+	require.Equal(t, http.StatusOK, login(server.Router, "10.0.0.20", "root", "000").StatusCode)
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"net/smtp"
+	"strings"
+	"sync"
+)
+
+// Mailer : sends the emails of the reset and verification flows
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+// Mail : message sent by a mailer
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// SMTPMailer : mailer that sends through an smtp server
+//
+// Address: host:port of the smtp server
+//
+// From: sender address
+//
+// Auth: smtp authentication, nil to send without authenticating
+type SMTPMailer struct {
+	Address string
+	From    string
+	Auth    smtp.Auth
+}
+
+// Send : deliver a plain text email
+func (m *SMTPMailer) Send(to string, subject string, body string) error {
+	message := "From: " + m.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		strings.Replace(body, "\n", "\r\n", -1)
+	return smtp.SendMail(m.Address, m.Auth, m.From, []string{to}, []byte(message))
+}
+
+// MemoryMailer : mailer that keeps the messages in memory, used for testing
+type MemoryMailer struct {
+	mutex    sync.Mutex
+	messages []Mail
+}
+
+// Send : keep the message
+func (m *MemoryMailer) Send(to string, subject string, body string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.messages = append(m.messages, Mail{To: to, Subject: subject, Body: body})
+	return nil
+}
+
+// Messages : every message sent
+func (m *MemoryMailer) Messages() []Mail {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]Mail{}, m.messages...)
+}
+
+// Last : last message sent to an address, false if there is none
+func (m *MemoryMailer) Last(to string) (Mail, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		if m.messages[i].To == to {
+			return m.messages[i], true
+		}
+	}
+	return Mail{}, false
+}
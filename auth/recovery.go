@@ -0,0 +1,253 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/benitogf/katamari/objects"
+)
+
+// purposes of the single use tokens
+const (
+	purposeReset  = "reset"
+	purposeVerify = "verify"
+)
+
+// Message : subject and body of an email with a single use token
+type Message func(user User, token string) (string, string)
+
+// pending : single use token stored in the auth database until it's used or expires
+type pending struct {
+	Account string `json:"account"`
+	Email   string `json:"email"`
+	Purpose string `json:"purpose"`
+	Used    bool   `json:"used"`
+}
+
+var (
+	errInvalidToken = errors.New("invalid token")
+	errNoMailer     = errors.New("mailer not configured")
+	errNotVerified  = errors.New("email not verified")
+)
+
+func defaultResetMessage(user User, token string) (string, string) {
+	return "password reset", "Use this token to reset the password of " + user.Account + ":\n\n" + token + "\n"
+}
+
+func defaultVerifyMessage(user User, token string) (string, string) {
+	return "email verification", "Use this token to verify the email of " + user.Account + ":\n\n" + token + "\n"
+}
+
+// single : signed token of the user for a purpose that can be used once, the type
+// and audience tell it apart from the access tokens for the offline verifiers
+func (t *TokenAuth) single(user User, purpose string, ttl time.Duration) (string, error) {
+	token, err := t.tokenStore.NewToken()
+	if err != nil {
+		return "", err
+	}
+	token.Header["typ"] = purpose + "+jwt"
+	token.SetClaim("iss", user.Account)
+	token.SetClaim("aud", purpose)
+	token.SetClaim("purpose", purpose)
+	token.SetClaim("exp", time.Now().Add(ttl).UnixNano())
+	data, err := json.Marshal(pending{Account: user.Account, Email: user.Email, Purpose: purpose})
+	if err != nil {
+		return "", err
+	}
+	_, err = t.store.SetTTL("pending/"+token.Claims("jti").(string), string(data), ttl)
+	if err != nil {
+		return "", err
+	}
+	return token.String(), nil
+}
+
+// use : verify a single use token for a purpose and mark it as used
+func (t *TokenAuth) use(str string, purpose string) (pending, error) {
+	token, err := t.tokenStore.CheckToken(str)
+	if err != nil {
+		return pending{}, errInvalidToken
+	}
+	claimed, _ := token.Claims("purpose").(string)
+	jti, _ := token.Claims("jti").(string)
+	if claimed != purpose || token.Claims("aud") != purpose || jti == "" {
+		return pending{}, errInvalidToken
+	}
+
+	var current pending
+	_, err = t.store.Update("pending/"+jti, func(obj objects.Object) (string, error) {
+		if obj.Expires != 0 && time.Now().UTC().UnixNano() > obj.Expires {
+			return "", errInvalidToken
+		}
+		err := json.Unmarshal([]byte(obj.Data), &current)
+		if err != nil {
+			return "", err
+		}
+		if current.Used || current.Purpose != purpose || current.Account != token.Claims("iss") {
+			return "", errInvalidToken
+		}
+		current.Used = true
+		data, err := json.Marshal(current)
+		return string(data), err
+	})
+	if err != nil {
+		return pending{}, errInvalidToken
+	}
+
+	return current, nil
+}
+
+// sendReset : mail a reset token to the email of the account if it exists
+func (t *TokenAuth) sendReset(account string) error {
+	user, err := t.getUser(account)
+	if err != nil {
+		return err
+	}
+	token, err := t.single(user, purposeReset, t.ResetExpire)
+	if err != nil {
+		return err
+	}
+	subject, body := t.ResetMessage(user, token)
+	return t.Mailer.Send(user.Email, subject, body)
+}
+
+// sendVerification : mail a verification token to the email of the user
+func (t *TokenAuth) sendVerification(user User) error {
+	if t.Mailer == nil {
+		return errNoMailer
+	}
+	token, err := t.single(user, purposeVerify, t.VerifyExpire)
+	if err != nil {
+		return err
+	}
+	subject, body := t.VerifyMessage(user, token)
+	return t.Mailer.Send(user.Email, subject, body)
+}
+
+// Reset : POST {"account"} mails a reset token to the email of the account in the
+// background, the response doesn't reveal if the account exists and the requests are
+// throttled like the logins. PUT {"token", "password"} sets the new password and
+// revokes every token of the account
+func (t *TokenAuth) Reset(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var payload struct {
+		Account  string `json:"account"`
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		if t.Mailer == nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, errNoMailer)
+			return
+		}
+		wait := t.throttle(payload.Account, remoteIP(r))
+		if wait > 0 {
+			tooManyAttempts(w, wait)
+			return
+		}
+		go t.sendReset(payload.Account)
+		w.WriteHeader(http.StatusAccepted)
+	case "PUT":
+		if len(payload.Password) < 3 || len(payload.Password) > 88 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%s", errors.New("password character count must be between 2 and 88"))
+			return
+		}
+		current, err := t.use(payload.Token, purposeReset)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, err)
+			return
+		}
+		user, err := t.getUser(current.Account)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, errInvalidToken)
+			return
+		}
+		user.Password = payload.Password
+		// the reset token proves access to the email it was sent to
+		user.Verified = user.Verified || user.Email == current.Email
+		err = t.setUser(user, false)
+		if err == nil {
+			err = t.logoutAll(user.Account)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// VerifyEmail : POST mails a verification token to the email of the account of the
+// request, PUT {"token"} marks the email of the account as verified
+func (t *TokenAuth) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	switch r.Method {
+	case "POST":
+		_, account, err := t.Audit(r)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, "%s", errors.New("this request is not authorized"))
+			return
+		}
+		user, err := t.getUser(account)
+		if err == nil {
+			err = t.sendVerification(user)
+		}
+		if err == errNoMailer {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, err)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	case "PUT":
+		var payload struct {
+			Token string `json:"token"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&payload)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+		current, err := t.use(payload.Token, purposeVerify)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, err)
+			return
+		}
+		user, err := t.getUser(current.Account)
+		if err != nil || user.Email != current.Email {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, errInvalidToken)
+			return
+		}
+		user.Verified = true
+		err = t.setUser(user, true)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// mailed : token of the last message sent to an address
+func mailed(t *testing.T, mailer *MemoryMailer, to string) string {
+	mail, ok := mailer.Last(to)
+	require.True(t, ok)
+	lines := strings.Split(strings.TrimSpace(mail.Body), "\n")
+	return lines[len(lines)-1]
+}
+
+func TestPasswordReset(t *testing.T) {
+	mailer := &MemoryMailer{}
+	server, auth := newTestAuth(t, mailer)
+	defer server.Close(os.Interrupt)
+	auth.LoginBackoff = time.Millisecond
+	token := register(t, server, "bob")
+
+	// unknown accounts get the same response and no message is sent
+	require.Equal(t, http.StatusAccepted, call(t, server.Router, "POST", "/reset", "", `{"account":"nobody"}`).StatusCode)
+	time.Sleep(5 * time.Millisecond)
+	require.Equal(t, http.StatusAccepted, call(t, server.Router, "POST", "/reset", "", `{"account":"bob"}`).StatusCode)
+	require.Eventually(t, func() bool { return len(mailer.Messages()) == 2 }, time.Second, time.Millisecond)
+	mail, _ := mailer.Last("bob@test.test")
+	require.Equal(t, "password reset", mail.Subject)
+	reset := mailed(t, mailer, "bob@test.test")
+
+	// reset tokens can't authenticate requests
+	parsed, err := auth.tokenStore.CheckToken(reset)
+	require.NoError(t, err)
+	require.Equal(t, "reset+jwt", parsed.(*JwtToken).Header["typ"])
+	require.Equal(t, "reset", parsed.Claims("aud"))
+	require.Equal(t, http.StatusUnauthorized, call(t, server.Router, "GET", "/", reset, "").StatusCode)
+	require.Equal(t, http.StatusBadRequest, call(t, server.Router, "PUT", "/reset", "", `{"token":"`+reset+`","password":"1"}`).StatusCode)
+	require.Equal(t, http.StatusUnauthorized, call(t, server.Router, "PUT", "/reset", "", `{"token":"invalid","password":"111"}`).StatusCode)
+	require.Equal(t, http.StatusNoContent, call(t, server.Router, "PUT", "/reset", "", `{"token":"`+reset+`","password":"111"}`).StatusCode)
+	require.Equal(t, http.StatusUnauthorized, call(t, server.Router, "PUT", "/reset", "", `{"token":"`+reset+`","password":"222"}`).StatusCode)
+
+	// previous tokens are revoked and the new password works
+	require.Equal(t, http.StatusUnauthorized, call(t, server.Router, "GET", "/", token, "").StatusCode)
+	status, _ := credentials(t, server, "POST", `{"account":"bob","password":"111"}`)
+	require.Equal(t, http.StatusOK, status)
+	status, _ = credentials(t, server, "POST", `{"account":"bob","password":"000"}`)
+	require.Equal(t, http.StatusForbidden, status)
+}
+
+func TestResetThrottle(t *testing.T) {
+	server, auth := newTestAuth(t, &MemoryMailer{})
+	defer server.Close(os.Interrupt)
+	auth.LoginBackoff = time.Millisecond
+	auth.MaxLoginAttempts = 2
+
+	require.Equal(t, http.StatusAccepted, call(t, server.Router, "POST", "/reset", "", `{"account":"bob"}`).StatusCode)
+	resp := call(t, server.Router, "POST", "/reset", "", `{"account":"bob"}`)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "1", resp.Header.Get("Retry-After"))
+	time.Sleep(5 * time.Millisecond)
+	require.Equal(t, http.StatusAccepted, call(t, server.Router, "POST", "/reset", "", `{"account":"bob"}`).StatusCode)
+	require.Equal(t, http.StatusTooManyRequests, call(t, server.Router, "POST", "/reset", "", `{"account":"bob"}`).StatusCode)
+
+	// the reset requests don't lock the logins
+	time.Sleep(5 * time.Millisecond)
+	status, _ := credentials(t, server, "POST", `{"account":"bob","password":"000"}`)
+	require.Equal(t, http.StatusForbidden, status)
+}
+
+func TestEmailVerification(t *testing.T) {
+	mailer := &MemoryMailer{}
+	server, auth := newTestAuth(t, mailer)
+	defer server.Close(os.Interrupt)
+	auth.RequireVerified = true
+
+	// registering mails the verification token without issuing tokens
+	require.Empty(t, register(t, server, "bob"))
+	verify := mailed(t, mailer, "bob@test.test")
+	status, _ := credentials(t, server, "POST", `{"account":"bob","password":"000"}`)
+	require.Equal(t, http.StatusForbidden, status)
+
+	require.Equal(t, http.StatusUnauthorized, call(t, server.Router, "PUT", "/reset", "", `{"token":"`+verify+`","password":"111"}`).StatusCode)
+	require.Equal(t, http.StatusNoContent, call(t, server.Router, "PUT", "/verify", "", `{"token":"`+verify+`"}`).StatusCode)
+	require.Equal(t, http.StatusUnauthorized, call(t, server.Router, "PUT", "/verify", "", `{"token":"`+verify+`"}`).StatusCode)
+	user, err := auth.getUser("bob")
+	require.NoError(t, err)
+	require.True(t, user.Verified)
+	status, c := credentials(t, server, "POST", `{"account":"bob","password":"000"}`)
+	require.Equal(t, http.StatusOK, status)
+
+	// a new email has to be verified again
+	auth.RequireVerified = false
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/user/bob", register(t, server, "root"), `{"email":"bob@other.test"}`).StatusCode)
+	user, _ = auth.getUser("bob")
+	require.False(t, user.Verified)
+	require.Equal(t, http.StatusAccepted, call(t, server.Router, "POST", "/verify", c.Token, "").StatusCode)
+	verify = mailed(t, mailer, "bob@other.test")
+	require.Equal(t, http.StatusNoContent, call(t, server.Router, "PUT", "/verify", "", `{"token":"`+verify+`"}`).StatusCode)
+	user, _ = auth.getUser("bob")
+	require.True(t, user.Verified)
+	status, _ = credentials(t, server, "POST", `{"account":"bob","password":"000"}`)
+	require.Equal(t, http.StatusOK, status)
+}
+
+func TestRequireVerifiedExisting(t *testing.T) {
+	server, auth := newTestAuth(t, &MemoryMailer{})
+	defer server.Close(os.Interrupt)
+	register(t, server, "bob")
+	alice := register(t, server, "alice")
+	root := register(t, server, "root")
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/role/manager", root, `{"permissions":[{"name":"users"}]}`).StatusCode)
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/user/alice", root, `{"role":"manager"}`).StatusCode)
+	_, c := credentials(t, server, "POST", `{"account":"alice","password":"000"}`)
+	alice = c.Token
+	auth.RequireVerified = true
+
+	// root isn't locked out and verifies the existing users
+	status, _ := credentials(t, server, "POST", `{"account":"root","password":"000"}`)
+	require.Equal(t, http.StatusOK, status)
+	status, _ = credentials(t, server, "POST", `{"account":"bob","password":"000"}`)
+	require.Equal(t, http.StatusForbidden, status)
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "POST", "/user/bob", alice, `{"verified":true}`).StatusCode)
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/user/bob", root, `{"verified":true}`).StatusCode)
+	status, _ = credentials(t, server, "POST", `{"account":"bob","password":"000"}`)
+	require.Equal(t, http.StatusOK, status)
+}
+
+func TestNoMailer(t *testing.T) {
+	server, _ := newTestAuth(t, nil)
+	defer server.Close(os.Interrupt)
+	token := register(t, server, "bob")
+	require.Equal(t, http.StatusServiceUnavailable, call(t, server.Router, "POST", "/reset", "", `{"account":"bob"}`).StatusCode)
+	require.Equal(t, http.StatusServiceUnavailable, call(t, server.Router, "POST", "/verify", token, "").StatusCode)
+}
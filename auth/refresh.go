@@ -0,0 +1,230 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/benitogf/katamari"
+	"github.com/benitogf/katamari/objects"
+)
+
+// session : refresh token stored in the auth database, the tokens
+// issued by rotating a refresh token belong to the same family
+type session struct {
+	Account string `json:"account"`
+	Family  string `json:"family"`
+	Used    bool   `json:"used"`
+	Created int64  `json:"created"`
+}
+
+// logout : tokens of the account issued before are revoked
+type logout struct {
+	Before int64 `json:"before"`
+}
+
+var (
+	errInvalidRefresh = errors.New("invalid refresh token")
+	errRefreshReuse   = errors.New("refresh token reuse detected")
+)
+
+// randomID : hex encoded random bytes
+func randomID(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// hashToken : refresh tokens are stored by their hash
+func hashToken(refresh string) string {
+	sum := sha256.Sum256([]byte(refresh))
+	return hex.EncodeToString(sum[:])
+}
+
+func (t *TokenAuth) exists(key string) bool {
+	_, err := t.store.Get(key)
+	return err == nil
+}
+
+// loggedOut : time of the last logout of every session of the account
+func (t *TokenAuth) loggedOut(account string) int64 {
+	raw, err := t.store.Get("logout/" + account)
+	if err != nil {
+		return 0
+	}
+	obj, err := objects.Decode(raw)
+	if err != nil {
+		return 0
+	}
+	var marker logout
+	err = json.Unmarshal([]byte(obj.Data), &marker)
+	if err != nil {
+		return 0
+	}
+	return marker.Before
+}
+
+// revoked : checks the revocation list for the token, its family and its account
+func (t *TokenAuth) revoked(token *JwtToken) bool {
+	jti, _ := token.Claims("jti").(string)
+	if jti != "" && t.exists("revoked/"+jti) {
+		return true
+	}
+	family, _ := token.Claims("fam").(string)
+	if family != "" && t.exists("revoked/"+family) {
+		return true
+	}
+	account, _ := token.Claims("iss").(string)
+	issued, _ := token.Claims("issued").(float64)
+	return account != "" && int64(issued) <= t.loggedOut(account)
+}
+
+// revoke : add a token or a family to the revocation list
+func (t *TokenAuth) revoke(id string, ttl time.Duration) error {
+	_, err := t.store.SetTTL("revoked/"+id, "{}", ttl)
+	return err
+}
+
+// issue : new access and refresh tokens of a family
+func (t *TokenAuth) issue(user User, family string) (Credentials, error) {
+	newToken, err := t.tokenStore.NewToken()
+	if err != nil {
+		return Credentials{}, err
+	}
+	newToken.SetClaim("iss", user.Account)
+	newToken.SetClaim("role", user.Role)
+	newToken.SetClaim("fam", family)
+	refresh := randomID(32)
+	data, err := json.Marshal(session{
+		Account: user.Account,
+		Family:  family,
+		Created: time.Now().UnixNano(),
+	})
+	if err != nil {
+		return Credentials{}, err
+	}
+	_, err = t.store.SetTTL("refresh/"+hashToken(refresh), string(data), t.RefreshExpire)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	return Credentials{
+		Account: user.Account,
+		Token:   newToken.String(),
+		Refresh: refresh,
+		Role:    user.Role,
+	}, nil
+}
+
+// rotate : exchange a refresh token of the account for new tokens of the same
+// family, reusing a refresh token revokes the whole family, the account is only
+// looked up once the refresh token is valid
+func (t *TokenAuth) rotate(account string, refresh string) (Credentials, error) {
+	var current session
+	_, err := t.store.Update("refresh/"+hashToken(refresh), func(obj objects.Object) (string, error) {
+		if obj.Expires != 0 && time.Now().UTC().UnixNano() > obj.Expires {
+			return "", errInvalidRefresh
+		}
+		err := json.Unmarshal([]byte(obj.Data), &current)
+		if err != nil {
+			return "", err
+		}
+		if current.Account != account {
+			return "", errInvalidRefresh
+		}
+		if current.Used {
+			return "", errRefreshReuse
+		}
+		current.Used = true
+		data, err := json.Marshal(current)
+		return string(data), err
+	})
+	if err == errRefreshReuse {
+		t.revoke(current.Family, t.RefreshExpire)
+		return Credentials{}, err
+	}
+	if err != nil {
+		return Credentials{}, errInvalidRefresh
+	}
+
+	if t.exists("revoked/"+current.Family) || current.Created <= t.loggedOut(current.Account) {
+		return Credentials{}, errInvalidRefresh
+	}
+
+	user, err := t.getUser(current.Account)
+	if err != nil {
+		return Credentials{}, errInvalidRefresh
+	}
+
+	return t.issue(user, current.Family)
+}
+
+// logoutAll : revoke every token issued to the account until now
+func (t *TokenAuth) logoutAll(account string) error {
+	ttl := t.RefreshExpire
+	if t.tokenStore.expireAfter > ttl {
+		ttl = t.tokenStore.expireAfter
+	}
+	_, err := t.store.SetTTL("logout/"+account, `{"before":`+strconv.FormatInt(time.Now().UnixNano(), 10)+`}`, ttl)
+	return err
+}
+
+// revoking : check the sessions of the connections of the server after
+// a handler that can revoke tokens
+func revoking(server *katamari.Server, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r)
+		go server.Stream.CheckSessions()
+	}
+}
+
+// Logout : revoke the token of the request and its family
+func (t *TokenAuth) Logout(w http.ResponseWriter, r *http.Request) {
+	token, err := t.Authenticate(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "%s", errors.New("this request is not authorized"))
+		return
+	}
+
+	jti, _ := token.Claims("jti").(string)
+	family, _ := token.Claims("fam").(string)
+	if jti != "" {
+		err = t.revoke(jti, t.tokenStore.expireAfter)
+	}
+	if err == nil && family != "" {
+		err = t.revoke(family, t.RefreshExpire)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LogoutAll : revoke every token issued to the account of the request
+func (t *TokenAuth) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	token, err := t.Authenticate(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "%s", errors.New("this request is not authorized"))
+		return
+	}
+
+	err = t.logoutAll(token.Claims("iss").(string))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
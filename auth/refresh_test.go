@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/benitogf/katamari"
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/stream"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAuth(t *testing.T, mailer *MemoryMailer) (*katamari.Server, *TokenAuth) {
+	authStore := &katamari.MemoryStorage{}
+	require.NoError(t, authStore.Start(katamari.StorageOpt{}))
+	go katamari.WatchStorageNoop(authStore)
+	auth := New(NewJwtStore("a-secret-key", time.Minute*10), authStore)
+	if mailer != nil {
+		auth.Mailer = mailer
+	}
+	server := &katamari.Server{}
+	server.Silence = true
+	server.Audit = auth.Verify
+	server.Router = mux.NewRouter()
+	auth.Router(server)
+	server.Start("localhost:0")
+	return server, auth
+}
+
+func credentials(t *testing.T, server *katamari.Server, method string, payload string) (int, Credentials) {
+	var c Credentials
+	req := httptest.NewRequest(method, "/authorize", bytes.NewBufferString(payload))
+	w := httptest.NewRecorder()
+	server.Router.ServeHTTP(w, req)
+	if w.Result().StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(w.Result().Body).Decode(&c))
+	}
+	return w.Result().StatusCode, c
+}
+
+func TestRefreshRotation(t *testing.T) {
+	server, _ := newTestAuth(t, nil)
+	defer server.Close(os.Interrupt)
+	register(t, server, "root")
+
+	status, first := credentials(t, server, "POST", `{"account":"root","password":"000"}`)
+	require.Equal(t, http.StatusOK, status)
+	require.NotEmpty(t, first.Refresh)
+
+	status, second := credentials(t, server, "PUT", `{"account":"root","refresh":"`+first.Refresh+`"}`)
+	require.Equal(t, http.StatusOK, status)
+	require.NotEqual(t, first.Refresh, second.Refresh)
+	require.Equal(t, http.StatusOK, request(server, "GET", "/", second.Token, "").StatusCode)
+
+	// reusing a rotated refresh token revokes the family
+	status, _ = credentials(t, server, "PUT", `{"account":"root","refresh":"`+first.Refresh+`"}`)
+	require.Equal(t, http.StatusUnauthorized, status)
+	require.Equal(t, http.StatusUnauthorized, request(server, "GET", "/", first.Token, "").StatusCode)
+	require.Equal(t, http.StatusUnauthorized, request(server, "GET", "/", second.Token, "").StatusCode)
+	status, _ = credentials(t, server, "PUT", `{"account":"root","refresh":"`+second.Refresh+`"}`)
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	// other families are not affected
+	status, other := credentials(t, server, "POST", `{"account":"root","password":"000"}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, http.StatusOK, request(server, "GET", "/", other.Token, "").StatusCode)
+
+	// unknown accounts and invalid refresh tokens fail the same
+	unknown := call(t, server.Router, "PUT", "/authorize", "", `{"account":"nobody","refresh":"`+other.Refresh+`"}`)
+	invalid := call(t, server.Router, "PUT", "/authorize", "", `{"account":"root","refresh":"invalid"}`)
+	empty := call(t, server.Router, "PUT", "/authorize", "", `{"account":"root"}`)
+	require.Equal(t, http.StatusUnauthorized, unknown.StatusCode)
+	require.Equal(t, http.StatusUnauthorized, invalid.StatusCode)
+	require.Equal(t, http.StatusUnauthorized, empty.StatusCode)
+	unknownBody, _ := ioutil.ReadAll(unknown.Body)
+	invalidBody, _ := ioutil.ReadAll(invalid.Body)
+	require.Equal(t, "invalid refresh token", string(unknownBody))
+	require.Equal(t, string(unknownBody), string(invalidBody))
+	status, _ = credentials(t, server, "PUT", `{"account":"root","refresh":"`+other.Refresh+`"}`)
+	require.Equal(t, http.StatusOK, status)
+}
+
+func TestLogout(t *testing.T) {
+	server, _ := newTestAuth(t, nil)
+	defer server.Close(os.Interrupt)
+	register(t, server, "root")
+
+	_, first := credentials(t, server, "POST", `{"account":"root","password":"000"}`)
+	_, second := credentials(t, server, "POST", `{"account":"root","password":"000"}`)
+	require.Equal(t, http.StatusNoContent, request(server, "POST", "/logout", first.Token, "").StatusCode)
+	require.Equal(t, http.StatusUnauthorized, request(server, "GET", "/", first.Token, "").StatusCode)
+	status, _ := credentials(t, server, "PUT", `{"account":"root","refresh":"`+first.Refresh+`"}`)
+	require.Equal(t, http.StatusUnauthorized, status)
+	require.Equal(t, http.StatusOK, request(server, "GET", "/", second.Token, "").StatusCode)
+
+	_, third := credentials(t, server, "POST", `{"account":"root","password":"000"}`)
+	require.Equal(t, http.StatusNoContent, request(server, "POST", "/logout/all", third.Token, "").StatusCode)
+	require.Equal(t, http.StatusUnauthorized, request(server, "GET", "/", second.Token, "").StatusCode)
+	require.Equal(t, http.StatusUnauthorized, request(server, "GET", "/", third.Token, "").StatusCode)
+	status, _ = credentials(t, server, "PUT", `{"account":"root","refresh":"`+second.Refresh+`"}`)
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	// a new login after the logout is valid
+	status, fourth := credentials(t, server, "POST", `{"account":"root","password":"000"}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, http.StatusOK, request(server, "GET", "/", fourth.Token, "").StatusCode)
+}
+
+func TestLogoutClosesConnections(t *testing.T) {
+	authStore := &katamari.MemoryStorage{}
+	require.NoError(t, authStore.Start(katamari.StorageOpt{}))
+	go katamari.WatchStorageNoop(authStore)
+	auth := New(NewJwtStore("a-secret-key", time.Minute*10), authStore)
+	server := &katamari.Server{}
+	server.Silence = true
+	server.Audit = auth.Verify
+	server.SessionInterval = 20 * time.Millisecond
+	server.Router = mux.NewRouter()
+	auth.Router(server)
+	server.Start("localhost:0")
+	defer server.Close(os.Interrupt)
+	register(t, server, "root")
+
+	_, first := credentials(t, server, "POST", `{"account":"root","password":"000"}`)
+	_, second := credentials(t, server, "POST", `{"account":"root","password":"000"}`)
+	dial := func(token string) *websocket.Conn {
+		u := url.URL{Scheme: "ws", Host: server.Address, Path: "/test"}
+		c, _, err := websocket.DefaultDialer.Dial(u.String(), http.Header{"Authorization": []string{"Bearer " + token}})
+		require.NoError(t, err)
+		_, _, err = c.ReadMessage()
+		require.NoError(t, err)
+		return c
+	}
+	closeCode := func(c *websocket.Conn) int {
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, _, err := c.ReadMessage()
+		closeErr, ok := err.(*websocket.CloseError)
+		require.True(t, ok)
+		return closeErr.Code
+	}
+
+	revoked := dial(first.Token)
+	defer revoked.Close()
+	renewed := dial(first.Token)
+	defer renewed.Close()
+	reply := messages.Reply{}
+	require.NoError(t, renewed.WriteJSON(messages.Command{ID: "1", Op: "auth", Data: second.Token}))
+	require.NoError(t, renewed.ReadJSON(&reply))
+	require.Empty(t, reply.Error)
+
+	require.Equal(t, http.StatusNoContent, request(server, "POST", "/logout", first.Token, "").StatusCode)
+	require.Equal(t, stream.CloseRevoked, closeCode(revoked))
+	require.NoError(t, renewed.WriteJSON(messages.Command{ID: "2", Op: "auth", Data: second.Token}))
+	require.NoError(t, renewed.ReadJSON(&reply))
+	require.Equal(t, "2", reply.ID)
+
+	require.Equal(t, http.StatusNoContent, request(server, "POST", "/logout/all", second.Token, "").StatusCode)
+	require.Equal(t, stream.CloseRevoked, closeCode(renewed))
+}
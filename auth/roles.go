@@ -0,0 +1,345 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/benitogf/katamari/key"
+	"github.com/benitogf/katamari/objects"
+	"github.com/gorilla/mux"
+)
+
+// permissions required by the auth endpoints
+const (
+	PermissionUsers = "users"
+	PermissionRoles = "roles"
+)
+
+// Permission : named permission, limited to the keys that match
+// the globs when there are any
+type Permission struct {
+	Name string   `json:"name"`
+	Keys []string `json:"keys,omitempty"`
+}
+
+// Role : named set of permissions, a role also has the permissions of
+// the roles it inherits, root has every permission and can't be stored
+type Role struct {
+	Name        string       `json:"name"`
+	Permissions []Permission `json:"permissions"`
+	Inherits    []string     `json:"inherits,omitempty"`
+}
+
+var roleRegexp = regexp.MustCompile("^[a-zA-Z0-9_]{2,15}$")
+
+func (t *TokenAuth) getRole(name string) (Role, error) {
+	var role Role
+	raw, err := t.store.Get("roles/" + name)
+	if err != nil {
+		return role, err
+	}
+	var obj objects.Object
+	err = json.Unmarshal(raw, &obj)
+	if err != nil {
+		return role, err
+	}
+	err = json.Unmarshal([]byte(obj.Data), &role)
+	return role, err
+}
+
+func (t *TokenAuth) getRoles() ([]Role, error) {
+	roles := []Role{}
+	raw, err := t.store.Get("roles/*")
+	if err != nil {
+		return nil, err
+	}
+	var objs []objects.Object
+	err = json.Unmarshal(raw, &objs)
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range objs {
+		var role Role
+		err = json.Unmarshal([]byte(obj.Data), &role)
+		if err == nil {
+			roles = append(roles, role)
+		}
+	}
+	return roles, nil
+}
+
+// lineage : the role and every role it inherits, stored roles that
+// don't exist are skipped
+func (t *TokenAuth) lineage(name string) []Role {
+	lineage := []Role{}
+	visited := map[string]bool{}
+	pending := []string{name}
+	for len(pending) > 0 {
+		current := pending[0]
+		pending = pending[1:]
+		if visited[current] {
+			continue
+		}
+		visited[current] = true
+		role, err := t.getRole(current)
+		if err != nil {
+			continue
+		}
+		lineage = append(lineage, role)
+		pending = append(pending, role.Inherits...)
+	}
+	return lineage
+}
+
+// HasRole : the role is the other role or inherits it
+func (t *TokenAuth) HasRole(role string, other string) bool {
+	if role == "" {
+		return false
+	}
+	if role == other {
+		return true
+	}
+	for _, inherited := range t.lineage(role) {
+		if inherited.Name == other {
+			return true
+		}
+	}
+	return false
+}
+
+// Can : the role or the roles it inherits have the permission on the key,
+// an empty key only matches the permissions that aren't limited to keys
+func (t *TokenAuth) Can(role string, permission string, _key string) bool {
+	if role == "root" {
+		return true
+	}
+	if role == "" {
+		return false
+	}
+	for _, inherited := range t.lineage(role) {
+		for _, granted := range inherited.Permissions {
+			if granted.Name != permission {
+				continue
+			}
+			if len(granted.Keys) == 0 {
+				return true
+			}
+			for _, glob := range granted.Keys {
+				if _key != "" && key.Match(glob, _key) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Allowed : the token of the request has the permission on the key
+func (t *TokenAuth) Allowed(r *http.Request, permission string, _key string) bool {
+	role, _, err := t.Audit(r)
+	if err != nil {
+		return false
+	}
+	return t.Can(role, permission, _key)
+}
+
+// AccountCan : the role of the account has the permission on the key,
+// can be used on scoped filters with the account as principal
+func (t *TokenAuth) AccountCan(account string, permission string, _key string) bool {
+	user, err := t.getUser(account)
+	if err != nil {
+		return false
+	}
+	return t.Can(user.Role, permission, _key)
+}
+
+// Permit : audit function that allows the requests which token has
+// the permission on the key of the path, can be used as the Audit of the server
+func (t *TokenAuth) Permit(permission string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		return t.Allowed(r, permission, strings.Trim(r.URL.Path, "/"))
+	}
+}
+
+// validRole : the role can be assigned to a user
+func (t *TokenAuth) validRole(name string) bool {
+	if name == "root" || name == "user" {
+		return true
+	}
+	_, err := t.getRole(name)
+	return err == nil
+}
+
+func (t *TokenAuth) validateRole(role Role) error {
+	if !roleRegexp.MatchString(role.Name) {
+		return errors.New("role name cannot contain special characters and character count must be between 2 and 15")
+	}
+	if role.Name == "root" {
+		return errors.New("the root role can't be modified")
+	}
+	for _, permission := range role.Permissions {
+		if permission.Name == "" {
+			return errors.New("permission name required")
+		}
+		for _, glob := range permission.Keys {
+			if !key.IsValid(glob) {
+				return errors.New("invalid permission key " + glob)
+			}
+		}
+	}
+	for _, inherited := range role.Inherits {
+		if inherited == "root" {
+			return errors.New("the root role can't be inherited")
+		}
+		if inherited == role.Name {
+			return errors.New("role " + role.Name + " can't inherit itself")
+		}
+		_, err := t.getRole(inherited)
+		if err != nil {
+			return errors.New("unknown role " + inherited)
+		}
+		for _, ancestor := range t.lineage(inherited) {
+			if ancestor.Name == role.Name {
+				return errors.New("role " + role.Name + " is inherited by " + inherited)
+			}
+		}
+	}
+
+	return nil
+}
+
+// grants : the caller role holds every permission the role would grant,
+// including the permissions of the roles it inherits
+func (t *TokenAuth) grants(caller string, role Role) error {
+	if caller == "root" {
+		return nil
+	}
+	permissions := append([]Permission{}, role.Permissions...)
+	for _, inherited := range role.Inherits {
+		for _, ancestor := range t.lineage(inherited) {
+			permissions = append(permissions, ancestor.Permissions...)
+		}
+	}
+	for _, permission := range permissions {
+		if len(permission.Keys) == 0 && !t.Can(caller, permission.Name, "") {
+			return errors.New("can't grant the permission " + permission.Name)
+		}
+		for _, glob := range permission.Keys {
+			if !t.Can(caller, permission.Name, glob) {
+				return errors.New("can't grant the permission " + permission.Name + " on " + glob)
+			}
+		}
+	}
+	return nil
+}
+
+// Roles : send the stored roles
+func (t *TokenAuth) Roles(w http.ResponseWriter, r *http.Request) {
+	if !t.Allowed(r, PermissionRoles, "roles/*") {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Method not suported for your role")
+		return
+	}
+
+	roles, err := t.getRoles()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(&roles)
+}
+
+// RoleHandler : get, store or delete a role, other than root callers can't
+// change the roles they have or grant permissions they don't hold
+func (t *TokenAuth) RoleHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	caller, _, err := t.Audit(r)
+	if err != nil || !t.Can(caller, PermissionRoles, "roles/"+name) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Method not suported for your role")
+		return
+	}
+	if r.Method != "GET" && caller != "root" && t.HasRole(caller, name) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "%s", errors.New("role "+name+" is part of your role"))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		role, err := t.getRole(name)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.Encode(&role)
+	case "POST":
+		var role Role
+		err := json.NewDecoder(r.Body).Decode(&role)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, errors.New("invalid role data"))
+			return
+		}
+		role.Name = name
+		if role.Permissions == nil {
+			role.Permissions = []Permission{}
+		}
+		err = t.validateRole(role)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%s", err)
+			return
+		}
+		err = t.grants(caller, role)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "%s", err)
+			return
+		}
+		dataBytes := new(bytes.Buffer)
+		json.NewEncoder(dataBytes).Encode(role)
+		_, err = t.store.Set("roles/"+name, string(dataBytes.Bytes()))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.Encode(&role)
+	case "DELETE":
+		roles, err := t.getRoles()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+		for _, role := range roles {
+			if contains(role.Inherits, name) {
+				w.WriteHeader(http.StatusConflict)
+				fmt.Fprintf(w, "%s", errors.New("role "+name+" is inherited by "+role.Name))
+				return
+			}
+		}
+		err = t.store.Del("roles/" + name)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "%s", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func call(t *testing.T, handler http.Handler, method string, path string, token string, body string) *http.Response {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w.Result()
+}
+
+func TestRoles(t *testing.T) {
+	server, auth := newTestAuth(t, nil)
+	defer server.Close(os.Interrupt)
+	root := register(t, server, "root")
+	bob := register(t, server, "bob")
+	register(t, server, "alice")
+
+	// only root can manage roles until a role grants it
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "POST", "/role/editor", bob, `{}`).StatusCode)
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/role/editor", root,
+		`{"permissions":[{"name":"publish","keys":["news/*"]}]}`).StatusCode)
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/role/admin", root,
+		`{"permissions":[{"name":"users","keys":["users/alice"]},{"name":"roles"}],"inherits":["editor"]}`).StatusCode)
+
+	// invalid roles
+	require.Equal(t, http.StatusBadRequest, call(t, server.Router, "POST", "/role/root", root, `{}`).StatusCode)
+	require.Equal(t, http.StatusBadRequest, call(t, server.Router, "POST", "/role/other", root, `{"inherits":["missing"]}`).StatusCode)
+	require.Equal(t, http.StatusBadRequest, call(t, server.Router, "POST", "/role/editor", root, `{"inherits":["admin"]}`).StatusCode)
+	require.Equal(t, http.StatusBadRequest, call(t, server.Router, "POST", "/role/other", root, `{"permissions":[{"name":""}]}`).StatusCode)
+
+	response := call(t, server.Router, "GET", "/roles", root, "")
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	var roles []Role
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&roles))
+	require.Len(t, roles, 2)
+
+	// permissions and inheritance
+	require.True(t, auth.Can("admin", "publish", "news/1"))
+	require.False(t, auth.Can("admin", "publish", "blog/1"))
+	require.False(t, auth.Can("editor", PermissionUsers, "users/alice"))
+	require.True(t, auth.Can("admin", PermissionUsers, "users/alice"))
+	require.False(t, auth.Can("admin", PermissionUsers, "users/bob"))
+	require.True(t, auth.Can("root", "anything", ""))
+	require.False(t, auth.Can("", "publish", "news/1"))
+	require.True(t, auth.HasRole("admin", "editor"))
+	require.False(t, auth.HasRole("editor", "admin"))
+
+	// assign roles
+	require.Equal(t, http.StatusBadRequest, call(t, server.Router, "POST", "/user/bob", root, `{"role":"missing"}`).StatusCode)
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/user/bob", root, `{"role":"admin"}`).StatusCode)
+	require.True(t, auth.AccountCan("bob", "publish", "news/1"))
+	require.False(t, auth.AccountCan("alice", "publish", "news/1"))
+	_, c := credentials(t, server, "POST", `{"account":"bob","password":"000"}`)
+	bob = c.Token
+	require.Equal(t, http.StatusOK, call(t, server.Router, "GET", "/user/alice", bob, "").StatusCode)
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "GET", "/user/root", bob, "").StatusCode)
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "GET", "/users", bob, "").StatusCode)
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "POST", "/user/alice", bob, `{"role":"root"}`).StatusCode)
+	require.Equal(t, http.StatusOK, call(t, server.Router, "GET", "/roles", bob, "").StatusCode)
+
+	// audit helpers
+	req := httptest.NewRequest("GET", "/news/1", nil)
+	req.Header.Set("Authorization", "Bearer "+bob)
+	require.True(t, auth.Allowed(req, "publish", "news/1"))
+	require.True(t, auth.Permit("publish")(req))
+	require.False(t, auth.Permit("publish")(httptest.NewRequest("GET", "/news/1", nil)))
+
+	// inherited roles can't be deleted
+	require.Equal(t, http.StatusConflict, call(t, server.Router, "DELETE", "/role/editor", root, "").StatusCode)
+	require.Equal(t, http.StatusNoContent, call(t, server.Router, "DELETE", "/role/admin", root, "").StatusCode)
+	require.False(t, auth.AccountCan("bob", "publish", "news/1"))
+}
+
+func TestACLInheritedRoles(t *testing.T) {
+	server, auth := newTestAuth(t, nil)
+	defer server.Close(os.Interrupt)
+	root := register(t, server, "root")
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/role/editor", root, `{}`).StatusCode)
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/role/admin", root, `{"inherits":["editor"]}`).StatusCode)
+
+	acl, err := NewACL(auth, []Rule{{Path: "news/*", Actions: []string{"write"}, Roles: []string{"editor"}}})
+	require.NoError(t, err)
+	require.True(t, acl.Explain("editor", "bob", "news/1", "write").Allowed)
+	require.True(t, acl.Explain("admin", "bob", "news/1", "write").Allowed)
+	require.False(t, acl.Explain("user", "bob", "news/1", "write").Allowed)
+}
+
+func TestRootUsers(t *testing.T) {
+	server, _ := newTestAuth(t, nil)
+	defer server.Close(os.Interrupt)
+	root := register(t, server, "root")
+	register(t, server, "bob")
+	register(t, server, "alice")
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/role/manager", root, `{"permissions":[{"name":"users"}]}`).StatusCode)
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/user/bob", root, `{"role":"manager"}`).StatusCode)
+	_, c := credentials(t, server, "POST", `{"account":"bob","password":"000"}`)
+
+	// a role with the users permission can't manage root users
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "GET", "/user/root", c.Token, "").StatusCode)
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "POST", "/user/root", c.Token, `{"email":"bob@other.test"}`).StatusCode)
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "POST", "/user/root", c.Token, `{"role":"user"}`).StatusCode)
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "DELETE", "/user/root", c.Token, "").StatusCode)
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "PUT", "/password/root", c.Token, `{"password":"111"}`).StatusCode)
+	status, _ := credentials(t, server, "POST", `{"account":"root","password":"000"}`)
+	require.Equal(t, http.StatusOK, status)
+
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/user/alice", c.Token, `{"email":"alice@other.test"}`).StatusCode)
+	require.Equal(t, http.StatusOK, call(t, server.Router, "PUT", "/password/alice", c.Token, `{"password":"111"}`).StatusCode)
+	require.Equal(t, http.StatusNoContent, call(t, server.Router, "DELETE", "/user/alice", c.Token, "").StatusCode)
+}
+
+func TestRoleEscalation(t *testing.T) {
+	server, auth := newTestAuth(t, nil)
+	defer server.Close(os.Interrupt)
+	root := register(t, server, "root")
+	register(t, server, "bob")
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/role/base", root, `{"permissions":[{"name":"publish","keys":["news/*"]}]}`).StatusCode)
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/role/admin", root, `{"permissions":[{"name":"roles"}],"inherits":["base"]}`).StatusCode)
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/role/super", root, `{"permissions":[{"name":"users"}]}`).StatusCode)
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/user/bob", root, `{"role":"admin"}`).StatusCode)
+	_, c := credentials(t, server, "POST", `{"account":"bob","password":"000"}`)
+
+	// the roles of the caller can't be changed
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "POST", "/role/admin", c.Token, `{"permissions":[{"name":"roles"},{"name":"users"}]}`).StatusCode)
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "POST", "/role/base", c.Token, `{"permissions":[{"name":"publish"}]}`).StatusCode)
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "DELETE", "/role/base", c.Token, "").StatusCode)
+	require.Equal(t, http.StatusOK, call(t, server.Router, "GET", "/role/admin", c.Token, "").StatusCode)
+
+	// only held permissions can be granted
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "POST", "/role/editor", c.Token, `{"permissions":[{"name":"users"}]}`).StatusCode)
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "POST", "/role/editor", c.Token, `{"permissions":[{"name":"publish"}]}`).StatusCode)
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "POST", "/role/editor", c.Token, `{"permissions":[{"name":"publish","keys":["blog/*"]}]}`).StatusCode)
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "POST", "/role/editor", c.Token, `{"inherits":["super"]}`).StatusCode)
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/role/editor", c.Token, `{"permissions":[{"name":"publish","keys":["news/*","news/1"]}],"inherits":["base"]}`).StatusCode)
+	require.Equal(t, http.StatusNoContent, call(t, server.Router, "DELETE", "/role/editor", c.Token, "").StatusCode)
+	require.False(t, auth.Can("admin", PermissionUsers, "users/bob"))
+}
+
+func TestRoleAssignment(t *testing.T) {
+	server, _ := newTestAuth(t, nil)
+	defer server.Close(os.Interrupt)
+	root := register(t, server, "root")
+	register(t, server, "bob")
+	register(t, server, "alice")
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/role/base", root, `{"permissions":[{"name":"publish","keys":["news/*"]}]}`).StatusCode)
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/role/admin", root, `{"permissions":[{"name":"users"}],"inherits":["base"]}`).StatusCode)
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/role/super", root, `{"permissions":[{"name":"users"},{"name":"publish"}]}`).StatusCode)
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/user/bob", root, `{"role":"admin"}`).StatusCode)
+	_, c := credentials(t, server, "POST", `{"account":"bob","password":"000"}`)
+
+	// a role above the caller can't be assigned to anyone
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "POST", "/user/alice", c.Token, `{"role":"super"}`).StatusCode)
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "POST", "/user/bob", c.Token, `{"role":"super"}`).StatusCode)
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "POST", "/create", c.Token,
+		`{"name":"mallory","account":"mallory","password":"000","email":"mallory@test.test","phone":"123123123","role":"super"}`).StatusCode)
+	resp := call(t, server.Router, "POST", "/users/import", c.Token,
+		`[{"name":"mallory","account":"mallory","password":"000","email":"mallory@test.test","phone":"123123123","role":"super"}]`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var report ImportReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	require.Equal(t, 0, report.Imported)
+	require.Len(t, report.Errors, 1)
+
+	// roles within the permissions of the caller can be assigned
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/user/alice", c.Token, `{"role":"base"}`).StatusCode)
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/user/alice", c.Token, `{"role":"admin"}`).StatusCode)
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/user/alice", root, `{"role":"super"}`).StatusCode)
+}
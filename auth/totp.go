@@ -0,0 +1,341 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benitogf/katamari/objects"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// rfc 6238 parameters used by the authenticator apps
+const (
+	purposeTOTP   = "totp"
+	totpPeriod    = 30
+	totpDigits    = 6
+	totpSkew      = 1
+	recoveryCount = 10
+)
+
+// secondFactor : totp secret and hashed recovery codes of an account, stored in
+// the auth database, enabled once the first code of the secret is confirmed
+//
+// Last: last time step used, codes of the same or earlier steps are rejected
+type secondFactor struct {
+	Secret   string   `json:"secret"`
+	Enabled  bool     `json:"enabled"`
+	Last     int64    `json:"last"`
+	Recovery []string `json:"recovery"`
+}
+
+// Enrollment : secret of a second factor and its provisioning uri, the uri
+// can be rendered as a qr code for the authenticator apps
+type Enrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+var (
+	errInvalidCode       = errors.New("invalid code")
+	errTwoFactorEnabled  = errors.New("two factor authentication already enabled")
+	errTwoFactorDisabled = errors.New("two factor authentication not enrolled")
+	base32NoPadding      = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// totpCode : code of the secret for a time step
+func totpCode(secret []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	code := strconv.FormatUint(uint64(value%1000000), 10)
+	return strings.Repeat("0", totpDigits-len(code)) + code
+}
+
+// totpStep : time step of a code matching the secret, the steps next to the
+// current one are accepted to allow for clock drift
+func totpStep(secret string, code string, now time.Time) (int64, bool) {
+	key, err := base32NoPadding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// provisioning : otpauth uri of the secret of an account
+func provisioning(issuer string, account string, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", strconv.Itoa(totpDigits))
+	query.Set("period", strconv.Itoa(totpPeriod))
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// recoveryCodes : single use codes and their hashes
+func recoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCount)
+	hashes := make([]string, recoveryCount)
+	for i := range codes {
+		codes[i] = randomID(5)
+		hash, err := bcrypt.GenerateFromPassword([]byte(codes[i]), bcrypt.MinCost)
+		if err != nil {
+			return nil, nil, err
+		}
+		hashes[i] = string(hash)
+	}
+	return codes, hashes, nil
+}
+
+func (t *TokenAuth) getSecondFactor(account string) (secondFactor, error) {
+	var factor secondFactor
+	raw, err := t.store.Get("totp/" + account)
+	if err != nil {
+		return factor, err
+	}
+	obj, err := objects.Decode(raw)
+	if err != nil {
+		return factor, err
+	}
+	err = json.Unmarshal([]byte(obj.Data), &factor)
+	return factor, err
+}
+
+// checkCode : verify a totp or recovery code of the account, used
+// recovery codes are removed and totp codes can't be replayed
+func (t *TokenAuth) checkCode(account string, code string) error {
+	code = strings.TrimSpace(code)
+	_, err := t.store.Update("totp/"+account, func(obj objects.Object) (string, error) {
+		var factor secondFactor
+		err := json.Unmarshal([]byte(obj.Data), &factor)
+		if err != nil {
+			return "", err
+		}
+		if !factor.Enabled {
+			return "", errInvalidCode
+		}
+		step, ok := totpStep(factor.Secret, code, time.Now())
+		if ok && step > factor.Last {
+			factor.Last = step
+			data, err := json.Marshal(factor)
+			return string(data), err
+		}
+		for i, hash := range factor.Recovery {
+			if bcrypt.CompareHashAndPassword([]byte(hash), []byte(strings.ToLower(code))) == nil {
+				factor.Recovery = append(factor.Recovery[:i], factor.Recovery[i+1:]...)
+				data, err := json.Marshal(factor)
+				return string(data), err
+			}
+		}
+		return "", errInvalidCode
+	})
+	if err != nil {
+		return errInvalidCode
+	}
+	return nil
+}
+
+// unused : the single use token wasn't used yet
+func (t *TokenAuth) unused(token Token) bool {
+	jti, _ := token.Claims("jti").(string)
+	raw, err := t.store.Get("pending/" + jti)
+	if err != nil {
+		return false
+	}
+	obj, err := objects.Decode(raw)
+	if err != nil || (obj.Expires != 0 && time.Now().UTC().UnixNano() > obj.Expires) {
+		return false
+	}
+	var current pending
+	err = json.Unmarshal([]byte(obj.Data), &current)
+	return err == nil && !current.Used
+}
+
+// challenge : single use token that replaces the password on the second step of a login
+func (t *TokenAuth) challenge(user User) (Credentials, error) {
+	token, err := t.single(user, purposeTOTP, t.TwoFactorExpire)
+	if err != nil {
+		return Credentials{}, err
+	}
+	return Credentials{Account: user.Account, Role: user.Role, Challenge: token}, nil
+}
+
+// secondStep : check the challenge and the code of a login throttling the
+// failed attempts of the account and ip, the challenge is used once the code is valid
+func (t *TokenAuth) secondStep(credentials Credentials, ip string) (User, time.Duration, error) {
+	token, err := t.tokenStore.CheckToken(credentials.Challenge)
+	if err != nil || token.Claims("purpose") != purposeTOTP || token.Claims("iss") != credentials.Account || !t.unused(token) {
+		return User{}, 0, errInvalidToken
+	}
+
+	previous, reserved, wait := t.reserve(credentials.Account, ip)
+	if wait > 0 {
+		return User{}, wait, errTooManyAttempts
+	}
+
+	user, err := t.getUser(credentials.Account)
+	if err != nil {
+		return User{}, 0, errInvalidToken
+	}
+
+	err = t.checkCode(user.Account, credentials.Code)
+	if err != nil {
+		return User{}, 0, err
+	}
+
+	_, err = t.use(credentials.Challenge, purposeTOTP)
+	if err != nil {
+		return User{}, 0, err
+	}
+
+	t.release(credentials.Account, previous, reserved)
+	return user, 0, nil
+}
+
+// TwoFactor : POST starts the enrollment of the account of the request sending
+// the secret and provisioning uri, PUT {"code"} confirms it with a code of the
+// secret, enables the second factor and sends the recovery codes
+func (t *TokenAuth) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	_, account, err := t.Audit(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "%s", errors.New("this request is not authorized"))
+		return
+	}
+	user, err := t.getUser(account)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "%s", errors.New("this request is not authorized"))
+		return
+	}
+	if user.TwoFactor {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, errTwoFactorEnabled)
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		key := make([]byte, 20)
+		_, err = rand.Read(key)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+		enrollment := Enrollment{Secret: base32NoPadding.EncodeToString(key)}
+		enrollment.URI = provisioning(t.TwoFactorIssuer, account, enrollment.Secret)
+		data, err := json.Marshal(secondFactor{Secret: enrollment.Secret, Recovery: []string{}})
+		if err == nil {
+			_, err = t.store.Set("totp/"+account, string(data))
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.Encode(&enrollment)
+	case "PUT":
+		var payload struct {
+			Code string `json:"code"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&payload)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+		factor, err := t.getSecondFactor(account)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, errTwoFactorDisabled)
+			return
+		}
+		step, ok := totpStep(factor.Secret, strings.TrimSpace(payload.Code), time.Now())
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, errInvalidCode)
+			return
+		}
+		codes, hashes, err := recoveryCodes()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+		factor.Enabled = true
+		factor.Last = step
+		factor.Recovery = hashes
+		data, err := json.Marshal(factor)
+		if err == nil {
+			_, err = t.store.Set("totp/"+account, string(data))
+		}
+		if err == nil {
+			user.TwoFactor = true
+			err = t.setUser(user, true)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.Encode(&struct {
+			Recovery []string `json:"recovery"`
+		}{codes})
+	}
+}
+
+// ResetTwoFactor : remove the second factor of an account (root only access)
+func (t *TokenAuth) ResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	role, _, err := t.Audit(r)
+	if err != nil || role != "root" {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Method not suported for your role")
+		return
+	}
+
+	user, err := t.getUser(mux.Vars(r)["account"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	t.store.Del("totp/" + user.Account)
+	user.TwoFactor = false
+	err = t.setUser(user, true)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// code : current totp code of a secret
+func code(t *testing.T, secret string, offset int64) string {
+	key, err := base32NoPadding.DecodeString(secret)
+	require.NoError(t, err)
+	return totpCode(key, time.Now().Unix()/totpPeriod+offset)
+}
+
+// challenged : status and credentials of a login step that may require a second factor
+func challenged(t *testing.T, server http.Handler, payload string) (int, Credentials) {
+	var c Credentials
+	req := httptest.NewRequest("POST", "/authorize", bytes.NewBufferString(payload))
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	if w.Result().StatusCode == http.StatusOK || w.Result().StatusCode == http.StatusAccepted {
+		require.NoError(t, json.NewDecoder(w.Result().Body).Decode(&c))
+	}
+	return w.Result().StatusCode, c
+}
+
+func TestTOTP(t *testing.T) {
+	key, _ := base32NoPadding.DecodeString("GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ")
+	// rfc 6238 sha1 test vector
+	require.Equal(t, "287082", totpCode(key, 59/totpPeriod))
+	require.Equal(t, "005924", totpCode(key, 1234567890/totpPeriod))
+	_, ok := totpStep("GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", "005924", time.Unix(1234567890+totpPeriod, 0))
+	require.True(t, ok)
+	_, ok = totpStep("GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", "005924", time.Unix(1234567890+3*totpPeriod, 0))
+	require.False(t, ok)
+	require.Equal(t, "otpauth://totp/katamari:bob?algorithm=SHA1&digits=6&issuer=katamari&period=30&secret=ABC", provisioning("katamari", "bob", "ABC"))
+}
+
+func TestTwoFactor(t *testing.T) {
+	server, auth := newTestAuth(t, nil)
+	defer server.Close(os.Interrupt)
+	auth.LoginBackoff = time.Millisecond
+	token := register(t, server, "bob")
+	root := register(t, server, "root")
+
+	require.Equal(t, http.StatusUnauthorized, call(t, server.Router, "POST", "/totp", "", "").StatusCode)
+	require.Equal(t, http.StatusNotFound, call(t, server.Router, "PUT", "/totp", token, `{"code":"000000"}`).StatusCode)
+	resp := call(t, server.Router, "POST", "/totp", token, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var enrollment Enrollment
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&enrollment))
+	require.True(t, strings.HasPrefix(enrollment.URI, "otpauth://totp/katamari:bob?"))
+	require.Contains(t, enrollment.URI, "secret="+enrollment.Secret)
+
+	// the enrollment isn't enabled until a code is confirmed
+	status, _ := challenged(t, server.Router, `{"account":"bob","password":"000"}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, http.StatusBadRequest, call(t, server.Router, "PUT", "/totp", token, `{"code":"abc"}`).StatusCode)
+	enrolled := code(t, enrollment.Secret, 0)
+	resp = call(t, server.Router, "PUT", "/totp", token, `{"code":"`+enrolled+`"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var recovery struct {
+		Recovery []string `json:"recovery"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&recovery))
+	require.Len(t, recovery.Recovery, recoveryCount)
+	require.Equal(t, http.StatusConflict, call(t, server.Router, "POST", "/totp", token, "").StatusCode)
+	user, err := auth.getUser("bob")
+	require.NoError(t, err)
+	require.True(t, user.TwoFactor)
+
+	// the password step sends a challenge instead of tokens
+	status, c := challenged(t, server.Router, `{"account":"bob","password":"000"}`)
+	require.Equal(t, http.StatusAccepted, status)
+	require.Empty(t, c.Token)
+	require.NotEmpty(t, c.Challenge)
+	require.Equal(t, http.StatusUnauthorized, call(t, server.Router, "GET", "/", c.Challenge, "").StatusCode)
+
+	// the code used for the enrollment can't be replayed
+	status, _ = challenged(t, server.Router, `{"account":"bob","challenge":"`+c.Challenge+`","code":"`+enrolled+`"}`)
+	require.Equal(t, http.StatusForbidden, status)
+	time.Sleep(5 * time.Millisecond)
+	status, _ = challenged(t, server.Router, `{"account":"root","challenge":"`+c.Challenge+`","code":"`+code(t, enrollment.Secret, 1)+`"}`)
+	require.Equal(t, http.StatusForbidden, status)
+	status, issued := challenged(t, server.Router, `{"account":"bob","challenge":"`+c.Challenge+`","code":"`+code(t, enrollment.Secret, 1)+`"}`)
+	require.Equal(t, http.StatusOK, status)
+	require.NotEmpty(t, issued.Token)
+	require.Equal(t, http.StatusOK, call(t, server.Router, "GET", "/", issued.Token, "").StatusCode)
+	status, _ = challenged(t, server.Router, `{"account":"bob","challenge":"`+c.Challenge+`","code":"`+recovery.Recovery[0]+`"}`)
+	require.Equal(t, http.StatusForbidden, status)
+
+	// recovery codes can be used once
+	time.Sleep(5 * time.Millisecond)
+	_, c = challenged(t, server.Router, `{"account":"bob","password":"000"}`)
+	status, _ = challenged(t, server.Router, `{"account":"bob","challenge":"`+c.Challenge+`","code":"`+recovery.Recovery[0]+`"}`)
+	require.Equal(t, http.StatusOK, status)
+	_, c = challenged(t, server.Router, `{"account":"bob","password":"000"}`)
+	status, _ = challenged(t, server.Router, `{"account":"bob","challenge":"`+c.Challenge+`","code":"`+recovery.Recovery[0]+`"}`)
+	require.Equal(t, http.StatusForbidden, status)
+
+	// root resets the second factor
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "DELETE", "/totp/bob", token, "").StatusCode)
+	require.Equal(t, http.StatusNotFound, call(t, server.Router, "DELETE", "/totp/nobody", root, "").StatusCode)
+	require.Equal(t, http.StatusNoContent, call(t, server.Router, "DELETE", "/totp/bob", root, "").StatusCode)
+	time.Sleep(5 * time.Millisecond)
+	status, _ = challenged(t, server.Router, `{"account":"bob","password":"000"}`)
+	require.Equal(t, http.StatusOK, status)
+	_, err = auth.getSecondFactor("bob")
+	require.Error(t, err)
+}
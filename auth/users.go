@@ -0,0 +1,270 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/objects"
+	"github.com/benitogf/katamari/pivot"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// columns of the csv user directories
+var userColumns = []string{"account", "name", "email", "phone", "role", "password"}
+
+// ImportError : row of an import that wasn't stored
+type ImportError struct {
+	Row     int    `json:"row"`
+	Account string `json:"account"`
+	Error   string `json:"error"`
+}
+
+// ImportReport : result of an import, valid rows are stored even if others fail
+type ImportReport struct {
+	Imported int           `json:"imported"`
+	Errors   []ImportError `json:"errors"`
+}
+
+// validateUser : registration rules of the user fields
+func validateUser(user User) error {
+	if user.Account == "" || user.Name == "" || user.Password == "" || user.Email == "" || user.Phone == "" {
+		return errors.New("new user data incomplete")
+	}
+
+	if !userRegexp.MatchString(user.Account) {
+		return errors.New("account cannot contain special characters, only numbers or lowercase letters and character count must be between 2 and 15")
+	}
+
+	if len(user.Password) < 3 || len(user.Password) > 88 {
+		return errors.New("password character count must be between 2 and 88")
+	}
+
+	if !userRegexp.MatchString(user.Phone) {
+		return errors.New("phone cannot contain special characters othen than '-' and character count must be between 6 and 15")
+	}
+
+	if !emailRegexp.MatchString(user.Email) {
+		return errors.New("invalid email address")
+	}
+
+	return nil
+}
+
+// setUser : store the user hashing the password, unless hashed is
+// set and the password is already a bcrypt hash
+func (t *TokenAuth) setUser(user User, hashed bool) error {
+	_, err := bcrypt.Cost([]byte(user.Password))
+	if !hashed || err != nil {
+		hash, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.MinCost)
+		if err != nil {
+			return err
+		}
+		user.Password = string(hash)
+	}
+
+	dataBytes := new(bytes.Buffer)
+	json.NewEncoder(dataBytes).Encode(user)
+	_, err = t.store.Set("users/"+user.Account, string(dataBytes.Bytes()))
+	return err
+}
+
+// forbidden : the role of the caller can't assign the requested role
+type forbidden struct {
+	error
+}
+
+// assign : role requested for a user by a caller with the role, the
+// default role if none was requested, only root can assign root users
+// and the caller must hold every permission the role grants
+func (t *TokenAuth) assign(requested string, role string) (string, error) {
+	if requested == "" {
+		return t.DefaultRole, nil
+	}
+	if !t.validRole(requested) {
+		return "", errors.New("unknown role " + requested)
+	}
+	if requested == "root" {
+		if role != "root" {
+			return "", forbidden{errors.New("only root can assign the root role")}
+		}
+		return requested, nil
+	}
+	stored, err := t.getRole(requested)
+	if err != nil {
+		// the built in user role has no permissions
+		return requested, nil
+	}
+	err = t.grants(role, stored)
+	if err != nil {
+		return "", forbidden{err}
+	}
+	return requested, nil
+}
+
+// create : validate and store a user created by a caller with the role
+func (t *TokenAuth) create(user User, role string, hashed bool) (User, error) {
+	err := validateUser(user)
+	if err != nil {
+		return user, err
+	}
+
+	_, err = t.getUser(user.Account)
+	if err == nil {
+		return user, errors.New("account name taken")
+	}
+
+	// second factors are enrolled by the users
+	user.TwoFactor = false
+	user.Role, err = t.assign(user.Role, role)
+	if err != nil {
+		return user, err
+	}
+
+	err = t.setUser(user, hashed)
+	user.Password = ""
+	return user, err
+}
+
+// readUsers : users of a json list or a csv with a header row
+func readUsers(r *http.Request) ([]User, error) {
+	var users []User
+	if !messages.Includes(r.Header.Get("Content-Type"), "text/csv") {
+		err := json.NewDecoder(r.Body).Decode(&users)
+		return users, err
+	}
+
+	reader := csv.NewReader(r.Body)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return users, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		fields := map[string]string{}
+		for i, column := range header {
+			fields[strings.ToLower(strings.TrimSpace(column))] = record[i]
+		}
+		users = append(users, User{
+			Account:  fields["account"],
+			Name:     fields["name"],
+			Email:    fields["email"],
+			Phone:    fields["phone"],
+			Role:     fields["role"],
+			Password: fields["password"],
+		})
+	}
+}
+
+// Import : bulk create users from a json list or a csv (text/csv) with
+// the account, name, email, phone, role and password columns, passwords
+// can be bcrypt hashes of an exported directory
+func (t *TokenAuth) Import(w http.ResponseWriter, r *http.Request) {
+	token, err := t.Authenticate(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "Method not suported for your role")
+		return
+	}
+	role := token.Claims("role").(string)
+	if !t.Can(role, PermissionUsers, "users/*") {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Method not suported for your role")
+		return
+	}
+
+	defer r.Body.Close()
+	users, err := readUsers(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	report := ImportReport{Errors: []ImportError{}}
+	for i, user := range users {
+		_, err := t.create(user, role, true)
+		if err != nil {
+			report.Errors = append(report.Errors, ImportError{Row: i + 1, Account: user.Account, Error: err.Error()})
+			continue
+		}
+		report.Imported++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(&report)
+}
+
+// Export : send the users with their password hashes as json or
+// as csv (format=csv or Accept: text/csv) (root only access)
+func (t *TokenAuth) Export(pivotIP string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role, _, err := t.Audit(r)
+		if err != nil || role != "root" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "Method not suported for your role")
+			return
+		}
+
+		if pivotIP != "" {
+			pivot.Synchronize(t.client, t.store, pivotIP, []string{"users/*"})
+		}
+
+		users, err := t.getDirectory()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err.Error())
+			return
+		}
+
+		if r.FormValue("format") != "csv" && !messages.Includes(r.Header.Get("Accept"), "text/csv") {
+			w.Header().Set("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			enc.Encode(&users)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv")
+		writer := csv.NewWriter(w)
+		writer.Write(userColumns)
+		for _, user := range users {
+			writer.Write([]string{user.Account, user.Name, user.Email, user.Phone, user.Role, user.Password})
+		}
+		writer.Flush()
+	}
+}
+
+// getDirectory : every stored user including the password hashes
+func (t *TokenAuth) getDirectory() ([]User, error) {
+	users := []User{}
+	raw, err := t.store.Get("users/*")
+	if err != nil {
+		return nil, err
+	}
+	var objs []objects.Object
+	err = json.Unmarshal(raw, &objs)
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range objs {
+		var user User
+		err = json.Unmarshal([]byte(obj.Data), &user)
+		if err == nil {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
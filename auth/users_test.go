@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreate(t *testing.T) {
+	server, auth := newTestAuth(t, nil)
+	defer server.Close(os.Interrupt)
+	root := register(t, server, "root")
+	bob := register(t, server, "bob")
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/role/editor", root, `{}`).StatusCode)
+
+	payload := `{"name":"alice","account":"alice","password":"000","email":"alice@test.test","phone":"123123123","role":"editor"}`
+	require.Equal(t, http.StatusUnauthorized, call(t, server.Router, "POST", "/create", "", payload).StatusCode)
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "POST", "/create", bob, payload).StatusCode)
+	require.Equal(t, http.StatusBadRequest, call(t, server.Router, "POST", "/create", root, `{"name":"alice","account":"alice","password":"000"}`).StatusCode)
+	require.Equal(t, http.StatusBadRequest, call(t, server.Router, "POST", "/create", root, strings.Replace(payload, "editor", "missing", 1)).StatusCode)
+
+	response := call(t, server.Router, "POST", "/create", root, payload)
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	var user User
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&user))
+	require.Equal(t, "editor", user.Role)
+	require.Empty(t, user.Password)
+	require.Equal(t, http.StatusBadRequest, call(t, server.Router, "POST", "/create", root, payload).StatusCode)
+	status, c := credentials(t, server, "POST", `{"account":"alice","password":"000"}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "editor", c.Role)
+
+	// default and root roles
+	auth.DefaultRole = "editor"
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/role/admin", root, `{"permissions":[{"name":"users"}]}`).StatusCode)
+	require.Equal(t, http.StatusOK, call(t, server.Router, "POST", "/user/bob", root, `{"role":"admin"}`).StatusCode)
+	_, c = credentials(t, server, "POST", `{"account":"bob","password":"000"}`)
+	response = call(t, server.Router, "POST", "/create", c.Token, strings.Replace(strings.Replace(payload, "alice", "carol", -1), `,"role":"editor"`, "", 1))
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&user))
+	require.Equal(t, "editor", user.Role)
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "POST", "/create", c.Token, strings.Replace(strings.Replace(payload, "alice", "dave", -1), "editor", "root", 1)).StatusCode)
+}
+
+func TestImportExport(t *testing.T) {
+	server, _ := newTestAuth(t, nil)
+	defer server.Close(os.Interrupt)
+	root := register(t, server, "root")
+	bob := register(t, server, "bob")
+
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "GET", "/users/export", bob, "").StatusCode)
+	require.Equal(t, http.StatusForbidden, call(t, server.Router, "POST", "/users/import", bob, "[]").StatusCode)
+
+	// json
+	response := call(t, server.Router, "POST", "/users/import", root, `[
+		{"name":"alice","account":"alice","password":"000","email":"alice@test.test","phone":"123123123"},
+		{"name":"bob","account":"bob","password":"000","email":"bob@test.test","phone":"123123123"},
+		{"name":"carol","account":"carol","password":"0","email":"carol@test.test","phone":"123123123"}
+	]`)
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	var report ImportReport
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&report))
+	require.Equal(t, 1, report.Imported)
+	require.Len(t, report.Errors, 2)
+	require.Equal(t, 2, report.Errors[0].Row)
+	require.Equal(t, "account name taken", report.Errors[0].Error)
+	require.Equal(t, "carol", report.Errors[1].Account)
+
+	// csv export keeps the password hashes
+	req := httptest.NewRequest("GET", "/users/export?format=csv", nil)
+	req.Header.Set("Authorization", "Bearer "+root)
+	w := httptest.NewRecorder()
+	server.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "text/csv", w.Result().Header.Get("Content-Type"))
+	exported, err := ioutil.ReadAll(w.Result().Body)
+	require.NoError(t, err)
+	records, err := csv.NewReader(strings.NewReader(string(exported))).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+	require.Equal(t, userColumns, records[0])
+
+	// import the directory on another server
+	other, _ := newTestAuth(t, nil)
+	defer other.Close(os.Interrupt)
+	otherRoot := register(t, other, "root")
+	req = httptest.NewRequest("POST", "/users/import", strings.NewReader(string(exported)+"dave,dave,dave@test.test,123123123,,000\n"))
+	req.Header.Set("Authorization", "Bearer "+otherRoot)
+	req.Header.Set("Content-Type", "text/csv")
+	w = httptest.NewRecorder()
+	other.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	report = ImportReport{}
+	require.NoError(t, json.NewDecoder(w.Result().Body).Decode(&report))
+	require.Equal(t, 3, report.Imported)
+	require.Len(t, report.Errors, 1)
+	require.Equal(t, "root", report.Errors[0].Account)
+	for _, account := range []string{"alice", "bob", "dave"} {
+		status, _ := credentials(t, other, "POST", `{"account":"`+account+`","password":"000"}`)
+		require.Equal(t, http.StatusOK, status)
+	}
+
+	response = call(t, other.Router, "GET", "/users/export", otherRoot, "")
+	var users []User
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&users))
+	require.Len(t, users, 4)
+
+	// the password hashes are only exported to root
+	require.Equal(t, http.StatusOK, call(t, other.Router, "POST", "/role/manager", otherRoot, `{"permissions":[{"name":"users"}]}`).StatusCode)
+	require.Equal(t, http.StatusOK, call(t, other.Router, "POST", "/user/bob", otherRoot, `{"role":"manager"}`).StatusCode)
+	_, c := credentials(t, other, "POST", `{"account":"bob","password":"000"}`)
+	require.Equal(t, http.StatusForbidden, call(t, other.Router, "GET", "/users/export", c.Token, "").StatusCode)
+}
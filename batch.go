@@ -0,0 +1,119 @@
+package katamari
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/benitogf/katamari/key"
+	"github.com/benitogf/katamari/messages"
+)
+
+// operation converts a batch command into a storage operation
+// after auditing the key and passing it through the write or delete filters
+func (app *Server) operation(r *http.Request, command messages.Command) (BatchOperation, error) {
+	switch command.Op {
+	case "set":
+		if !isWritable(command.Key) {
+			return BatchOperation{}, errors.New("katamari: pathKeyError key is not valid")
+		}
+		_key := key.Build(command.Key)
+		if !app.auditCommand(r, _key, ActionWrite) {
+			return BatchOperation{}, errUnauthorized
+		}
+		data, err := app.checkWrite(_key, []byte(command.Data))
+		if err != nil {
+			return BatchOperation{}, err
+		}
+		return BatchOperation{Op: "set", Key: _key, Data: string(data)}, nil
+	case "del":
+		if !key.IsValid(command.Key) || strings.Contains(command.Key, "*") {
+			return BatchOperation{}, errors.New("katamari: pathKeyError key is not valid")
+		}
+		if !app.auditCommand(r, command.Key, ActionDelete) {
+			return BatchOperation{}, errUnauthorized
+		}
+		err := app.filters.deleteChain().check(command.Key, app.Static)
+		if err != nil {
+			return BatchOperation{}, err
+		}
+		return BatchOperation{Op: "del", Key: command.Key}, nil
+	default:
+		return BatchOperation{}, errors.New("katamari: unknown operation " + command.Op)
+	}
+}
+
+func (app *Server) batch(w http.ResponseWriter, r *http.Request) {
+	if !app.Audit(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "%s", errors.New("katamari: this request is not authorized"))
+		return
+	}
+
+	var commands []messages.Command
+	var err error
+	if messages.IsRaw(r.Header.Get("Content-Type")) {
+		commands, err = messages.DecodeRawBatch(r.Body)
+	} else {
+		commands, err = messages.DecodeBatch(r.Body)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	operations := make([]BatchOperation, len(commands))
+	for i, command := range commands {
+		operations[i], err = app.operation(r, command)
+		if err != nil {
+			app.console.Err("batchError["+command.Key+"]", err)
+			w.WriteHeader(filterStatus(err, http.StatusBadRequest))
+			fmt.Fprintf(w, "%s", err)
+			return
+		}
+	}
+
+	inMemory := key.Contains(app.InMemoryKeys, operations[0].Key)
+	for _, operation := range operations {
+		if key.Contains(app.InMemoryKeys, operation.Key) != inMemory {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%s", errors.New("katamari: a batch can't mix in memory and persistent keys"))
+			return
+		}
+	}
+
+	var indexes []string
+	if inMemory {
+		indexes, err = app.storage.MemBatch(operations)
+	} else {
+		indexes, err = app.storage.Batch(operations)
+	}
+	if err != nil {
+		app.console.Err("batchError", err)
+		if err.Error() == "katamari: not found" {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	replies := make([]messages.Reply, len(operations))
+	for i, operation := range operations {
+		app.console.Log("batch", operation.Op, operation.Key)
+		if operation.Op == "set" {
+			app.filters.afterChain().check(operation.Key)
+		}
+		replies[i] = messages.Reply{ID: commands[i].ID, Key: operation.Key, Index: indexes[i]}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(replies)
+	if err != nil {
+		app.console.Err("batchError", err)
+	}
+}
@@ -0,0 +1,139 @@
+package katamari
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/objects"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatch(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.ForcePatch = true
+	app.InMemoryKeys = []string{"cache"}
+	app.DeleteFilter("locked", func(key string) error {
+		return errors.New("can't delete " + key)
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	_, err := app.Storage.Set("stock", messages.Encode([]byte(`{"count":10}`)))
+	require.NoError(t, err)
+	_, err = app.Storage.Set("locked", messages.Encode([]byte(`{}`)))
+	require.NoError(t, err)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/orders/*"}
+	wsClient, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer wsClient.Close()
+	_, message, err := wsClient.ReadMessage()
+	require.NoError(t, err)
+	wsEvent, err := messages.DecodeTest(message)
+	require.NoError(t, err)
+	require.Equal(t, "[]", wsEvent.Data)
+
+	post := func(commands []messages.Command) *http.Response {
+		body, err := json.Marshal(commands)
+		require.NoError(t, err)
+		req := httptest.NewRequest("POST", "/_batch", bytes.NewBuffer(body))
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	resp := post([]messages.Command{
+		{Op: "set", Key: "orders/*", Data: messages.Encode([]byte(`{"item":"one"}`))},
+		{Op: "del", Key: "locked"},
+	})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = post([]messages.Command{
+		{Op: "set", Key: "orders/*", Data: messages.Encode([]byte(`{"item":"one"}`))},
+		{Op: "set", Key: "cache", Data: messages.Encode([]byte(`{}`))},
+	})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = post([]messages.Command{
+		{Op: "set", Key: "orders/*", Data: messages.Encode([]byte(`{"item":"one"}`))},
+		{Op: "del", Key: "missing"},
+	})
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = post([]messages.Command{})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	objs, err := app.Storage.GetObjList("orders/*")
+	require.NoError(t, err)
+	require.Equal(t, 0, len(objs))
+
+	resp = post([]messages.Command{
+		{ID: "order", Op: "set", Key: "orders/*", Data: messages.Encode([]byte(`{"item":"one"}`))},
+		{ID: "stock", Op: "set", Key: "stock", Data: messages.Encode([]byte(`{"count":9}`))},
+	})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	var replies []messages.Reply
+	err = json.Unmarshal(body, &replies)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(replies))
+	require.Equal(t, "order", replies[0].ID)
+	require.Equal(t, "orders/"+replies[0].Index, replies[0].Key)
+	require.Equal(t, "stock", replies[1].Key)
+
+	_, message, err = wsClient.ReadMessage()
+	require.NoError(t, err)
+	wsEvent, err = messages.DecodeTest(message)
+	require.NoError(t, err)
+	require.False(t, wsEvent.Snapshot)
+	data, err := app.Storage.Get("stock")
+	require.NoError(t, err)
+	obj, err := objects.DecodeFull(data)
+	require.NoError(t, err)
+	require.Equal(t, `{"count":9}`, obj.Data)
+}
+
+func TestBatchAudit(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.Audit = func(r *http.Request) bool {
+		return r.URL.Path == "/_batch" || (r.URL.Path == "/public" && r.Method == "POST")
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	post := func(commands []messages.Command) *http.Response {
+		body, err := json.Marshal(commands)
+		require.NoError(t, err)
+		req := httptest.NewRequest("POST", "/_batch", bytes.NewBuffer(body))
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	// each operation is audited on its key
+	resp := post([]messages.Command{
+		{Op: "set", Key: "public", Data: messages.Encode([]byte(`{}`))},
+		{Op: "set", Key: "secret", Data: messages.Encode([]byte(`{}`))},
+	})
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = post([]messages.Command{
+		{Op: "set", Key: "public", Data: messages.Encode([]byte(`{}`))},
+		{Op: "del", Key: "public"},
+	})
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	_, err := app.Storage.Get("public")
+	require.Error(t, err)
+	resp = post([]messages.Command{
+		{Op: "set", Key: "public", Data: messages.Encode([]byte(`{}`))},
+	})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,423 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benitogf/jsonpatch"
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/objects"
+	"github.com/gorilla/websocket"
+)
+
+// OnMessage callback of a subscription, receives the current
+// value(s) of the subscribed key with the data already decoded
+type OnMessage func(objs []objects.Object)
+
+// Client of a katamari server
+//
+// Address: host:port of the server
+//
+// Header: headers to send on every request (ex: Authorization)
+//
+// HTTP: http client to make requests
+//
+// Dialer: websocket dialer used on subscriptions
+//
+// Retry: time to wait between reconnection attempts of a subscription
+//
+// TLS: tls configuration to connect with https and wss, used on the
+// default http client and dialer (ex: client certificates)
+//
+// Socket: path of a unix domain socket to connect through instead
+// of the address, used on the default http client and dialer
+type Client struct {
+	Address string
+	Header  http.Header
+	HTTP    *http.Client
+	Dialer  *websocket.Dialer
+	Retry   time.Duration
+	TLS     *tls.Config
+	Socket  string
+}
+
+// Subscription to a key, keeps a local copy of the key value(s)
+// that is updated with the snapshot and patch messages of the server
+type Subscription struct {
+	mutex     sync.Mutex
+	client    *Client
+	conn      *websocket.Conn
+	key       string
+	version   string
+	cache     []byte
+	closed    bool
+	onMessage OnMessage
+}
+
+// New client of the server at address
+func New(address string) *Client {
+	return &Client{Address: address}
+}
+
+func (c *Client) defaults() {
+	if c.Address == "" && c.Socket != "" {
+		c.Address = "localhost"
+	}
+
+	if c.HTTP == nil {
+		c.HTTP = &http.Client{Timeout: 30 * time.Second}
+		if c.TLS != nil || c.Socket != "" {
+			c.HTTP.Transport = &http.Transport{TLSClientConfig: c.TLS, DialContext: c.dial}
+		}
+	}
+
+	if c.Dialer == nil {
+		c.Dialer = websocket.DefaultDialer
+		if c.TLS != nil || c.Socket != "" {
+			dialer := *websocket.DefaultDialer
+			dialer.TLSClientConfig = c.TLS
+			dialer.NetDialContext = c.dial
+			c.Dialer = &dialer
+		}
+	}
+
+	if c.Retry == 0 {
+		c.Retry = 1 * time.Second
+	}
+}
+
+// dial the socket if defined or the requested address
+func (c *Client) dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	if c.Socket != "" {
+		return dialer.DialContext(ctx, "unix", c.Socket)
+	}
+
+	return dialer.DialContext(ctx, network, address)
+}
+
+// scheme of the urls, secure when the client uses tls
+func (c *Client) scheme(plain string, secure string) string {
+	if c.TLS != nil {
+		return secure
+	}
+
+	return plain
+}
+
+func (c *Client) request(method string, path string, body []byte, header http.Header) ([]byte, error) {
+	c.defaults()
+	u := url.URL{Scheme: c.scheme("http", "https"), Host: c.Address, Path: "/" + path}
+	req, err := http.NewRequest(method, u.String(), bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range c.Header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	for name, values := range header {
+		for _, value := range values {
+			req.Header.Set(name, value)
+		}
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, errors.New("katamari: " + method + " " + path + " failed with status " +
+			fmt.Sprint(resp.StatusCode) + ", " + strings.TrimSpace(string(data)))
+	}
+
+	return data, nil
+}
+
+// Keys list the keys available in the server
+func (c *Client) Keys() ([]string, error) {
+	var stats struct {
+		Keys []string `json:"keys"`
+	}
+	data, err := c.request("GET", "", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &stats)
+	return stats.Keys, err
+}
+
+// Get a key value, the key cannot include a glob pattern
+func (c *Client) Get(key string) (objects.Object, error) {
+	if strings.Contains(key, "*") {
+		return objects.Object{}, errors.New("katamari: use GetList to read glob patterns")
+	}
+
+	data, err := c.request("GET", key, nil, nil)
+	if err != nil {
+		return objects.Object{}, err
+	}
+
+	return objects.DecodeFull(data)
+}
+
+// GetList values of a glob pattern
+func (c *Client) GetList(path string) ([]objects.Object, error) {
+	if !strings.Contains(path, "*") {
+		return nil, errors.New("katamari: invalid pattern")
+	}
+
+	data, err := c.request("GET", path, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return objects.DecodeList(data)
+}
+
+// Set data on a key, a glob pattern will create a new key
+// returns the index of the stored value
+func (c *Client) Set(key string, data []byte) (string, error) {
+	return c.set(key, data, nil)
+}
+
+// SetIf data on a key only if the stored object is still the current
+// one read with Get (an empty object for a key that doesn't exist yet)
+func (c *Client) SetIf(key string, data []byte, current objects.Object) (string, error) {
+	match := "0"
+	if current.Revision != 0 {
+		match = objects.ETag(current)
+	}
+	return c.set(key, data, http.Header{"If-Match": []string{match}})
+}
+
+func (c *Client) set(key string, data []byte, header http.Header) (string, error) {
+	body, err := json.Marshal(messages.Message{Data: messages.Encode(data)})
+	if err != nil {
+		return "", err
+	}
+
+	res, err := c.request("POST", key, body, header)
+	if err != nil {
+		return "", err
+	}
+
+	var created struct {
+		Index string `json:"index"`
+	}
+	err = json.Unmarshal(res, &created)
+	return created.Index, err
+}
+
+// Patch the value of a key with a merge patch (RFC 7386) or a
+// json patch document (RFC 6902) when merge is false
+func (c *Client) Patch(key string, patch []byte, merge bool) (string, error) {
+	contentType := "application/json-patch+json"
+	if merge {
+		contentType = "application/merge-patch+json"
+	}
+
+	res, err := c.request("PATCH", key, patch, http.Header{"Content-Type": []string{contentType}})
+	if err != nil {
+		return "", err
+	}
+
+	var updated struct {
+		Index string `json:"index"`
+	}
+	err = json.Unmarshal(res, &updated)
+	return updated.Index, err
+}
+
+// Del a key or glob pattern
+func (c *Client) Del(key string) error {
+	_, err := c.request("DELETE", key, nil, nil)
+	return err
+}
+
+// Batch apply a list of set/del commands atomically, returns a reply
+// for each command with the key and index written
+func (c *Client) Batch(commands []messages.Command) ([]messages.Reply, error) {
+	body, err := json.Marshal(commands)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.request("POST", "_batch", body, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var replies []messages.Reply
+	err = json.Unmarshal(res, &replies)
+	return replies, err
+}
+
+// Subscribe to a key or glob pattern, onMessage will be called on
+// every update with the current value(s), reconnections will
+// resume from the last version received
+func (c *Client) Subscribe(key string, onMessage OnMessage) (*Subscription, error) {
+	c.defaults()
+	sub := &Subscription{
+		client:    c,
+		key:       key,
+		onMessage: onMessage,
+	}
+
+	err := sub.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	go sub.listen()
+	return sub, nil
+}
+
+// Data returns the current value(s) of the subscription
+func (sub *Subscription) Data() ([]objects.Object, error) {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	return decode(sub.key, sub.cache)
+}
+
+// Version returns the last version received
+func (sub *Subscription) Version() string {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	return sub.version
+}
+
+// Close the subscription
+func (sub *Subscription) Close() {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	sub.closed = true
+	if sub.conn != nil {
+		sub.conn.Close()
+	}
+}
+
+func (sub *Subscription) dial() error {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	if sub.closed {
+		return errors.New("katamari: subscription closed")
+	}
+
+	u := url.URL{Scheme: sub.client.scheme("ws", "wss"), Host: sub.client.Address, Path: "/" + sub.key}
+	if sub.version != "" {
+		u.RawQuery = url.Values{"v": []string{sub.version}}.Encode()
+	}
+
+	conn, _, err := sub.client.Dialer.Dial(u.String(), sub.client.Header)
+	if err != nil {
+		return err
+	}
+
+	sub.conn = conn
+	return nil
+}
+
+func (sub *Subscription) isClosed() bool {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	return sub.closed
+}
+
+func (sub *Subscription) listen() {
+	for {
+		_, message, err := sub.conn.ReadMessage()
+		if err == nil {
+			sub.update(message)
+			continue
+		}
+
+		for !sub.isClosed() {
+			time.Sleep(sub.client.Retry)
+			if sub.dial() == nil {
+				break
+			}
+		}
+
+		if sub.isClosed() {
+			return
+		}
+	}
+}
+
+// update the local copy with a snapshot or patch message
+func (sub *Subscription) update(message []byte) {
+	var event messages.Message
+	err := json.Unmarshal(message, &event)
+	if err != nil {
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(event.Data)
+	if err != nil {
+		return
+	}
+
+	sub.mutex.Lock()
+	if !event.Snapshot {
+		patch, err := jsonpatch.DecodePatch(data)
+		if err != nil {
+			sub.mutex.Unlock()
+			return
+		}
+		data, err = patch.Apply(sub.cache)
+		if err != nil {
+			sub.mutex.Unlock()
+			return
+		}
+	}
+	sub.cache = data
+	sub.version = event.Version
+	objs, err := decode(sub.key, sub.cache)
+	sub.mutex.Unlock()
+
+	if err == nil && sub.onMessage != nil {
+		sub.onMessage(objs)
+	}
+}
+
+func decode(key string, data []byte) ([]objects.Object, error) {
+	if len(data) == 0 {
+		return []objects.Object{}, nil
+	}
+
+	if strings.Contains(key, "*") {
+		return objects.DecodeList(data)
+	}
+
+	obj, err := objects.DecodeFull(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if obj.Created == 0 {
+		return []objects.Object{}, nil
+	}
+
+	return []objects.Object{obj}, nil
+}
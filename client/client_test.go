@@ -0,0 +1,158 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/benitogf/katamari"
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/objects"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientRest(t *testing.T) {
+	t.Parallel()
+	app := katamari.Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	client := New(app.Address)
+
+	index, err := client.Set("test", []byte(`{"name":"test"}`))
+	require.NoError(t, err)
+	require.Equal(t, "test", index)
+	obj, err := client.Get("test")
+	require.NoError(t, err)
+	require.Equal(t, `{"name":"test"}`, obj.Data)
+
+	_, err = client.Set("things/*", []byte(`{"name":"one"}`))
+	require.NoError(t, err)
+	_, err = client.Set("things/*", []byte(`{"name":"two"}`))
+	require.NoError(t, err)
+	objs, err := client.GetList("things/*")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(objs))
+	require.Equal(t, `{"name":"two"}`, objs[0].Data)
+
+	keys, err := client.Keys()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(keys))
+
+	_, err = client.SetIf("test", []byte(`{"name":"conflict"}`), objects.Object{})
+	require.Error(t, err)
+	_, err = client.SetIf("test", []byte(`{"name":"match"}`), obj)
+	require.NoError(t, err)
+
+	_, err = client.Patch("test", []byte(`{"count":1}`), true)
+	require.NoError(t, err)
+	_, err = client.Patch("test", []byte(`[{"op":"replace","path":"/name","value":"patched"}]`), false)
+	require.NoError(t, err)
+	obj, err = client.Get("test")
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name":"patched","count":1}`, obj.Data)
+
+	replies, err := client.Batch([]messages.Command{
+		{Op: "set", Key: "things/*", Data: messages.Encode([]byte(`{"name":"three"}`))},
+		{Op: "del", Key: "things/" + objs[1].Index},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(replies))
+	objs, err = client.GetList("things/*")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(objs))
+	require.Equal(t, replies[0].Index, objs[0].Index)
+
+	err = client.Del("test")
+	require.NoError(t, err)
+	_, err = client.Get("test")
+	require.Error(t, err)
+	err = client.Del("test")
+	require.Error(t, err)
+}
+
+func TestClientSubscribe(t *testing.T) {
+	t.Parallel()
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var last []objects.Object
+	app := katamari.Server{}
+	app.Silence = true
+	app.ForcePatch = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	client := New(app.Address)
+
+	wg.Add(1)
+	sub, err := client.Subscribe("things/*", func(objs []objects.Object) {
+		mutex.Lock()
+		last = objs
+		mutex.Unlock()
+		wg.Done()
+	})
+	require.NoError(t, err)
+	defer sub.Close()
+	wg.Wait()
+	require.Equal(t, 0, len(last))
+
+	wg.Add(1)
+	_, err = client.Set("things/*", []byte(`{"name":"one"}`))
+	require.NoError(t, err)
+	wg.Wait()
+	mutex.Lock()
+	require.Equal(t, 1, len(last))
+	require.Equal(t, `{"name":"one"}`, last[0].Data)
+	mutex.Unlock()
+
+	wg.Add(1)
+	index, err := client.Set("things/*", []byte(`{"name":"two"}`))
+	require.NoError(t, err)
+	wg.Wait()
+	mutex.Lock()
+	require.Equal(t, 2, len(last))
+	require.Equal(t, index, last[0].Index)
+	mutex.Unlock()
+
+	wg.Add(1)
+	err = client.Del("things/" + index)
+	require.NoError(t, err)
+	wg.Wait()
+	data, err := sub.Data()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(data))
+	require.NotEmpty(t, sub.Version())
+}
+
+func TestClientSocket(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "katamari")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	app := katamari.Server{}
+	app.Silence = true
+	app.NamedSocket = filepath.Join(dir, "katamari.sock")
+	app.Start("")
+	defer app.Close(os.Interrupt)
+	require.Equal(t, "", app.Address)
+
+	client := &Client{Socket: app.NamedSocket}
+	_, err = client.Set("test", []byte(`{"name":"test"}`))
+	require.NoError(t, err)
+	obj, err := client.Get("test")
+	require.NoError(t, err)
+	require.Equal(t, `{"name":"test"}`, obj.Data)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	sub, err := client.Subscribe("test", func(objs []objects.Object) {
+		wg.Done()
+	})
+	require.NoError(t, err)
+	defer sub.Close()
+	wg.Wait()
+	data, err := sub.Data()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(data))
+}
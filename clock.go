@@ -41,6 +41,19 @@ func (app *Server) clock(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if isEventStream(r) {
+		client, err := app.Stream.Events("", "", w, r)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "%s", err)
+			return
+		}
+
+		go app.Stream.WriteTime(client, Time())
+		app.Stream.Wait("", "", client, r)
+		return
+	}
+
 	client, err := app.Stream.New("", "", w, r)
 	if err != nil {
 		return
@@ -0,0 +1,47 @@
+package katamari
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/stream"
+	"github.com/gorilla/mux"
+)
+
+// isEventStream checks if a request accepts server sent events
+func isEventStream(r *http.Request) bool {
+	return messages.Includes(r.Header.Get("Accept"), stream.EventStreamType)
+}
+
+// events subscription of a key using server sent events, the last version received
+// can be sent with the v query parameter or the Last-Event-ID header
+func (app *Server) events(w http.ResponseWriter, r *http.Request) {
+	_key := mux.Vars(r)["key"]
+	version := r.FormValue("v")
+	if r.Header.Get("Last-Event-ID") != "" {
+		version = r.Header.Get("Last-Event-ID")
+	}
+
+	client, err := app.Stream.Events(_key, _key, w, r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	// send initial msg
+	entry, err := app.fetch(_key, client.Principal())
+	if err != nil {
+		app.console.Err("katamari: filtered route", err)
+		app.Stream.WriteError(client, _key, err)
+		app.Stream.Close(_key, _key, client)
+		return
+	}
+
+	if version != strconv.FormatInt(entry.Version, 16) {
+		go app.Stream.Write(client, messages.Encode(entry.Data), true, entry.Version)
+	}
+	app.Stream.Wait(_key, _key, client, r)
+}
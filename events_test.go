@@ -0,0 +1,126 @@
+package katamari
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/stretchr/testify/require"
+)
+
+func readEvent(t *testing.T, reader *bufio.Reader) (string, string) {
+	id := ""
+	data := ""
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimRight(line, "\n")
+		if line == "" && data != "" {
+			return id, data
+		}
+		if strings.HasPrefix(line, "id: ") {
+			id = strings.TrimPrefix(line, "id: ")
+		}
+		if strings.HasPrefix(line, "data: ") {
+			data += strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.ForcePatch = true
+	app.ReadFilter("private", func(key string, data []byte) ([]byte, error) {
+		return nil, errors.New("private")
+	})
+	unsubscribed := make(chan string, 3)
+	app.OnUnsubscribe = func(key string) {
+		if key == "test" {
+			unsubscribed <- key
+		}
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	req, err := http.NewRequest("GET", "http://"+app.Address+"/test", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	reader := bufio.NewReader(resp.Body)
+
+	id, data := readEvent(t, reader)
+	wsEvent, err := messages.DecodeTest([]byte(data))
+	require.NoError(t, err)
+	require.True(t, wsEvent.Snapshot)
+	require.Equal(t, wsEvent.Version, id)
+
+	_, err = app.Storage.Set("test", messages.Encode([]byte("test")))
+	require.NoError(t, err)
+	id, data = readEvent(t, reader)
+	wsEvent, err = messages.DecodeTest([]byte(data))
+	require.NoError(t, err)
+	require.False(t, wsEvent.Snapshot)
+	require.Equal(t, wsEvent.Version, id)
+
+	req, err = http.NewRequest("GET", "http://"+app.Address+"/private", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	private, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_, data = readEvent(t, bufio.NewReader(private.Body))
+	require.Contains(t, data, "private")
+	private.Body.Close()
+
+	req, err = http.NewRequest("GET", "http://"+app.Address+"/", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	clock, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_, data = readEvent(t, bufio.NewReader(clock.Body))
+	require.NotEmpty(t, data)
+	clock.Body.Close()
+
+	resp.Body.Close()
+	select {
+	case key := <-unsubscribed:
+		require.Equal(t, "test", key)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "the event stream wasn't closed")
+	}
+}
+
+func TestEventsWriteTimeout(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.WriteTimeout = 100 * time.Millisecond
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	req, err := http.NewRequest("GET", "http://"+app.Address+"/test", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	first, _ := readEvent(t, reader)
+
+	// the stream keeps working past the write timeout
+	time.Sleep(300 * time.Millisecond)
+	_, err = app.Storage.Set("test", messages.Encode([]byte("test")))
+	require.NoError(t, err)
+	id, _ := readEvent(t, reader)
+	require.NotEqual(t, first, id)
+}
@@ -2,6 +2,9 @@ package katamari
 
 import (
 	"errors"
+	"net/http"
+	"sort"
+	"sync"
 
 	"github.com/benitogf/katamari/key"
 )
@@ -15,26 +18,76 @@ import (
 // error: will prevent data to pass the filter
 type Apply func(key string, data []byte) ([]byte, error)
 
+// ApplyScoped filter function that also receives the principal
+// of the subscriber, used to scope the data sent to each caller
+type ApplyScoped func(key string, principal string, data []byte) ([]byte, error)
+
 // ApplyDelete callback function
 type ApplyDelete func(key string) error
 
 // Notify after a write is done
 type Notify func(key string)
 
+// FilterID identifies a registered filter, used to change its priority or remove it
+type FilterID int64
+
+// FilterError stops a filter chain, the status will be used as the
+// status code of the response
+type FilterError struct {
+	Status  int
+	Message string
+}
+
+func (err *FilterError) Error() string {
+	return err.Message
+}
+
+// filterStatus returns the status of a filter or validation error
+// or the fallback status for other errors
+func filterStatus(err error, fallback int) int {
+	var filterErr *FilterError
+	if errors.As(err, &filterErr) {
+		return filterErr.Status
+	}
+
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		return http.StatusUnprocessableEntity
+	}
+
+	return fallback
+}
+
+// errUnauthorized denial of a key audit
+var errUnauthorized = &FilterError{Status: http.StatusUnauthorized, Message: "katamari: this request is not authorized"}
+
 type hook struct {
-	path  string
-	apply ApplyDelete
+	id       FilterID
+	priority int
+	path     string
+	apply    ApplyDelete
 }
 
 // Filter path -> match
 type filter struct {
-	path  string
-	apply Apply
+	id       FilterID
+	priority int
+	path     string
+	apply    Apply
+}
+
+type scopedFilter struct {
+	id       FilterID
+	priority int
+	path     string
+	apply    ApplyScoped
 }
 
 type watch struct {
-	path  string
-	apply Notify
+	id       FilterID
+	priority int
+	path     string
+	apply    Notify
 }
 
 // Router group of filters
@@ -42,48 +95,232 @@ type router []filter
 
 type hooks []hook
 
+type scopes []scopedFilter
+
 type watchers []watch
 
-// Filters read and write
+// Filters read and write, the chains are replaced instead of modified
+// so a chain can run without holding the mutex
 type filters struct {
+	mutex  sync.RWMutex
+	lastID FilterID
 	Write  router
 	Read   router
+	Scoped scopes
 	Delete hooks
 	After  watchers
 }
 
-// DeleteFilter add a filter that runs before sending a read result
-func (app *Server) DeleteFilter(path string, apply ApplyDelete) {
-	app.filters.Delete = append(app.filters.Delete, hook{
+func (f *filters) nextID() FilterID {
+	f.lastID++
+	return f.lastID
+}
+
+func (f *filters) writeChain() router {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.Write
+}
+
+func (f *filters) readChain() router {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.Read
+}
+
+func (f *filters) scopedChain() scopes {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.Scoped
+}
+
+func (f *filters) deleteChain() hooks {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.Delete
+}
+
+func (f *filters) afterChain() watchers {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.After
+}
+
+// DeleteFilter add a filter that runs before a delete
+func (app *Server) DeleteFilter(path string, apply ApplyDelete) FilterID {
+	app.filters.mutex.Lock()
+	defer app.filters.mutex.Unlock()
+	id := app.filters.nextID()
+	del := append(append(hooks{}, app.filters.Delete...), hook{
+		id:    id,
 		path:  path,
 		apply: apply,
 	})
+	sort.SliceStable(del, func(i, j int) bool { return del[i].priority > del[j].priority })
+	app.filters.Delete = del
+	return id
 }
 
 // https://github.com/golang/go/issues/11862
 
 // WriteFilter add a filter that triggers on write
-func (app *Server) WriteFilter(path string, apply Apply) {
-	app.filters.Write = append(app.filters.Write, filter{
+func (app *Server) WriteFilter(path string, apply Apply) FilterID {
+	app.filters.mutex.Lock()
+	defer app.filters.mutex.Unlock()
+	id := app.filters.nextID()
+	write := append(append(router{}, app.filters.Write...), filter{
+		id:    id,
 		path:  path,
 		apply: apply,
 	})
+	sort.SliceStable(write, func(i, j int) bool { return write[i].priority > write[j].priority })
+	app.filters.Write = write
+	return id
 }
 
 // AfterFilter add a filter that triggers after a successful write
-func (app *Server) AfterFilter(path string, apply Notify) {
-	app.filters.After = append(app.filters.After, watch{
+func (app *Server) AfterFilter(path string, apply Notify) FilterID {
+	app.filters.mutex.Lock()
+	defer app.filters.mutex.Unlock()
+	id := app.filters.nextID()
+	after := append(append(watchers{}, app.filters.After...), watch{
+		id:    id,
 		path:  path,
 		apply: apply,
 	})
+	sort.SliceStable(after, func(i, j int) bool { return after[i].priority > after[j].priority })
+	app.filters.After = after
+	return id
 }
 
 // ReadFilter add a filter that runs before sending a read result
-func (app *Server) ReadFilter(path string, apply Apply) {
-	app.filters.Read = append(app.filters.Read, filter{
+func (app *Server) ReadFilter(path string, apply Apply) FilterID {
+	app.filters.mutex.Lock()
+	defer app.filters.mutex.Unlock()
+	id := app.filters.nextID()
+	read := append(append(router{}, app.filters.Read...), filter{
+		id:    id,
+		path:  path,
+		apply: apply,
+	})
+	sort.SliceStable(read, func(i, j int) bool { return read[i].priority > read[j].priority })
+	app.filters.Read = read
+	return id
+}
+
+// ScopedFilter add a filter that runs after the read filter with the
+// principal of the caller, subscriptions to its path are grouped by
+// principal so each scope gets its own broadcasts
+func (app *Server) ScopedFilter(path string, apply ApplyScoped) FilterID {
+	app.filters.mutex.Lock()
+	defer app.filters.mutex.Unlock()
+	id := app.filters.nextID()
+	scoped := append(append(scopes{}, app.filters.Scoped...), scopedFilter{
+		id:    id,
 		path:  path,
 		apply: apply,
 	})
+	sort.SliceStable(scoped, func(i, j int) bool { return scoped[i].priority > scoped[j].priority })
+	app.filters.Scoped = scoped
+	return id
+}
+
+// FilterPriority changes the priority of a filter, filters with a higher
+// priority run first and filters with the same priority run in the order
+// they were added (the default priority is 0), returns false if the filter
+// doesn't exist
+func (app *Server) FilterPriority(id FilterID, priority int) bool {
+	app.filters.mutex.Lock()
+	defer app.filters.mutex.Unlock()
+	f := &app.filters
+	found := false
+	write := append(router{}, f.Write...)
+	for i := range write {
+		if write[i].id == id {
+			write[i].priority = priority
+			found = true
+		}
+	}
+	read := append(router{}, f.Read...)
+	for i := range read {
+		if read[i].id == id {
+			read[i].priority = priority
+			found = true
+		}
+	}
+	scoped := append(scopes{}, f.Scoped...)
+	for i := range scoped {
+		if scoped[i].id == id {
+			scoped[i].priority = priority
+			found = true
+		}
+	}
+	del := append(hooks{}, f.Delete...)
+	for i := range del {
+		if del[i].id == id {
+			del[i].priority = priority
+			found = true
+		}
+	}
+	after := append(watchers{}, f.After...)
+	for i := range after {
+		if after[i].id == id {
+			after[i].priority = priority
+			found = true
+		}
+	}
+	if !found {
+		return false
+	}
+
+	sort.SliceStable(write, func(i, j int) bool { return write[i].priority > write[j].priority })
+	sort.SliceStable(read, func(i, j int) bool { return read[i].priority > read[j].priority })
+	sort.SliceStable(scoped, func(i, j int) bool { return scoped[i].priority > scoped[j].priority })
+	sort.SliceStable(del, func(i, j int) bool { return del[i].priority > del[j].priority })
+	sort.SliceStable(after, func(i, j int) bool { return after[i].priority > after[j].priority })
+	f.Write, f.Read, f.Scoped, f.Delete, f.After = write, read, scoped, del, after
+	return true
+}
+
+// RemoveFilter removes a filter, returns false if the filter doesn't exist
+func (app *Server) RemoveFilter(id FilterID) bool {
+	app.filters.mutex.Lock()
+	defer app.filters.mutex.Unlock()
+	f := &app.filters
+	write := router{}
+	for _, filter := range f.Write {
+		if filter.id != id {
+			write = append(write, filter)
+		}
+	}
+	read := router{}
+	for _, filter := range f.Read {
+		if filter.id != id {
+			read = append(read, filter)
+		}
+	}
+	scoped := scopes{}
+	for _, filter := range f.Scoped {
+		if filter.id != id {
+			scoped = append(scoped, filter)
+		}
+	}
+	del := hooks{}
+	for _, filter := range f.Delete {
+		if filter.id != id {
+			del = append(del, filter)
+		}
+	}
+	after := watchers{}
+	for _, filter := range f.After {
+		if filter.id != id {
+			after = append(after, filter)
+		}
+	}
+	removed := len(write)+len(read)+len(scoped)+len(del)+len(after) <
+		len(f.Write)+len(f.Read)+len(f.Scoped)+len(f.Delete)+len(f.After)
+	f.Write, f.Read, f.Scoped, f.Delete, f.After = write, read, scoped, del, after
+	return removed
 }
 
 // NoopHook open noop hook
@@ -103,58 +340,85 @@ func (app *Server) OpenFilter(name string) {
 	app.DeleteFilter(name, NoopHook)
 }
 
+// matches checks if a filter path matches a key
+func matches(filterPath string, path string) bool {
+	return filterPath == path || key.Match(filterPath, path)
+}
+
+// check runs every matching watcher
 func (r watchers) check(path string) {
-	match := -1
-	for i, filter := range r {
-		if filter.path == path || key.Match(filter.path, path) {
-			match = i
-			break
+	for _, filter := range r {
+		if matches(filter.path, path) {
+			filter.apply(path)
 		}
 	}
-
-	if match == -1 {
-		return
-	}
-
-	r[match].apply(path)
 }
 
+// check runs every matching hook, stops on the first error
 func (r hooks) check(path string, static bool) error {
-	match := -1
-	for i, filter := range r {
-		if filter.path == path || key.Match(filter.path, path) {
-			match = i
-			break
+	matched := false
+	for _, filter := range r {
+		if !matches(filter.path, path) {
+			continue
+		}
+		matched = true
+		err := filter.apply(path)
+		if err != nil {
+			return err
 		}
 	}
 
-	if match == -1 && !static {
-		return nil
-	}
-
-	if match == -1 && static {
+	if !matched && static {
 		return errors.New("route not defined, static mode, key:" + path)
 	}
 
-	return r[match].apply(path)
+	return nil
 }
 
+// check passes the data through every matching filter, stops on the first error
 func (r router) check(path string, data []byte, static bool) ([]byte, error) {
-	match := -1
-	for i, filter := range r {
-		if filter.path == path || key.Match(filter.path, path) {
-			match = i
-			break
+	matched := false
+	for _, filter := range r {
+		if !matches(filter.path, path) {
+			continue
+		}
+		matched = true
+		var err error
+		data, err = filter.apply(path, data)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	if match == -1 && !static {
-		return data, nil
+	if !matched && static {
+		return nil, errors.New("route not defined, static mode, key:" + path)
 	}
 
-	if match == -1 && static {
-		return nil, errors.New("route not defined, static mode, key:" + path)
+	return data, nil
+}
+
+func (r scopes) match(path string) bool {
+	for _, filter := range r {
+		if matches(filter.path, path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// check passes the data through every matching scoped filter, stops on the first error
+func (r scopes) check(path string, principal string, data []byte) ([]byte, error) {
+	for _, filter := range r {
+		if !matches(filter.path, path) {
+			continue
+		}
+		var err error
+		data, err = filter.apply(path, principal, data)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return r[match].apply(path, data)
+	return data, nil
 }
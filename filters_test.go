@@ -2,13 +2,21 @@ package katamari
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/objects"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/require"
 )
 
@@ -91,3 +99,214 @@ func TestFilters(t *testing.T) {
 	require.Equal(t, 200, resp.StatusCode)
 	require.Equal(t, "intercepted:bag/1", string(body))
 }
+
+func TestScopedFilter(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.Identify = func(r *http.Request) string {
+		return r.Header.Get("X-User")
+	}
+	app.ScopedFilter("todos/*", func(key string, principal string, data []byte) ([]byte, error) {
+		var all []objects.Object
+		err := json.Unmarshal(data, &all)
+		if err != nil {
+			return nil, err
+		}
+		owned := []objects.Object{}
+		for _, obj := range all {
+			if strings.HasPrefix(obj.Index, principal) {
+				owned = append(owned, obj)
+			}
+		}
+		return json.Marshal(owned)
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	subscribe := func(user string) *websocket.Conn {
+		u := url.URL{Scheme: "ws", Host: app.Address, Path: "/todos/*"}
+		c, _, err := websocket.DefaultDialer.Dial(u.String(), http.Header{"X-User": []string{user}})
+		require.NoError(t, err)
+		return c
+	}
+	read := func(c *websocket.Conn) (string, bool) {
+		_, message, err := c.ReadMessage()
+		require.NoError(t, err)
+		var event messages.Message
+		require.NoError(t, json.Unmarshal(message, &event))
+		data, err := base64.StdEncoding.DecodeString(event.Data)
+		require.NoError(t, err)
+		return string(data), event.Snapshot
+	}
+	alice := subscribe("alice")
+	defer alice.Close()
+	bob := subscribe("bob")
+	defer bob.Close()
+	data, _ := read(alice)
+	require.Equal(t, "[]", data)
+	data, _ = read(bob)
+	require.Equal(t, "[]", data)
+
+	_, err := app.Storage.Set("todos/alice1", messages.Encode([]byte(`{"title":"alice"}`)))
+	require.NoError(t, err)
+	data, snapshot := read(alice)
+	require.True(t, snapshot)
+	objs, err := objects.DecodeList([]byte(data))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(objs))
+	require.Equal(t, "alice1", objs[0].Index)
+	data, _ = read(bob)
+	require.Equal(t, "[]", data)
+
+	_, err = app.Storage.Set("todos/bob1", messages.Encode([]byte(`{"title":"bob"}`)))
+	require.NoError(t, err)
+	data, _ = read(bob)
+	objs, err = objects.DecodeList([]byte(data))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(objs))
+	require.Equal(t, "bob1", objs[0].Index)
+
+	scopes := []string{}
+	app.Stream.UseConnections("todos/*", func(poolIndex int) {
+		scopes = append(scopes, app.Stream.Pools[poolIndex].Scope)
+	})
+	require.Contains(t, scopes, "alice")
+	require.Contains(t, scopes, "bob")
+
+	req := httptest.NewRequest("GET", "/todos/*", nil)
+	req.Header.Set("X-User", "bob")
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	body, err := ioutil.ReadAll(w.Result().Body)
+	require.NoError(t, err)
+	objs, err = objects.DecodeList(body)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(objs))
+	require.Equal(t, "bob1", objs[0].Index)
+}
+
+func TestScopedPoolsRemoved(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.Identify = func(r *http.Request) string {
+		return r.Header.Get("X-User")
+	}
+	app.ScopedFilter("todos/*", func(key string, principal string, data []byte) ([]byte, error) {
+		return data, nil
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	scoped := func() int {
+		count := 0
+		app.Stream.UseConnections("todos/*", func(poolIndex int) {
+			if app.Stream.Pools[poolIndex].Scope != "" {
+				count++
+			}
+		})
+		return count
+	}
+	require.Equal(t, 0, scoped())
+
+	clients := []*websocket.Conn{}
+	for _, user := range []string{"alice", "bob", "carol"} {
+		u := url.URL{Scheme: "ws", Host: app.Address, Path: "/todos/*"}
+		c, _, err := websocket.DefaultDialer.Dial(u.String(), http.Header{"X-User": []string{user}})
+		require.NoError(t, err)
+		_, _, err = c.ReadMessage()
+		require.NoError(t, err)
+		clients = append(clients, c)
+	}
+	require.Equal(t, 3, scoped())
+
+	for _, c := range clients {
+		c.Close()
+	}
+	require.Eventually(t, func() bool {
+		return scoped() == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestFilterChain(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	first := app.ReadFilter("books/*", func(key string, data []byte) ([]byte, error) {
+		return append(data, []byte(":first")...), nil
+	})
+	second := app.ReadFilter("books/*", func(key string, data []byte) ([]byte, error) {
+		return append(data, []byte(":second")...), nil
+	})
+	app.ReadFilter("other/*", func(key string, data []byte) ([]byte, error) {
+		return nil, errors.New("unexpected")
+	})
+	calls := 0
+	app.WriteFilter("books/*", func(key string, data []byte) ([]byte, error) {
+		calls++
+		return data, nil
+	})
+	guard := app.WriteFilter("books/*", func(key string, data []byte) ([]byte, error) {
+		return nil, &FilterError{Status: http.StatusForbidden, Message: "katamari: read only"}
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	data, err := app.filters.readChain().check("books/1", []byte("data"), false)
+	require.NoError(t, err)
+	require.Equal(t, "data:first:second", string(data))
+
+	require.True(t, app.FilterPriority(second, 10))
+	data, err = app.filters.readChain().check("books/1", []byte("data"), false)
+	require.NoError(t, err)
+	require.Equal(t, "data:second:first", string(data))
+
+	require.True(t, app.RemoveFilter(first))
+	require.False(t, app.RemoveFilter(first))
+	require.False(t, app.FilterPriority(first, 1))
+	data, err = app.filters.readChain().check("books/1", []byte("data"), false)
+	require.NoError(t, err)
+	require.Equal(t, "data:second", string(data))
+
+	// the guard short circuits the chain before the counter
+	require.True(t, app.FilterPriority(guard, 1))
+	var jsonStr = []byte(`{"data":"` + messages.Encode([]byte(`{"title":"test"}`)) + `"}`)
+	req := httptest.NewRequest("POST", "/books/1", bytes.NewBuffer(jsonStr))
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp := w.Result()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.Equal(t, "katamari: read only", string(body))
+	require.Equal(t, 0, calls)
+
+	require.True(t, app.RemoveFilter(guard))
+	req = httptest.NewRequest("POST", "/books/1", bytes.NewBuffer(jsonStr))
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, 1, calls)
+}
+
+func TestFilterPriorityOrder(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	tag := func(name string) Apply {
+		return func(key string, data []byte) ([]byte, error) {
+			return append(data, []byte(":"+name)...), nil
+		}
+	}
+	low := app.ReadFilter("books/*", tag("low"))
+	require.True(t, app.FilterPriority(low, -1))
+	high := app.ReadFilter("books/*", tag("high"))
+	require.True(t, app.FilterPriority(high, 1))
+	// filters added after a priority change keep the order of the priorities
+	app.ReadFilter("books/*", tag("first"))
+	app.ReadFilter("books/*", tag("second"))
+	data, err := app.filters.readChain().check("books/1", []byte("data"), false)
+	require.NoError(t, err)
+	require.Equal(t, "data:high:first:second:low", string(data))
+}
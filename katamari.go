@@ -1,7 +1,8 @@
 package katamari
 
 import (
-	"context"
+	"crypto/tls"
+	"errors"
 	"log"
 	"net"
 	"net/http"
@@ -29,6 +30,20 @@ import (
 // false: deny the request
 type audit func(r *http.Request) bool
 
+// keyAudit requests function
+// will define approval or denial of an action on a key
+// r: the request to be audited, for websocket commands the request that opened the connection
+// key: the key of the action
+// action: ActionRead, ActionWrite or ActionDelete
+type keyAudit func(r *http.Request, key string, action string) bool
+
+// actions audited on a key
+const (
+	ActionRead   = "read"
+	ActionWrite  = "write"
+	ActionDelete = "delete"
+)
+
 // Server application
 //
 // Router: can be predefined with routes and passed to be extended
@@ -41,6 +56,13 @@ type audit func(r *http.Request) bool
 //
 // Audit: function to audit requests
 //
+// AuditKey: function to audit the actions of a request on each key, applied to
+// rest, websocket and event stream reads and writes, multiplexed subscriptions,
+// batches and the key listing
+//
+// AuditSchemas: function to audit the writes and deletes of the SchemasKey,
+// they are refused when it's not defined
+//
 // Workers: number of workers to use as readers of the storage->broadcast channel
 //
 // ForcePatch: flag to force patch operations
@@ -57,7 +79,41 @@ type audit func(r *http.Request) bool
 //
 // Tick: time interval between ticks on the clock subscription
 //
-// NamedSocket: name of the ipc socket
+// ExpireInterval: time interval between sweeps of the keys with an expired ttl
+//
+// TLSConfig: tls configuration to serve https and wss
+//
+// CertFile: certificate file to serve https and wss, reloaded when modified
+//
+// KeyFile: private key file of the certificate, reloaded when modified
+//
+// ClientCAFile: certificate authorities file to require and verify client certificates, reloaded when modified
+//
+// Identify: function to get the principal of a request given to the scoped filters,
+// defaults to the verified client certificate identity
+//
+// Session: function to get the identity and expiry of the credentials of a request,
+// websocket and event stream connections are closed once their session expires or
+// is revoked, websocket clients can renew it sending an "auth" operation with a new token
+//
+// SessionInterval: time interval between checks of the revocation of the sessions of the connections
+//
+// Metrics: flag to collect prometheus metrics and expose them on the /metrics route
+//
+// WriteTimeout: deadline to write the response of a request, event streams
+// clear it once they start
+//
+// ShutdownTimeout: deadline to drain the requests, broadcasts and workers on close
+//
+// OnClose: function to receive the report of what was dropped on close
+//
+// SchemasKey: key glob where json schemas can be stored as {"path": glob, "schema": schema}
+// documents, the schemas validate the writes of the keys that match their path
+//
+// NamedSocket: path of a unix domain socket to listen on, in addition to
+// the tcp address or instead of it when the address is empty
+//
+// Network: tcp network to listen on, tcp4 by default, tcp6 or tcp (dual stack)
 //
 // Signal: os signal channel
 //
@@ -73,17 +129,40 @@ type Server struct {
 	InMemoryKeys    []string
 	DbOpt           interface{}
 	Audit           audit
+	AuditKey        keyAudit
+	AuditSchemas    audit
 	Workers         int
 	ForcePatch      bool
 	OnSubscribe     stream.Subscribe
 	OnUnsubscribe   stream.Unsubscribe
 	Storage         Database
+	storage         Database
 	Address         string
 	closing         int64
 	active          int64
 	Silence         bool
 	Static          bool
 	Tick            time.Duration
+	ExpireInterval  time.Duration
+	TLSConfig       *tls.Config
+	CertFile        string
+	KeyFile         string
+	ClientCAFile    string
+	Identify        stream.Identify
+	Session         stream.Session
+	SessionInterval time.Duration
+	Metrics         bool
+	metrics         *metrics
+	WriteTimeout    time.Duration
+	ShutdownTimeout time.Duration
+	OnClose         Report
+	broadcasts      broadcasts
+	commands        commands
+	workers         sync.WaitGroup
+	SchemasKey      string
+	schemas         schemas
+	NamedSocket     string
+	Network         string
 	console         *coat.Console
 	Signal          chan os.Signal
 	Client          *http.Client
@@ -102,31 +181,89 @@ func (app *Server) waitListen() {
 	err = app.Storage.Start(StorageOpt{
 		NoBroadcastKeys: app.NoBroadcastKeys,
 		DbOpt:           app.DbOpt,
+		ExpireInterval:  app.ExpireInterval,
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
 	app.server = &http.Server{
-		WriteTimeout:      1 * time.Minute,
+		WriteTimeout:      app.WriteTimeout,
 		ReadTimeout:       1 * time.Minute,
 		ReadHeaderTimeout: 10 * time.Second,
 		IdleTimeout:       10 * time.Second,
 		Addr:              app.Address,
 		Handler: cors.New(cors.Options{
-			AllowedMethods: []string{"GET", "POST", "DELETE", "PUT"},
+			AllowedMethods: []string{"GET", "POST", "DELETE", "PUT", "PATCH"},
 			// AllowedOrigins: []string{"http://foo.com", "http://foo.com:8080"},
 			// AllowCredentials: true,
-			AllowedHeaders: []string{"Authorization", "Content-Type"},
+			AllowedHeaders: []string{"Authorization", "Content-Type", "If-Match", "X-TTL"},
+			ExposedHeaders: []string{"ETag"},
 			// Debug:          true,
 		}).Handler(handlers.CompressHandler(app.Router))}
-	ln, err := net.Listen("tcp4", app.Address)
+	listeners, err := app.listen()
 	if err != nil {
-		log.Fatal("failed to start tcp, ", err)
+		log.Fatal(err)
 	}
-	app.Address = ln.Addr().String()
 	atomic.StoreInt64(&app.active, 1)
 	app.wg.Done()
-	err = app.server.Serve(tcpKeepAliveListener{ln.(*net.TCPListener)})
+	for _, listener := range listeners[1:] {
+		go app.serve(listener)
+	}
+	app.serve(listeners[0])
+}
+
+// listen on the tcp address and/or the named socket
+func (app *Server) listen() ([]net.Listener, error) {
+	config, err := app.tlsConfig()
+	if err != nil {
+		return nil, errors.New("failed to load tls, " + err.Error())
+	}
+	listeners := []net.Listener{}
+	if app.Address != "" || app.NamedSocket == "" {
+		ln, err := net.Listen(app.Network, app.Address)
+		if err != nil {
+			return nil, errors.New("failed to start tcp, " + err.Error())
+		}
+		app.Address = ln.Addr().String()
+		listeners = append(listeners, tcpKeepAliveListener{ln.(*net.TCPListener)})
+	}
+
+	if app.NamedSocket != "" {
+		// remove a socket left behind by a previous process,
+		// a socket that accepts connections is still in use
+		info, err := os.Stat(app.NamedSocket)
+		if err == nil && info.Mode()&os.ModeSocket != 0 {
+			conn, err := net.DialTimeout("unix", app.NamedSocket, time.Second)
+			if err == nil {
+				conn.Close()
+				for _, listener := range listeners {
+					listener.Close()
+				}
+				return nil, errors.New("failed to start socket, " + app.NamedSocket + " is in use")
+			}
+			os.Remove(app.NamedSocket)
+		}
+		ln, err := net.Listen("unix", app.NamedSocket)
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return nil, errors.New("failed to start socket, " + err.Error())
+		}
+		listeners = append(listeners, ln)
+	}
+
+	if config != nil {
+		for i := range listeners {
+			listeners[i] = tls.NewListener(listeners[i], config)
+		}
+	}
+
+	return listeners, nil
+}
+
+func (app *Server) serve(listener net.Listener) {
+	err := app.server.Serve(listener)
 	if atomic.LoadInt64(&app.closing) != 1 {
 		log.Fatal(err)
 	}
@@ -142,6 +279,11 @@ func (app *Server) waitStart() {
 		log.Fatal("server start failed")
 	}
 
+	if app.SchemasKey != "" {
+		app.loadSchemas()
+	}
+
+	app.workers.Add(app.Workers * 2)
 	for i := 0; i < app.Workers; i++ {
 		go app.watch(app.Storage.Watch())
 	}
@@ -150,13 +292,18 @@ func (app *Server) waitStart() {
 		go app.memWatch(app.Storage.MemWatch())
 	}
 
-	app.console.Log("glad to serve[" + app.Address + "]")
+	if app.NamedSocket != "" {
+		app.console.Log("glad to serve[" + app.NamedSocket + "]")
+	}
+	if app.Address != "" {
+		app.console.Log("glad to serve[" + app.Address + "]")
+	}
 }
 
 // ForceFetch data, update cache and apply filter
 func (app *Server) ForceFetch(key string, filter string) (stream.Cache, error) {
 	var err error
-	raw, _ := app.Storage.Get(key)
+	raw, _ := app.storage.Get(key)
 	if len(raw) == 0 {
 		raw = objects.EmptyObject
 	}
@@ -166,7 +313,7 @@ func (app *Server) ForceFetch(key string, filter string) (stream.Cache, error) {
 		Version: newVersion,
 		Data:    raw,
 	}
-	cache.Data, err = app.filters.Read.check(filter, cache.Data, app.Static)
+	cache.Data, err = app.filters.readChain().check(filter, cache.Data, app.Static)
 	if err != nil {
 		return cache, err
 	}
@@ -176,7 +323,7 @@ func (app *Server) ForceFetch(key string, filter string) (stream.Cache, error) {
 // MemForceFetch data, update cache and apply filter
 func (app *Server) MemForceFetch(key string, filter string) (stream.Cache, error) {
 	var err error
-	raw, _ := app.Storage.MemGet(key)
+	raw, _ := app.storage.MemGet(key)
 	if len(raw) == 0 {
 		raw = objects.EmptyObject
 	}
@@ -186,7 +333,7 @@ func (app *Server) MemForceFetch(key string, filter string) (stream.Cache, error
 		Version: newVersion,
 		Data:    raw,
 	}
-	cache.Data, err = app.filters.Read.check(filter, cache.Data, app.Static)
+	cache.Data, err = app.filters.readChain().check(filter, cache.Data, app.Static)
 	if err != nil {
 		return cache, err
 	}
@@ -197,7 +344,7 @@ func (app *Server) MemForceFetch(key string, filter string) (stream.Cache, error
 func (app *Server) Fetch(key string, filter string) (stream.Cache, error) {
 	cache, err := app.Stream.GetCache(key)
 	if err != nil {
-		raw, _ := app.Storage.Get(key)
+		raw, _ := app.storage.Get(key)
 		if len(raw) == 0 {
 			raw = objects.EmptyObject
 		}
@@ -207,7 +354,7 @@ func (app *Server) Fetch(key string, filter string) (stream.Cache, error) {
 			Data:    raw,
 		}
 	}
-	cache.Data, err = app.filters.Read.check(filter, cache.Data, app.Static)
+	cache.Data, err = app.filters.readChain().check(filter, cache.Data, app.Static)
 	if err != nil {
 		return cache, err
 	}
@@ -218,7 +365,7 @@ func (app *Server) Fetch(key string, filter string) (stream.Cache, error) {
 func (app *Server) MemFetch(key string, filter string) (stream.Cache, error) {
 	cache, err := app.Stream.GetCache(key)
 	if err != nil {
-		raw, _ := app.Storage.MemGet(key)
+		raw, _ := app.storage.MemGet(key)
 		if len(raw) == 0 {
 			raw = objects.EmptyObject
 		}
@@ -228,7 +375,7 @@ func (app *Server) MemFetch(key string, filter string) (stream.Cache, error) {
 			Data:    raw,
 		}
 	}
-	cache.Data, err = app.filters.Read.check(filter, cache.Data, app.Static)
+	cache.Data, err = app.filters.readChain().check(filter, cache.Data, app.Static)
 	if err != nil {
 		return cache, err
 	}
@@ -236,12 +383,11 @@ func (app *Server) MemFetch(key string, filter string) (stream.Cache, error) {
 }
 
 func (app *Server) getPatch(poolIndex int) (string, bool, int64, error) {
-	raw, _ := app.Storage.Get(app.Stream.Pools[poolIndex].Key)
+	raw, _ := app.storage.Get(app.Stream.Pools[poolIndex].Key)
 	if len(raw) == 0 {
 		raw = objects.EmptyObject
 	}
-	filteredData, err := app.filters.Read.check(
-		app.Stream.Pools[poolIndex].Filter, raw, app.Static)
+	filteredData, err := app.scopedRead(poolIndex, raw)
 	if err != nil {
 		return "", false, 0, err
 	}
@@ -250,12 +396,11 @@ func (app *Server) getPatch(poolIndex int) (string, bool, int64, error) {
 }
 
 func (app *Server) memGetPatch(poolIndex int) (string, bool, int64, error) {
-	raw, _ := app.Storage.MemGet(app.Stream.Pools[poolIndex].Key)
+	raw, _ := app.storage.MemGet(app.Stream.Pools[poolIndex].Key)
 	if len(raw) == 0 {
 		raw = objects.EmptyObject
 	}
-	filteredData, err := app.filters.Read.check(
-		app.Stream.Pools[poolIndex].Filter, raw, app.Static)
+	filteredData, err := app.scopedRead(poolIndex, raw)
 	if err != nil {
 		return "", false, 0, err
 	}
@@ -263,48 +408,69 @@ func (app *Server) memGetPatch(poolIndex int) (string, bool, int64, error) {
 	return messages.Encode(modifiedData), snapshot, version, nil
 }
 
+// scopedRead applies the read filters of a pool, including the
+// scoped filters with the principal of the pool
+func (app *Server) scopedRead(poolIndex int, raw []byte) ([]byte, error) {
+	pool := app.Stream.Pools[poolIndex]
+	data, err := app.filters.readChain().check(pool.Filter, raw, app.Static)
+	if err != nil {
+		return nil, err
+	}
+
+	return app.filters.scopedChain().check(pool.Filter, pool.Scope, data)
+}
+
+// scoped checks if a key has a scoped filter
+func (app *Server) scoped(key string) bool {
+	return app.filters.scopedChain().match(key)
+}
+
 func (app *Server) broadcast(key string) {
+	start := time.Now()
+	deliveries := []*sync.WaitGroup{}
 	app.Stream.UseConnections(key, func(poolIndex int) {
 		data, snapshot, version, err := app.getPatch(poolIndex)
 		if err != nil {
 			return
 		}
-		app.Stream.Broadcast(poolIndex, data, snapshot, version)
+		app.metrics.patch(snapshot)
+		deliveries = append(deliveries, app.Stream.Broadcast(poolIndex, data, snapshot, version))
 	})
+	app.metrics.broadcast(start, deliveries)
 }
 
 func (app *Server) memBroadcast(key string) {
+	start := time.Now()
+	deliveries := []*sync.WaitGroup{}
 	app.Stream.UseConnections(key, func(poolIndex int) {
 		data, snapshot, version, err := app.memGetPatch(poolIndex)
 		if err != nil {
 			return
 		}
-		app.Stream.Broadcast(poolIndex, data, snapshot, version)
+		app.metrics.patch(snapshot)
+		deliveries = append(deliveries, app.Stream.Broadcast(poolIndex, data, snapshot, version))
 	})
+	app.metrics.broadcast(start, deliveries)
 }
 
 func (app *Server) watch(sc StorageChan) {
-	for {
-		ev := <-sc
+	defer app.workers.Done()
+	for ev := range sc {
 		if ev.Key != "" {
+			app.schemaEvent(ev)
 			app.console.Log("broadcast[" + ev.Key + "]")
-			go app.broadcast(ev.Key)
-		}
-		if !app.Storage.Active() {
-			break
+			app.broadcasts.dispatch(app.broadcast, ev.Key)
 		}
 	}
 }
 
 func (app *Server) memWatch(sc StorageChan) {
-	for {
-		ev := <-sc
+	defer app.workers.Done()
+	for ev := range sc {
 		if ev.Key != "" {
+			app.schemaEvent(ev)
 			app.console.Log("broadcast[" + ev.Key + "]")
-			go app.memBroadcast(ev.Key)
-		}
-		if !app.Storage.Active() {
-			break
+			app.broadcasts.dispatch(app.memBroadcast, ev.Key)
 		}
 	}
 }
@@ -331,10 +497,18 @@ func (app *Server) defaults() {
 		app.Tick = 1 * time.Second
 	}
 
+	if app.ExpireInterval == 0 {
+		app.ExpireInterval = 1 * time.Second
+	}
+
 	if app.Audit == nil {
 		app.Audit = func(r *http.Request) bool { return true }
 	}
 
+	if app.AuditKey == nil {
+		app.AuditKey = func(r *http.Request, key string, action string) bool { return true }
+	}
+
 	if app.OnSubscribe == nil {
 		app.OnSubscribe = func(key string) error { return nil }
 	}
@@ -351,16 +525,67 @@ func (app *Server) defaults() {
 		app.Stream.OnUnsubscribe = app.OnUnsubscribe
 	}
 
+	if app.Identify == nil {
+		app.Identify = PeerIdentity
+	}
+
+	if app.Stream.Identify == nil {
+		app.Stream.Identify = app.Identify
+	}
+
+	if app.Stream.Session == nil {
+		app.Stream.Session = app.Session
+	}
+
+	if app.SessionInterval == 0 {
+		app.SessionInterval = 10 * time.Second
+	}
+
+	if app.Stream.Scoped == nil {
+		app.Stream.Scoped = app.scoped
+	}
+
+	if app.Stream.OnCommand == nil {
+		app.Stream.OnCommand = app.command
+	}
+
 	if app.Workers == 0 {
 		app.Workers = 6
 	}
 
+	if app.WriteTimeout == 0 {
+		app.WriteTimeout = 1 * time.Minute
+	}
+
+	if app.ShutdownTimeout == 0 {
+		app.ShutdownTimeout = 10 * time.Second
+	}
+
+	if app.OnClose == nil {
+		app.OnClose = func(report ShutdownReport) {}
+	}
+
+	if app.Network == "" {
+		app.Network = "tcp4"
+	}
+
 	app.Stream.ForcePatch = app.ForcePatch
 	if len(app.Stream.Pools) == 0 {
 		app.Stream.Pools = append(
 			app.Stream.Pools,
 			&stream.Pool{Key: ""})
 	}
+
+	if app.Metrics && app.metrics == nil {
+		app.metrics = newMetrics(app)
+		app.Router.Use(app.metrics.middleware)
+	}
+
+	// the storage operations are observed without replacing the Storage
+	app.storage = app.Storage
+	if app.metrics != nil {
+		app.storage = &instrumented{Database: app.Storage, metrics: app.metrics}
+	}
 }
 
 // Start : initialize and start the http server and database connection
@@ -372,10 +597,18 @@ func (app *Server) Start(address string) {
 	}
 	atomic.StoreInt64(&app.active, 0)
 	atomic.StoreInt64(&app.closing, 0)
+	app.broadcasts.reset()
+	app.commands.reset()
 	app.defaults()
 	app.Router.HandleFunc("/", app.getStats).Methods("GET")
+	app.Router.HandleFunc("/_mux", app.multiplex).Methods("GET")
+	app.Router.HandleFunc("/_batch", app.batch).Methods("POST")
+	if app.Metrics {
+		app.Router.HandleFunc("/metrics", app.getMetrics).Methods("GET")
+	}
 	app.Router.HandleFunc("/{key:[a-zA-Z\\*\\d\\/]+}", app.unpublish).Methods("DELETE")
 	app.Router.HandleFunc("/{key:[a-zA-Z\\*\\d\\/]+}", app.publish).Methods("POST")
+	app.Router.HandleFunc("/{key:[a-zA-Z\\*\\d\\/]+}", app.patch).Methods("PATCH")
 	app.Router.HandleFunc("/{key:[a-zA-Z\\*\\d\\/]+}", app.read).Methods("GET")
 	app.Router.HandleFunc("/{key:[a-zA-Z\\*\\d\\/]+}", app.read).Queries("v", "{[\\d]}").Methods("GET")
 	app.wg.Add(1)
@@ -384,18 +617,18 @@ func (app *Server) Start(address string) {
 	app.waitStart()
 	app.console = coat.NewConsole(app.Address, app.Silence)
 	go app.tick()
+	if app.Session != nil {
+		go app.checkSessions()
+	}
 }
 
-// Close : shutdown the http server and database connection
+// Close : shutdown the http server, subscriptions and database connection
 func (app *Server) Close(sig os.Signal) {
 	if atomic.LoadInt64(&app.closing) != 1 {
 		atomic.StoreInt64(&app.closing, 1)
 		atomic.StoreInt64(&app.active, 0)
-		app.Storage.Close()
-		app.console.Err("shutdown", sig)
-		if app.server != nil {
-			app.server.Shutdown(context.Background())
-		}
+		report := app.shutdown(sig)
+		app.OnClose(report)
 	}
 }
 
@@ -2,10 +2,14 @@ package katamari
 
 import (
 	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/gorilla/websocket"
@@ -105,6 +109,84 @@ func TestRestart(t *testing.T) {
 	defer app.Close(os.Interrupt)
 }
 
+func TestDualStack(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.Network = "tcp"
+	app.Start(":0")
+	defer app.Close(os.Interrupt)
+	_, port, err := net.SplitHostPort(app.Address)
+	require.NoError(t, err)
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		resp, err := http.Get("http://" + net.JoinHostPort(host, port))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestNamedSocket(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "katamari")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	app := Server{}
+	app.Silence = true
+	app.NamedSocket = filepath.Join(dir, "katamari.sock")
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	resp, err := http.Get("http://" + app.Address)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	dial := func(ctx context.Context, network string, address string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", app.NamedSocket)
+	}
+	socket := &http.Client{Transport: &http.Transport{DialContext: dial}}
+	resp, err = socket.Get("http://localhost/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	wsDialer := websocket.Dialer{NetDialContext: dial}
+	c, _, err := wsDialer.Dial("ws://localhost/test", nil)
+	require.NoError(t, err)
+	c.Close()
+
+	// a socket in use is not removed
+	other := Server{NamedSocket: app.NamedSocket}
+	_, err = other.listen()
+	require.Error(t, err)
+	resp, err = socket.Get("http://localhost/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestNamedSocketStale(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "katamari")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "katamari.sock")
+	ln, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	app := Server{}
+	app.Silence = true
+	app.NamedSocket = path
+	app.Start("")
+	defer app.Close(os.Interrupt)
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	conn.Close()
+}
+
 func TestGlobKey(t *testing.T) {
 	t.Parallel()
 	app := Server{}
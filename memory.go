@@ -15,9 +15,13 @@ import (
 type MemoryStorage struct {
 	mem             sync.Map
 	mutex           sync.RWMutex
+	writeMutex      sync.Mutex
 	noBroadcastKeys []string
 	watcher         StorageChan
 	storage         *Storage
+	expirations     Expirations
+	stop            chan struct{}
+	done            chan struct{}
 }
 
 // Active provides access to the status of the storage client
@@ -39,11 +43,16 @@ func (db *MemoryStorage) Start(storageOpt StorageOpt) error {
 	}
 	db.noBroadcastKeys = storageOpt.NoBroadcastKeys
 	db.storage.Active = true
+	db.stop = make(chan struct{})
+	db.done = make(chan struct{})
+	go Sweep(storageOpt.ExpireInterval, db.stop, db.done, db.expire)
 	return nil
 }
 
 // Close the storage client
 func (db *MemoryStorage) Close() {
+	close(db.stop)
+	<-db.done
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 	close(db.watcher)
@@ -53,6 +62,7 @@ func (db *MemoryStorage) Close() {
 
 // Clear all keys in the storage
 func (db *MemoryStorage) Clear() {
+	db.expirations.Clear()
 	db.mem.Range(func(key interface{}, value interface{}) bool {
 		db.mem.Delete(key)
 		return true
@@ -61,9 +71,12 @@ func (db *MemoryStorage) Clear() {
 
 // Keys list all the keys in the storage
 func (db *MemoryStorage) Keys() ([]byte, error) {
+	now := time.Now().UTC().UnixNano()
 	stats := Stats{}
 	db.mem.Range(func(key interface{}, value interface{}) bool {
-		stats.Keys = append(stats.Keys, key.(string))
+		if !Expired(expires(value.([]byte)), now) {
+			stats.Keys = append(stats.Keys, key.(string))
+		}
 		return true
 	})
 
@@ -79,6 +92,7 @@ func (db *MemoryStorage) Keys() ([]byte, error) {
 
 // KeysRange list keys in a path and time range
 func (db *MemoryStorage) KeysRange(path string, from, to int64) ([]string, error) {
+	now := time.Now().UTC().UnixNano()
 	keys := []string{}
 	if !strings.Contains(path, "*") {
 		return keys, errors.New("katamari: invalid pattern")
@@ -98,6 +112,9 @@ func (db *MemoryStorage) KeysRange(path string, from, to int64) ([]string, error
 		if created < from || created > to {
 			return true
 		}
+		if Expired(expires(value.([]byte)), now) {
+			return true
+		}
 		keys = append(keys, current)
 		return true
 	})
@@ -112,9 +129,10 @@ func (db *MemoryStorage) MemGet(path string) ([]byte, error) {
 
 // Get a key/pattern related value(s)
 func (db *MemoryStorage) Get(path string) ([]byte, error) {
+	now := time.Now().UTC().UnixNano()
 	if !strings.Contains(path, "*") {
 		data, found := db.mem.Load(path)
-		if !found {
+		if !found || Expired(expires(data.([]byte)), now) {
 			return []byte(""), errors.New("katamari: not found")
 		}
 
@@ -128,7 +146,7 @@ func (db *MemoryStorage) Get(path string) ([]byte, error) {
 		}
 
 		newObject, err := objects.Decode(value.([]byte))
-		if err != nil {
+		if err != nil || Expired(newObject.Expires, now) {
 			return true
 		}
 
@@ -143,6 +161,7 @@ func (db *MemoryStorage) Get(path string) ([]byte, error) {
 
 // GetObjList bypass encoding and single objects reads
 func (db *MemoryStorage) GetObjList(path string) ([]objects.Object, error) {
+	now := time.Now().UTC().UnixNano()
 	res := []objects.Object{}
 	if !strings.Contains(path, "*") {
 		return res, errors.New("katamari: invalid pattern")
@@ -154,7 +173,7 @@ func (db *MemoryStorage) GetObjList(path string) ([]objects.Object, error) {
 		}
 
 		newObject, err := objects.DecodeFull(value.([]byte))
-		if err != nil {
+		if err != nil || Expired(newObject.Expires, now) {
 			return true
 		}
 
@@ -167,6 +186,7 @@ func (db *MemoryStorage) GetObjList(path string) ([]objects.Object, error) {
 
 // GetN get last N elements of a path related value(s)
 func (db *MemoryStorage) GetN(path string, limit int) ([]objects.Object, error) {
+	now := time.Now().UTC().UnixNano()
 	res := []objects.Object{}
 	if !strings.Contains(path, "*") {
 		return res, errors.New("katamari: invalid pattern")
@@ -182,7 +202,7 @@ func (db *MemoryStorage) GetN(path string, limit int) ([]objects.Object, error)
 		}
 
 		newObject, err := objects.DecodeFull(value.([]byte))
-		if err != nil {
+		if err != nil || Expired(newObject.Expires, now) {
 			return true
 		}
 
@@ -201,6 +221,7 @@ func (db *MemoryStorage) GetN(path string, limit int) ([]objects.Object, error)
 
 // GetNRange get last N elements of a path related value(s)
 func (db *MemoryStorage) GetNRange(path string, limit int, from, to int64) ([]objects.Object, error) {
+	now := time.Now().UTC().UnixNano()
 	res := []objects.Object{}
 	if !strings.Contains(path, "*") {
 		return res, errors.New("katamari: invalid pattern")
@@ -226,7 +247,7 @@ func (db *MemoryStorage) GetNRange(path string, limit int, from, to int64) ([]ob
 		}
 
 		newObject, err := objects.DecodeFull(value.([]byte))
-		if err != nil {
+		if err != nil || Expired(newObject.Expires, now) {
 			return true
 		}
 
@@ -250,17 +271,23 @@ func (db *MemoryStorage) MemGetN(path string, limit int) ([]objects.Object, erro
 
 // Peek a value timestamps
 func (db *MemoryStorage) Peek(key string, now int64) (int64, int64) {
-	previous, found := db.mem.Load(key)
-	if !found {
-		return now, 0
+	created, updated, _ := db.peek(key, now)
+	return created, updated
+}
+
+// peek a value timestamps and revision
+func (db *MemoryStorage) peek(key string, now int64) (int64, int64, int64) {
+	previous := db.lookup(key)
+	if previous == nil {
+		return now, 0, 0
 	}
 
-	oldObject, err := objects.Decode(previous.([]byte))
+	oldObject, err := objects.Decode(previous)
 	if err != nil {
-		return now, 0
+		return now, 0, 0
 	}
 
-	return oldObject.Created, now
+	return oldObject.Created, now, oldObject.Revision
 }
 
 // MemSet a value
@@ -268,17 +295,99 @@ func (db *MemoryStorage) MemSet(path string, data string) (string, error) {
 	return db.Set(path, data)
 }
 
+// MemSetIf a value if the revision matches
+func (db *MemoryStorage) MemSetIf(path string, data string, revision int64) (string, error) {
+	return db.SetIf(path, data, revision)
+}
+
+// MemSetTTL a value that will expire after the ttl
+func (db *MemoryStorage) MemSetTTL(path string, data string, ttl time.Duration) (string, error) {
+	return db.SetTTL(path, data, ttl)
+}
+
 // Set a value
 func (db *MemoryStorage) Set(path string, data string) (string, error) {
+	return db.set(path, data, 0, false, 0)
+}
+
+// SetTTL a value that will expire after the ttl
+func (db *MemoryStorage) SetTTL(path string, data string, ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		return "", errors.New("katamari: invalid ttl")
+	}
+
+	return db.set(path, data, 0, false, Expires(time.Now().UTC().UnixNano(), ttl))
+}
+
+// SetIf a value if the stored revision matches (0 for a key that doesn't exist)
+func (db *MemoryStorage) SetIf(path string, data string, revision int64) (string, error) {
+	return db.set(path, data, revision, true, 0)
+}
+
+func (db *MemoryStorage) set(path string, data string, revision int64, check bool, expires int64) (string, error) {
 	now := time.Now().UTC().UnixNano()
 	index := key.LastIndex(path)
-	created, updated := db.Peek(path, now)
+	db.writeMutex.Lock()
+	created, updated, current := db.peek(path, now)
+	if check && current != revision {
+		db.writeMutex.Unlock()
+		return "", ErrRevisionMismatch
+	}
 	db.mem.Store(path, objects.New(&objects.Object{
-		Created: created,
-		Updated: updated,
-		Index:   index,
-		Data:    data,
+		Created:  created,
+		Updated:  updated,
+		Revision: current + 1,
+		Expires:  expires,
+		Index:    index,
+		Data:     data,
 	}))
+	db.expirations.Set(path, expires)
+	db.writeMutex.Unlock()
+
+	if !key.Contains(db.noBroadcastKeys, path) {
+		db.watcher <- StorageEvent{Key: path, Operation: "set"}
+	}
+	return index, nil
+}
+
+// MemUpdate a value with the data returned by the updater
+func (db *MemoryStorage) MemUpdate(path string, updater Updater) (string, error) {
+	return db.Update(path, updater)
+}
+
+// Update a value with the data returned by the updater
+func (db *MemoryStorage) Update(path string, updater Updater) (string, error) {
+	if strings.Contains(path, "*") {
+		return "", errors.New("katamari: pathKeyError key is not valid")
+	}
+
+	now := time.Now().UTC().UnixNano()
+	index := key.LastIndex(path)
+	db.writeMutex.Lock()
+	previous := db.lookup(path)
+	if previous == nil {
+		db.writeMutex.Unlock()
+		return "", errors.New("katamari: not found")
+	}
+	oldObject, err := objects.Decode(previous)
+	if err != nil {
+		db.writeMutex.Unlock()
+		return "", err
+	}
+	data, err := updater(oldObject)
+	if err != nil {
+		db.writeMutex.Unlock()
+		return "", err
+	}
+	db.mem.Store(path, objects.New(&objects.Object{
+		Created:  oldObject.Created,
+		Updated:  now,
+		Revision: oldObject.Revision + 1,
+		Expires:  oldObject.Expires,
+		Index:    index,
+		Data:     data,
+	}))
+	db.writeMutex.Unlock()
 
 	if !key.Contains(db.noBroadcastKeys, path) {
 		db.watcher <- StorageEvent{Key: path, Operation: "set"}
@@ -289,12 +398,17 @@ func (db *MemoryStorage) Set(path string, data string) (string, error) {
 // Pivot set entries on pivot instances (force created/updated values)
 func (db *MemoryStorage) Pivot(path string, data string, created int64, updated int64) (string, error) {
 	index := key.LastIndex(path)
+	db.writeMutex.Lock()
+	_, _, revision := db.peek(path, 0)
 	db.mem.Store(path, objects.New(&objects.Object{
-		Created: created,
-		Updated: updated,
-		Index:   index,
-		Data:    data,
+		Created:  created,
+		Updated:  updated,
+		Revision: revision + 1,
+		Index:    index,
+		Data:     data,
 	}))
+	db.expirations.Set(path, 0)
+	db.writeMutex.Unlock()
 
 	if len(path) > 8 && path[0:7] == "history" {
 		return index, nil
@@ -309,40 +423,136 @@ func (db *MemoryStorage) Pivot(path string, data string, created int64, updated
 // Del a key/pattern value(s)
 func (db *MemoryStorage) Del(path string) error {
 	if !strings.Contains(path, "*") {
-		_, found := db.mem.Load(path)
-		if !found {
+		db.writeMutex.Lock()
+		if db.lookup(path) == nil {
+			db.writeMutex.Unlock()
 			return errors.New("katamari: not found")
 		}
 		db.mem.Delete(path)
+		db.expirations.Set(path, 0)
+		db.writeMutex.Unlock()
 		if !key.Contains(db.noBroadcastKeys, path) {
 			db.watcher <- StorageEvent{Key: path, Operation: "del"}
 		}
 		return nil
 	}
 
+	db.writeMutex.Lock()
 	db.mem.Range(func(k interface{}, value interface{}) bool {
 		if key.Match(path, k.(string)) {
 			db.mem.Delete(k.(string))
 		}
 		return true
 	})
+	db.expirations.Del(path)
+	db.writeMutex.Unlock()
 	if !key.Contains(db.noBroadcastKeys, path) {
 		db.watcher <- StorageEvent{Key: path, Operation: "del"}
 	}
 	return nil
 }
 
+// load a stored value, nil if the key doesn't exist
+func (db *MemoryStorage) load(path string) []byte {
+	data, found := db.mem.Load(path)
+	if !found {
+		return nil
+	}
+
+	return data.([]byte)
+}
+
+// lookup a stored value, nil if the key doesn't exist or expired
+func (db *MemoryStorage) lookup(path string) []byte {
+	data := db.load(path)
+	if Expired(expires(data), time.Now().UTC().UnixNano()) {
+		return nil
+	}
+
+	return data
+}
+
+// Batch apply a list of set/del operations atomically
+func (db *MemoryStorage) Batch(operations []BatchOperation) ([]string, error) {
+	db.writeMutex.Lock()
+	writes, indexes, err := PlanBatch(operations, db.lookup)
+	if err != nil {
+		db.writeMutex.Unlock()
+		return nil, err
+	}
+	for _, write := range writes {
+		db.expirations.Set(write.Key, 0)
+		if write.Value == nil {
+			db.mem.Delete(write.Key)
+			continue
+		}
+		db.mem.Store(write.Key, write.Value)
+	}
+	db.writeMutex.Unlock()
+
+	for _, write := range writes {
+		if key.Contains(db.noBroadcastKeys, write.Key) {
+			continue
+		}
+		if write.Value == nil {
+			db.watcher <- StorageEvent{Key: write.Key, Operation: "del"}
+			continue
+		}
+		db.watcher <- StorageEvent{Key: write.Key, Operation: "set"}
+	}
+	return indexes, nil
+}
+
+// MemBatch apply a list of set/del operations atomically
+func (db *MemoryStorage) MemBatch(operations []BatchOperation) ([]string, error) {
+	return db.Batch(operations)
+}
+
 // MemDel a key/pattern value(s)
 func (db *MemoryStorage) MemDel(path string) error {
 	return db.Del(path)
 }
 
-// Watch the storage set/del events
+// expires of a stored value, 0 if it doesn't exist or has no ttl
+func expires(data []byte) int64 {
+	if data == nil {
+		return 0
+	}
+	obj, err := objects.Decode(data)
+	if err != nil {
+		return 0
+	}
+
+	return obj.Expires
+}
+
+// expire the keys with a ttl that passed
+func (db *MemoryStorage) expire() {
+	now := time.Now().UTC().UnixNano()
+	for _, path := range db.expirations.Expired(now) {
+		db.writeMutex.Lock()
+		current := expires(db.load(path))
+		if current == 0 || current > now {
+			db.expirations.Set(path, current)
+			db.writeMutex.Unlock()
+			continue
+		}
+		db.mem.Delete(path)
+		db.expirations.Set(path, 0)
+		db.writeMutex.Unlock()
+
+		if !key.Contains(db.noBroadcastKeys, path) {
+			db.watcher <- StorageEvent{Key: path, Operation: "expire"}
+		}
+	}
+}
+
+// Watch the storage set/del/expire events
 func (db *MemoryStorage) Watch() StorageChan {
 	return db.watcher
 }
 
-// MemWatch the storage set/del events
+// MemWatch the storage set/del/expire events
 func (db *MemoryStorage) MemWatch() StorageChan {
 	return db.watcher
 }
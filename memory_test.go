@@ -3,20 +3,37 @@ package katamari
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/benitogf/katamari/messages"
+	"github.com/stretchr/testify/require"
 )
 
 func TestStorageMemory(t *testing.T) {
 	t.Parallel()
 	app := &Server{}
 	app.Silence = true
+	app.ExpireInterval = 10 * time.Millisecond
 	app.Start("localhost:0")
 	defer app.Close(os.Interrupt)
 	for i := range units {
 		StorageListTest(app, t, messages.Encode([]byte(units[i])))
 	}
 	StorageObjectTest(app, t)
+	StorageSetIfTest(app, t)
+	StorageBatchTest(app, t)
+	StorageUpdateTest(app, t)
+	StorageTTLTest(app, t)
+}
+
+func TestStorageMemoryExpired(t *testing.T) {
+	t.Parallel()
+	app := &Server{}
+	app.Silence = true
+	app.ExpireInterval = time.Hour
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	StorageExpiredTest(app, t)
 }
 
 func TestStreamBroadcastMemory(t *testing.T) {
@@ -65,3 +82,27 @@ func TestKeysRange(t *testing.T) {
 	defer app.Close(os.Interrupt)
 	StorageKeysRangeTest(app, t)
 }
+
+func TestMemoryExpire(t *testing.T) {
+	t.Parallel()
+	db := &MemoryStorage{}
+	err := db.Start(StorageOpt{ExpireInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	events := make(chan StorageEvent, 2)
+	go func(watcher StorageChan) {
+		for ev := range watcher {
+			events <- ev
+		}
+	}(db.Watch())
+	defer db.Close()
+
+	_, err = db.SetTTL("test", "test", 10*time.Millisecond)
+	require.NoError(t, err)
+	ev := <-events
+	require.Equal(t, "set", ev.Operation)
+	ev = <-events
+	require.Equal(t, "test", ev.Key)
+	require.Equal(t, "expire", ev.Operation)
+	_, err = db.Get("test")
+	require.Error(t, err)
+}
@@ -5,14 +5,64 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"io/ioutil"
+	"mime"
 	"strings"
 )
 
+// RawType media type of the raw json mode, data is sent and received as json instead of base64
+const RawType = "application/vnd.katamari.raw+json"
+
 // Message sent through websocket connections
 type Message struct {
+	Key      string `json:"key,omitempty"`
 	Data     string `json:"data"`
 	Version  string `json:"version"`
 	Snapshot bool   `json:"snapshot"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Command sent by clients through websocket connections
+type Command struct {
+	ID      string `json:"id"`
+	Op      string `json:"op"`
+	Key     string `json:"key"`
+	Version string `json:"version"`
+	Data    string `json:"data"`
+}
+
+// rawCommand sent by clients in the raw json mode, the data is json instead of base64
+type rawCommand struct {
+	ID      string          `json:"id"`
+	Op      string          `json:"op"`
+	Key     string          `json:"key"`
+	Version string          `json:"version"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// Reply to a write or delete command
+type Reply struct {
+	ID    string `json:"id"`
+	Key   string `json:"key,omitempty"`
+	Index string `json:"index,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Includes checks if a header value (Accept, Content-Type) includes a media type
+func Includes(header string, mediaType string) bool {
+	for _, value := range strings.Split(header, ",") {
+		current, _, err := mime.ParseMediaType(strings.TrimSpace(value))
+		if err == nil && current == mediaType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsRaw checks if a header value (Accept, Content-Type) includes the raw json media type
+func IsRaw(header string) bool {
+	return Includes(header, RawType)
 }
 
 // Encode to base64 string from bytes
@@ -36,6 +86,113 @@ func DecodeTest(data []byte) (Message, error) {
 	return wsEvent, nil
 }
 
+// DecodeCommand from a websocket message
+func DecodeCommand(data []byte) (Command, error) {
+	var command Command
+	err := json.Unmarshal(data, &command)
+	if err != nil {
+		return command, err
+	}
+	return command, check(command)
+}
+
+// DecodeRawCommand from a websocket message of a raw connection
+func DecodeRawCommand(data []byte) (Command, error) {
+	var raw rawCommand
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return Command{ID: raw.ID, Key: raw.Key}, err
+	}
+	command, err := encodeCommand(raw)
+	if err != nil {
+		return command, err
+	}
+	return command, check(command)
+}
+
+// DecodeRawBatch list of commands with json data
+func DecodeRawBatch(r io.Reader) ([]Command, error) {
+	var raws []rawCommand
+	decoder := json.NewDecoder(r)
+	err := decoder.Decode(&raws)
+	if err != nil {
+		return nil, err
+	}
+	commands := make([]Command, len(raws))
+	for i, raw := range raws {
+		commands[i], err = encodeCommand(raw)
+		if err != nil {
+			return commands, err
+		}
+	}
+
+	return commands, checkBatch(commands)
+}
+
+// encodeCommand converts the json data of a raw set command to base64,
+// the data of the other operations (ex: the token of an auth) is a string
+func encodeCommand(raw rawCommand) (Command, error) {
+	command := Command{ID: raw.ID, Op: raw.Op, Key: raw.Key, Version: raw.Version}
+	if len(raw.Data) == 0 || string(raw.Data) == "null" {
+		return command, nil
+	}
+	if raw.Op == "set" {
+		command.Data = Encode(raw.Data)
+		return command, nil
+	}
+	err := json.Unmarshal(raw.Data, &command.Data)
+	if err != nil {
+		return command, errors.New("katamari: invalid command data")
+	}
+
+	return command, nil
+}
+
+// DecodeBatch list of commands
+func DecodeBatch(r io.Reader) ([]Command, error) {
+	var commands []Command
+	decoder := json.NewDecoder(r)
+	err := decoder.Decode(&commands)
+	if err != nil {
+		return commands, err
+	}
+
+	return commands, checkBatch(commands)
+}
+
+func checkBatch(commands []Command) error {
+	if len(commands) == 0 {
+		return errors.New("katamari: empty batch")
+	}
+	for _, command := range commands {
+		err := check(command)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func check(command Command) error {
+	if command.Op == "" {
+		return errors.New("katamari: empty command operation")
+	}
+	if command.Op == "set" {
+		return validate(command.Data)
+	}
+
+	return nil
+}
+
+func validate(data string) error {
+	if data == "" {
+		return errors.New("katamari: empty post data")
+	}
+	_, err := base64.StdEncoding.DecodeString(data)
+	return err
+}
+
 // Decode message
 func Decode(r io.Reader) (Message, error) {
 	var httpEvent Message
@@ -44,13 +201,28 @@ func Decode(r io.Reader) (Message, error) {
 	if err != nil {
 		return httpEvent, err
 	}
-	if httpEvent.Data == "" {
-		return httpEvent, errors.New("katamari: empty post data")
+	err = validate(httpEvent.Data)
+	if err != nil {
+		return httpEvent, err
 	}
-	_, err = base64.StdEncoding.DecodeString(httpEvent.Data)
+
+	return httpEvent, nil
+}
+
+// DecodeRaw message, the body is the json data to store
+func DecodeRaw(r io.Reader) (Message, error) {
+	var httpEvent Message
+	data, err := ioutil.ReadAll(r)
 	if err != nil {
 		return httpEvent, err
 	}
+	if len(data) == 0 {
+		return httpEvent, errors.New("katamari: empty post data")
+	}
+	if !json.Valid(data) {
+		return httpEvent, errors.New("katamari: invalid json data")
+	}
+	httpEvent.Data = Encode(data)
 
 	return httpEvent, nil
 }
@@ -0,0 +1,325 @@
+package katamari
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/benitogf/katamari/objects"
+	"github.com/benitogf/katamari/stream"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics collected by the server on a private registry
+// exposed on the /metrics route
+type metrics struct {
+	registry   *prometheus.Registry
+	handler    http.Handler
+	requests   *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+	broadcasts prometheus.Histogram
+	patches    *prometheus.CounterVec
+	storage    *prometheus.HistogramVec
+}
+
+// pools collects the active connections of the pools labelled by key,
+// the scoped pools of a key are added together so the principals of the
+// connections don't become labels and the pools without connections are skipped
+type pools struct {
+	stream      *stream.Pools
+	connections *prometheus.Desc
+}
+
+func (p *pools) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.connections
+}
+
+func (p *pools) Collect(ch chan<- prometheus.Metric) {
+	for key, count := range p.stream.Connections() {
+		if count == 0 {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(p.connections, prometheus.GaugeValue, float64(count), key)
+	}
+}
+
+func newMetrics(app *Server) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "katamari_requests_total",
+			Help: "Requests handled by route, method and status.",
+		}, []string{"route", "method", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "katamari_request_duration_seconds",
+			Help:    "Latency of the requests by route and method, subscriptions are not observed.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		broadcasts: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "katamari_broadcast_duration_seconds",
+			Help:    "Latency of a storage event until its messages are written to every connection of the matching pools.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		patches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "katamari_broadcast_messages_total",
+			Help: "Broadcasted messages by type (patch or snapshot).",
+		}, []string{"type"}),
+		storage: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "katamari_storage_duration_seconds",
+			Help:    "Latency of the storage operations.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"operation"}),
+	}
+	m.registry.MustRegister(
+		m.requests,
+		m.duration,
+		m.broadcasts,
+		m.patches,
+		m.storage,
+		&pools{
+			stream: &app.Stream,
+			connections: prometheus.NewDesc(
+				"katamari_connections",
+				"Active connections of the pools by key, a multiplexed connection counts once for each subscription.",
+				[]string{"key"}, nil),
+		},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	m.handler = promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+
+	return m
+}
+
+// broadcast observes the latency of a broadcast started at start once
+// its messages are delivered
+func (m *metrics) broadcast(start time.Time, deliveries []*sync.WaitGroup) {
+	if m == nil {
+		return
+	}
+	go func() {
+		for _, delivery := range deliveries {
+			delivery.Wait()
+		}
+		m.broadcasts.Observe(time.Since(start).Seconds())
+	}()
+}
+
+// patch counts a broadcasted message by type
+func (m *metrics) patch(snapshot bool) {
+	if m == nil {
+		return
+	}
+	if snapshot {
+		m.patches.WithLabelValues("snapshot").Inc()
+		return
+	}
+	m.patches.WithLabelValues("patch").Inc()
+}
+
+// observe the latency of a storage operation started at start
+func (m *metrics) observe(operation string, start time.Time) {
+	m.storage.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// statusWriter captures the status of a response, keeping the
+// hijacker and flusher of the writer for subscriptions
+type statusWriter struct {
+	http.ResponseWriter
+	status    int
+	streaming bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Unwrap the writer for the response controller
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *statusWriter) Flush() {
+	flusher, ok := w.ResponseWriter.(http.Flusher)
+	if !ok {
+		return
+	}
+	w.streaming = true
+	flusher.Flush()
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("katamari: the response writer doesn't support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		w.status = http.StatusSwitchingProtocols
+		w.streaming = true
+	}
+	return conn, rw, err
+}
+
+// middleware counts the requests of the router routes
+func (m *metrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.URL.Path
+		current := mux.CurrentRoute(r)
+		if current != nil {
+			template, err := current.GetPathTemplate()
+			if err == nil {
+				route = template
+			}
+		}
+		start := time.Now()
+		writer := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(writer, r)
+		if writer.status == 0 {
+			writer.status = http.StatusOK
+		}
+		m.requests.WithLabelValues(route, r.Method, strconv.Itoa(writer.status)).Inc()
+		if !writer.streaming {
+			m.duration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		}
+	})
+}
+
+func (app *Server) getMetrics(w http.ResponseWriter, r *http.Request) {
+	if !app.Audit(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "%s", errors.New("katamari: this request is not authorized"))
+		return
+	}
+
+	app.metrics.handler.ServeHTTP(w, r)
+}
+
+// instrumented storage decorator that observes the latency of the operations
+type instrumented struct {
+	Database
+	metrics *metrics
+}
+
+func (db *instrumented) Keys() ([]byte, error) {
+	defer db.metrics.observe("keys", time.Now())
+	return db.Database.Keys()
+}
+
+func (db *instrumented) KeysRange(path string, from, to int64) ([]string, error) {
+	defer db.metrics.observe("keysRange", time.Now())
+	return db.Database.KeysRange(path, from, to)
+}
+
+func (db *instrumented) Get(key string) ([]byte, error) {
+	defer db.metrics.observe("get", time.Now())
+	return db.Database.Get(key)
+}
+
+func (db *instrumented) MemGet(key string) ([]byte, error) {
+	defer db.metrics.observe("memGet", time.Now())
+	return db.Database.MemGet(key)
+}
+
+func (db *instrumented) GetN(path string, limit int) ([]objects.Object, error) {
+	defer db.metrics.observe("getN", time.Now())
+	return db.Database.GetN(path, limit)
+}
+
+func (db *instrumented) GetNRange(path string, limit int, from, to int64) ([]objects.Object, error) {
+	defer db.metrics.observe("getNRange", time.Now())
+	return db.Database.GetNRange(path, limit, from, to)
+}
+
+func (db *instrumented) MemGetN(path string, limit int) ([]objects.Object, error) {
+	defer db.metrics.observe("memGetN", time.Now())
+	return db.Database.MemGetN(path, limit)
+}
+
+func (db *instrumented) GetObjList(path string) ([]objects.Object, error) {
+	defer db.metrics.observe("getObjList", time.Now())
+	return db.Database.GetObjList(path)
+}
+
+func (db *instrumented) Set(key string, data string) (string, error) {
+	defer db.metrics.observe("set", time.Now())
+	return db.Database.Set(key, data)
+}
+
+func (db *instrumented) MemSet(key string, data string) (string, error) {
+	defer db.metrics.observe("memSet", time.Now())
+	return db.Database.MemSet(key, data)
+}
+
+func (db *instrumented) SetTTL(key string, data string, ttl time.Duration) (string, error) {
+	defer db.metrics.observe("setTTL", time.Now())
+	return db.Database.SetTTL(key, data, ttl)
+}
+
+func (db *instrumented) MemSetTTL(key string, data string, ttl time.Duration) (string, error) {
+	defer db.metrics.observe("memSetTTL", time.Now())
+	return db.Database.MemSetTTL(key, data, ttl)
+}
+
+func (db *instrumented) SetIf(key string, data string, revision int64) (string, error) {
+	defer db.metrics.observe("setIf", time.Now())
+	return db.Database.SetIf(key, data, revision)
+}
+
+func (db *instrumented) MemSetIf(key string, data string, revision int64) (string, error) {
+	defer db.metrics.observe("memSetIf", time.Now())
+	return db.Database.MemSetIf(key, data, revision)
+}
+
+func (db *instrumented) Update(key string, updater Updater) (string, error) {
+	defer db.metrics.observe("update", time.Now())
+	return db.Database.Update(key, updater)
+}
+
+func (db *instrumented) MemUpdate(key string, updater Updater) (string, error) {
+	defer db.metrics.observe("memUpdate", time.Now())
+	return db.Database.MemUpdate(key, updater)
+}
+
+func (db *instrumented) Pivot(key string, data string, created, updated int64) (string, error) {
+	defer db.metrics.observe("pivot", time.Now())
+	return db.Database.Pivot(key, data, created, updated)
+}
+
+func (db *instrumented) Del(key string) error {
+	defer db.metrics.observe("del", time.Now())
+	return db.Database.Del(key)
+}
+
+func (db *instrumented) MemDel(key string) error {
+	defer db.metrics.observe("memDel", time.Now())
+	return db.Database.MemDel(key)
+}
+
+func (db *instrumented) Batch(operations []BatchOperation) ([]string, error) {
+	defer db.metrics.observe("batch", time.Now())
+	return db.Database.Batch(operations)
+}
+
+func (db *instrumented) MemBatch(operations []BatchOperation) ([]string, error) {
+	defer db.metrics.observe("memBatch", time.Now())
+	return db.Database.MemBatch(operations)
+}
@@ -0,0 +1,91 @@
+package katamari_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benitogf/katamari"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+	app := katamari.Server{}
+	app.Silence = true
+	app.Metrics = true
+	app.Identify = func(r *http.Request) string {
+		return r.Header.Get("X-User")
+	}
+	app.ScopedFilter("todos/*", func(key string, principal string, data []byte) ([]byte, error) {
+		return data, nil
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	_, ok := app.Storage.(*katamari.MemoryStorage)
+	require.True(t, ok)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/test"}
+	wsClient, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer wsClient.Close()
+	_, _, err = wsClient.ReadMessage()
+	require.NoError(t, err)
+	for _, user := range []string{"alice", "bob"} {
+		u := url.URL{Scheme: "ws", Host: app.Address, Path: "/todos/*"}
+		scoped, _, err := websocket.DefaultDialer.Dial(u.String(), http.Header{"X-User": []string{user}})
+		require.NoError(t, err)
+		defer scoped.Close()
+		_, _, err = scoped.ReadMessage()
+		require.NoError(t, err)
+	}
+
+	req := httptest.NewRequest("POST", "/test", bytes.NewBuffer([]byte(`{"data":"e30="}`)))
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	_, _, err = wsClient.ReadMessage()
+	require.NoError(t, err)
+
+	scrape := func() string {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		resp := w.Result()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+	// the broadcast is observed once the message is delivered
+	require.Eventually(t, func() bool {
+		return strings.Contains(scrape(), `katamari_broadcast_duration_seconds_count 1`)
+	}, time.Second, 10*time.Millisecond)
+	metrics := scrape()
+	require.Contains(t, metrics, `katamari_requests_total{method="POST",route="/{key:[a-zA-Z\\*\\d\\/]+}",status="200"} 1`)
+	require.Contains(t, metrics, `katamari_connections{key="test"} 1`)
+	require.Contains(t, metrics, `katamari_connections{key="todos/*"} 2`)
+	require.NotContains(t, metrics, `alice`)
+	require.Contains(t, metrics, `katamari_broadcast_messages_total{type="snapshot"} 1`)
+	require.Contains(t, metrics, `katamari_storage_duration_seconds_count{operation="set"} 1`)
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	t.Parallel()
+	app := katamari.Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+}
@@ -0,0 +1,59 @@
+package katamari
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/benitogf/katamari/key"
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/stream"
+)
+
+func (app *Server) multiplex(w http.ResponseWriter, r *http.Request) {
+	if !app.Audit(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "%s", errors.New("katamari: this request is not authorized"))
+		app.console.Err("socketConnectionUnauthorized multiplex")
+		return
+	}
+
+	client, err := app.Stream.Multiplex(w, r)
+	if err != nil {
+		return
+	}
+
+	app.Stream.Listen(client)
+}
+
+func (app *Server) subscribe(client *stream.Conn, command messages.Command) {
+	_key := command.Key
+	if !key.IsValid(_key) {
+		app.Stream.WriteError(client, _key, errors.New("katamari: pathKeyError key is not valid"))
+		return
+	}
+
+	if !app.auditCommand(client.Request(), _key, ActionRead) {
+		app.Stream.WriteError(client, _key, errUnauthorized)
+		return
+	}
+
+	err := app.Stream.Join(_key, _key, client)
+	if err != nil {
+		app.Stream.WriteError(client, _key, err)
+		return
+	}
+
+	entry, err := app.fetch(_key, client.Principal())
+	if err != nil {
+		app.console.Err("katamari: filtered route", err)
+		app.Stream.Leave(_key, _key, client)
+		app.Stream.WriteError(client, _key, err)
+		return
+	}
+
+	if command.Version != strconv.FormatInt(entry.Version, 16) {
+		app.Stream.WriteKey(client, _key, messages.Encode(entry.Data), true, entry.Version)
+	}
+}
@@ -0,0 +1,99 @@
+package katamari
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiplex(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.ForcePatch = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/_mux"}
+	wsClient, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer wsClient.Close()
+
+	read := func() messages.Message {
+		_, message, err := wsClient.ReadMessage()
+		require.NoError(t, err)
+		wsEvent, err := messages.DecodeTest(message)
+		require.NoError(t, err)
+		return wsEvent
+	}
+
+	err = wsClient.WriteJSON(messages.Command{Op: "subscribe", Key: "test"})
+	require.NoError(t, err)
+	wsEvent := read()
+	require.Equal(t, "test", wsEvent.Key)
+	require.True(t, wsEvent.Snapshot)
+
+	err = wsClient.WriteJSON(messages.Command{Op: "subscribe", Key: "things/*"})
+	require.NoError(t, err)
+	wsEvent = read()
+	require.Equal(t, "things/*", wsEvent.Key)
+	require.Equal(t, "[]", wsEvent.Data)
+
+	_, err = app.Storage.Set("things/1", messages.Encode([]byte("one")))
+	require.NoError(t, err)
+	wsEvent = read()
+	require.Equal(t, "things/*", wsEvent.Key)
+	require.False(t, wsEvent.Snapshot)
+
+	_, err = app.Storage.Set("test", messages.Encode([]byte("test")))
+	require.NoError(t, err)
+	wsEvent = read()
+	require.Equal(t, "test", wsEvent.Key)
+
+	err = wsClient.WriteJSON(messages.Command{Op: "unsubscribe", Key: "things/*"})
+	require.NoError(t, err)
+	err = wsClient.WriteJSON(messages.Command{Op: "subscribe", Key: "test//1"})
+	require.NoError(t, err)
+	_, message, err := wsClient.ReadMessage()
+	require.NoError(t, err)
+	require.Contains(t, string(message), "pathKeyError")
+
+	_, err = app.Storage.Set("things/2", messages.Encode([]byte("two")))
+	require.NoError(t, err)
+	_, err = app.Storage.Set("test", messages.Encode([]byte("test update")))
+	require.NoError(t, err)
+	wsEvent = read()
+	require.Equal(t, "test", wsEvent.Key)
+}
+
+func TestMultiplexAudit(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.Audit = func(r *http.Request) bool {
+		return r.URL.Path == "/_mux" || r.URL.Path == "/public"
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/_mux"}
+	wsClient, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer wsClient.Close()
+
+	// each subscription is audited on its key
+	require.NoError(t, wsClient.WriteJSON(messages.Command{Op: "subscribe", Key: "secret"}))
+	_, message, err := wsClient.ReadMessage()
+	require.NoError(t, err)
+	require.Contains(t, string(message), errUnauthorized.Error())
+	require.NoError(t, wsClient.WriteJSON(messages.Command{Op: "subscribe", Key: "public"}))
+	_, message, err = wsClient.ReadMessage()
+	require.NoError(t, err)
+	wsEvent, err := messages.DecodeTest(message)
+	require.NoError(t, err)
+	require.Equal(t, "public", wsEvent.Key)
+	require.True(t, wsEvent.Snapshot)
+}
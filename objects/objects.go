@@ -5,18 +5,22 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"io"
+	"strconv"
+	"strings"
 )
 
 // Object : data structure of elements
 type Object struct {
-	Created int64  `json:"created"`
-	Updated int64  `json:"updated"`
-	Index   string `json:"index"`
-	Data    string `json:"data"`
+	Created  int64  `json:"created"`
+	Updated  int64  `json:"updated"`
+	Revision int64  `json:"revision"`
+	Expires  int64  `json:"expires,omitempty"`
+	Index    string `json:"index"`
+	Data     string `json:"data"`
 }
 
 // EmptyObject byte array value
-var EmptyObject = []byte(`{ "created": 0, "updated": 0, "index": "", "data": "e30=" }`)
+var EmptyObject = []byte(`{ "created": 0, "updated": 0, "revision": 0, "index": "", "data": "e30=" }`)
 
 func max(a, b int64) int64 {
 	if a > b {
@@ -34,6 +38,12 @@ func Sort(obj []Object) func(i, j int) bool {
 	}
 }
 
+// ETag of an object, the creation time tells apart the
+// revisions of a key that was deleted and created again
+func ETag(obj Object) string {
+	return "\"" + strconv.FormatInt(obj.Revision, 10) + "-" + strconv.FormatInt(obj.Created, 36) + "\""
+}
+
 // Encode objects in json
 func Encode(v interface{}) ([]byte, error) {
 	data, err := json.Marshal(v)
@@ -138,3 +148,75 @@ func New(obj *Object) []byte {
 
 	return dataBytes.Bytes()
 }
+
+// data decodes a base64 data field into json, data that is not
+// json will be returned as a json string
+func data(encoded string) json.RawMessage {
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err == nil && json.Valid(decoded) {
+		return decoded
+	}
+	if err == nil {
+		encoded = string(decoded)
+	}
+	str, _ := json.Marshal(encoded)
+	return str
+}
+
+// expand the data field of an object or list of objects
+func expand(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		encoded, ok := v["data"].(string)
+		if ok {
+			v["data"] = data(encoded)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = expand(v[i])
+		}
+	}
+
+	return value
+}
+
+// Expand the base64 data fields of an encoded object or list of objects into json
+func Expand(encoded []byte) ([]byte, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(expand(value))
+}
+
+// ExpandPatch transforms the operations of a patch created between encoded objects
+// into operations that apply to the expanded objects
+func ExpandPatch(patch []byte) ([]byte, error) {
+	var operations []map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(patch))
+	decoder.UseNumber()
+	err := decoder.Decode(&operations)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, operation := range operations {
+		value, ok := operation["value"]
+		if !ok {
+			continue
+		}
+		path, _ := operation["path"].(string)
+		encoded, ok := value.(string)
+		if ok && (strings.HasSuffix(path, "/data")) {
+			operation["value"] = data(encoded)
+			continue
+		}
+		operation["value"] = expand(value)
+	}
+
+	return json.Marshal(operations)
+}
@@ -0,0 +1,190 @@
+package katamari
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/benitogf/jsonpatch"
+	"github.com/benitogf/katamari/key"
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/objects"
+	"github.com/gorilla/mux"
+)
+
+// media types of the patch documents
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+var errUnsupportedPatch = errors.New("katamari: unsupported patch media type, use " + MergePatchType + " or " + JSONPatchType)
+
+// errPatchConflict the key changed while the patch was applied
+var errPatchConflict = errors.New("katamari: the key changed while patching")
+
+// patchRetries number of times a patch is applied again when the key changes meanwhile
+const patchRetries = 5
+
+// patcher decodes a patch document according to its media type
+// and returns a function that applies it to json data
+func patcher(contentType string, body []byte) (func([]byte) ([]byte, error), error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, errUnsupportedPatch
+	}
+
+	switch mediaType {
+	case MergePatchType:
+		if !json.Valid(body) {
+			return nil, errors.New("katamari: invalid merge patch")
+		}
+		return func(data []byte) ([]byte, error) {
+			return jsonpatch.MergePatch(data, body)
+		}, nil
+	case JSONPatchType:
+		patch, err := jsonpatch.DecodePatch(body)
+		if err != nil {
+			return nil, err
+		}
+		return patch.Apply, nil
+	default:
+		return nil, errUnsupportedPatch
+	}
+}
+
+// object stored on a key of the storage that corresponds to it
+func (app *Server) object(_key string) (objects.Object, error) {
+	var raw []byte
+	var err error
+	if key.Contains(app.InMemoryKeys, _key) {
+		raw, err = app.storage.MemGet(_key)
+	} else {
+		raw, err = app.storage.Get(_key)
+	}
+	if err != nil {
+		return objects.Object{}, err
+	}
+
+	return objects.Decode(raw)
+}
+
+func (app *Server) patch(w http.ResponseWriter, r *http.Request) {
+	_key := mux.Vars(r)["key"]
+	if !key.IsValid(_key) || strings.Contains(_key, "*") {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", errors.New("katamari: pathKeyError key is not valid"))
+		return
+	}
+
+	if !app.Audit(r) || !app.auditKey(r, _key, ActionWrite) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "%s", errors.New("katamari: this request is not authorized"))
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	apply, err := patcher(r.Header.Get("Content-Type"), body)
+	if err == errUnsupportedPatch {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	match, conditional, err := ifMatch(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	// the filters run outside of the storage lock, the patched data
+	// is only stored if the key didn't change meanwhile
+	var index string
+	var obj objects.Object
+	status := http.StatusBadRequest
+	err = errPatchConflict
+	for attempt := 0; attempt < patchRetries && err == errPatchConflict; attempt++ {
+		status = http.StatusBadRequest
+		obj, err = app.object(_key)
+		if err != nil {
+			break
+		}
+		if conditional && !match.match(obj) {
+			err = ErrRevisionMismatch
+			break
+		}
+		var current, patched, data []byte
+		current, err = base64.StdEncoding.DecodeString(obj.Data)
+		if err != nil {
+			break
+		}
+		patched, err = apply(current)
+		if err != nil {
+			status = http.StatusUnprocessableEntity
+			break
+		}
+		data, err = app.checkWrite(_key, []byte(messages.Encode(patched)))
+		if err != nil {
+			break
+		}
+		status = http.StatusInternalServerError
+		index, err = app.update(_key, func(stored objects.Object) (string, error) {
+			if stored.Revision != obj.Revision || stored.Created != obj.Created {
+				return "", errPatchConflict
+			}
+			return string(data), nil
+		})
+	}
+
+	if err == ErrRevisionMismatch {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	if err == errPatchConflict {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	if notFound(err) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	if err != nil {
+		app.console.Err("patchError["+_key+"]", err)
+		w.WriteHeader(filterStatus(err, status))
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	app.console.Log("patch", _key)
+	app.filters.afterChain().check(_key)
+	obj.Revision++
+	w.Header().Set("ETag", objects.ETag(obj))
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "{"+
+		"\"index\": \""+index+"\""+
+		"}")
+}
@@ -0,0 +1,122 @@
+package katamari
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/objects"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatch(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.ForcePatch = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	_, err := app.Storage.Set("test", messages.Encode([]byte(`{"name":"test","count":1}`)))
+	require.NoError(t, err)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/test"}
+	wsClient, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer wsClient.Close()
+	_, _, err = wsClient.ReadMessage()
+	require.NoError(t, err)
+
+	patch := func(path string, contentType string, body string, revision string) *http.Response {
+		req := httptest.NewRequest("PATCH", path, bytes.NewBuffer([]byte(body)))
+		req.Header.Set("Content-Type", contentType)
+		if revision != "" {
+			req.Header.Set("If-Match", revision)
+		}
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		return w.Result()
+	}
+	stored := func() objects.Object {
+		data, err := app.Storage.Get("test")
+		require.NoError(t, err)
+		obj, err := objects.DecodeFull(data)
+		require.NoError(t, err)
+		return obj
+	}
+
+	resp := patch("/test", MergePatchType, `{"count":2}`, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.JSONEq(t, `{"name":"test","count":2}`, stored().Data)
+	require.Equal(t, objects.ETag(stored()), resp.Header.Get("ETag"))
+	_, message, err := wsClient.ReadMessage()
+	require.NoError(t, err)
+	wsEvent, err := messages.DecodeTest(message)
+	require.NoError(t, err)
+	require.False(t, wsEvent.Snapshot)
+
+	stale := objects.ETag(stored())
+	resp = patch("/test", JSONPatchType, `[{"op":"replace","path":"/name","value":"patched"}]`, stale)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.JSONEq(t, `{"name":"patched","count":2}`, stored().Data)
+	require.Equal(t, int64(3), stored().Revision)
+
+	resp = patch("/test", JSONPatchType, `[{"op":"replace","path":"/name","value":"stale"}]`, stale)
+	require.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	resp = patch("/test", JSONPatchType, `[{"op":"replace","path":"/name","value":"stale"}]`, "0")
+	require.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	resp = patch("/test", JSONPatchType, `[{"op":"remove","path":"/missing"}]`, "")
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	resp = patch("/test", JSONPatchType, `{"op":"remove"}`, "")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = patch("/test", MergePatchType, `{"count":`, "")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = patch("/test", "application/json", `{"count":3}`, "")
+	require.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+	resp = patch("/missing", MergePatchType, `{"count":3}`, "")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = patch("/test/*", MergePatchType, `{"count":3}`, "")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.JSONEq(t, `{"name":"patched","count":2}`, stored().Data)
+}
+
+func TestPatchFilterWrite(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	// a filter that writes to the storage doesn't block the patch
+	app.WriteFilter("test", func(index string, data []byte) ([]byte, error) {
+		_, err := app.Storage.Set("audit", string(data))
+		return data, err
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	_, err := app.Storage.Set("test", messages.Encode([]byte(`{"count":1}`)))
+	require.NoError(t, err)
+
+	done := make(chan *http.Response)
+	go func() {
+		req := httptest.NewRequest("PATCH", "/test", bytes.NewBuffer([]byte(`{"count":2}`)))
+		req.Header.Set("Content-Type", MergePatchType)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		done <- w.Result()
+	}()
+
+	select {
+	case resp := <-done:
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the patch is blocked by the filter")
+	}
+	data, err := app.Storage.Get("audit")
+	require.NoError(t, err)
+	obj, err := objects.DecodeFull(data)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"count":2}`, obj.Data)
+}
@@ -0,0 +1,193 @@
+package katamari
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/benitogf/jsonpatch"
+	"github.com/benitogf/katamari/messages"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+type rawMessage struct {
+	Data     json.RawMessage `json:"data"`
+	Version  string          `json:"version"`
+	Snapshot bool            `json:"snapshot"`
+}
+
+func TestRaw(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.ForcePatch = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/things/*", RawQuery: "raw=1"}
+	wsClient, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer wsClient.Close()
+	read := func() rawMessage {
+		var message rawMessage
+		_, data, err := wsClient.ReadMessage()
+		require.NoError(t, err)
+		err = json.Unmarshal(data, &message)
+		require.NoError(t, err)
+		return message
+	}
+	message := read()
+	require.True(t, message.Snapshot)
+	require.Equal(t, "[]", string(message.Data))
+	cache := []byte(message.Data)
+
+	post := func(path string, body string) *http.Response {
+		req := httptest.NewRequest("POST", path, bytes.NewBuffer([]byte(body)))
+		req.Header.Set("Content-Type", messages.RawType)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		return w.Result()
+	}
+	resp := post("/things/1", `{"name":"one","count":1}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = post("/things/1", `{"name":`)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = post("/things/1", ``)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	message = read()
+	require.False(t, message.Snapshot)
+	patch, err := jsonpatch.DecodePatch(message.Data)
+	require.NoError(t, err)
+	cache, err = patch.Apply(cache)
+	require.NoError(t, err)
+	var objs []struct {
+		Index string          `json:"index"`
+		Data  json.RawMessage `json:"data"`
+	}
+	err = json.Unmarshal(cache, &objs)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(objs))
+	require.Equal(t, "1", objs[0].Index)
+	require.JSONEq(t, `{"name":"one","count":1}`, string(objs[0].Data))
+
+	resp = post("/things/1", `{"name":"updated","count":2}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	message = read()
+	patch, err = jsonpatch.DecodePatch(message.Data)
+	require.NoError(t, err)
+	cache, err = patch.Apply(cache)
+	require.NoError(t, err)
+	err = json.Unmarshal(cache, &objs)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name":"updated","count":2}`, string(objs[0].Data))
+
+	req := httptest.NewRequest("GET", "/things/1", nil)
+	req.Header.Set("Accept", messages.RawType)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp = w.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, messages.RawType, resp.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	var obj struct {
+		Index string          `json:"index"`
+		Data  json.RawMessage `json:"data"`
+	}
+	err = json.Unmarshal(body, &obj)
+	require.NoError(t, err)
+	require.Equal(t, objs[0].Index, obj.Index)
+	require.JSONEq(t, `{"name":"updated","count":2}`, string(obj.Data))
+
+	req = httptest.NewRequest("GET", "/things/*", nil)
+	req.Header.Set("Accept", "text/html, "+messages.RawType+";q=0.9")
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	body, err = ioutil.ReadAll(w.Result().Body)
+	require.NoError(t, err)
+	err = json.Unmarshal(body, &objs)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(objs))
+	require.JSONEq(t, `{"name":"updated","count":2}`, string(objs[0].Data))
+
+	req = httptest.NewRequest("GET", "/things/1", nil)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	body, err = ioutil.ReadAll(w.Result().Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), messages.Encode([]byte(`{"name":"updated","count":2}`)))
+}
+
+func TestRawCommands(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/things/*", RawQuery: "raw=1"}
+	wsClient, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer wsClient.Close()
+	_, _, err = wsClient.ReadMessage()
+	require.NoError(t, err)
+	reply := func() messages.Reply {
+		for {
+			_, data, err := wsClient.ReadMessage()
+			require.NoError(t, err)
+			var reply messages.Reply
+			require.NoError(t, json.Unmarshal(data, &reply))
+			if reply.ID != "" {
+				return reply
+			}
+		}
+	}
+
+	// the commands of a raw connection use json data
+	require.NoError(t, wsClient.WriteMessage(websocket.TextMessage, []byte(`{"id":"1","op":"set","key":"things/1","data":{"name":"one"}}`)))
+	result := reply()
+	require.Empty(t, result.Error)
+	require.Equal(t, "things/1", result.Key)
+	require.NoError(t, wsClient.WriteMessage(websocket.TextMessage, []byte(`{"id":"2","op":"set","key":"things/2","data":"e30="}`)))
+	result = reply()
+	require.Empty(t, result.Error)
+	require.NoError(t, wsClient.WriteMessage(websocket.TextMessage, []byte(`{"id":"3","op":"set","key":"things/3"}`)))
+	require.NotEmpty(t, reply().Error)
+
+	req := httptest.NewRequest("GET", "/things/1", nil)
+	req.Header.Set("Accept", messages.RawType)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	var obj struct {
+		Data json.RawMessage `json:"data"`
+	}
+	require.NoError(t, json.NewDecoder(w.Result().Body).Decode(&obj))
+	require.JSONEq(t, `{"name":"one"}`, string(obj.Data))
+
+	// batches with the raw content type use json data
+	batch := func(body string) *http.Response {
+		req := httptest.NewRequest("POST", "/_batch", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", messages.RawType)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		return w.Result()
+	}
+	resp := batch(`[{"op":"set","key":"things/4","data":{"name":"four"}},{"op":"del","key":"things/2"}]`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, http.StatusBadRequest, batch(`[{"op":"set","key":"things/5"}]`).StatusCode)
+	require.Equal(t, http.StatusBadRequest, batch(`[{"op":"set","key":"things/5","data":{"name":}}]`).StatusCode)
+
+	req = httptest.NewRequest("GET", "/things/4", nil)
+	req.Header.Set("Accept", messages.RawType)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.NoError(t, json.NewDecoder(w.Result().Body).Decode(&obj))
+	require.JSONEq(t, `{"name":"four"}`, string(obj.Data))
+}
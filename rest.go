@@ -2,10 +2,13 @@ package katamari
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/benitogf/katamari/key"
 	"github.com/benitogf/katamari/messages"
@@ -15,7 +18,7 @@ import (
 )
 
 func (app *Server) getStats(w http.ResponseWriter, r *http.Request) {
-	if r.Header.Get("Upgrade") == "websocket" {
+	if r.Header.Get("Upgrade") == "websocket" || isEventStream(r) {
 		app.clock(w, r)
 		return
 	}
@@ -25,7 +28,31 @@ func (app *Server) getStats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stats, err := app.Storage.Keys()
+	raw, err := app.storage.Keys()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	var stats Stats
+	err = json.Unmarshal(raw, &stats)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	// list only the keys the request can read
+	keys := []string{}
+	for _, _key := range stats.Keys {
+		if app.auditKey(r, _key, ActionRead) {
+			keys = append(keys, _key)
+		}
+	}
+	stats.Keys = keys
+
+	data, err := objects.Encode(stats)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "%s", err)
@@ -33,15 +60,175 @@ func (app *Server) getStats(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, string(stats))
+	w.Write(data)
 }
 
-func (app *Server) publish(w http.ResponseWriter, r *http.Request) {
-	vkey := mux.Vars(r)["key"]
+// isWritable checks that a key can be used to write, at most a glob at the end
+func isWritable(vkey string) bool {
 	count := strings.Count(vkey, "*")
 	where := strings.Index(vkey, "*")
-	event, err := messages.Decode(r.Body)
-	if !key.IsValid(vkey) || count > 1 || (count == 1 && where != len(vkey)-1) {
+	return key.IsValid(vkey) && count <= 1 && (count == 0 || where == len(vkey)-1)
+}
+
+// store data on the storage that corresponds to the key
+func (app *Server) store(_key string, data []byte) (string, error) {
+	if key.Contains(app.InMemoryKeys, _key) {
+		return app.storage.MemSet(_key, string(data))
+	}
+
+	return app.storage.Set(_key, string(data))
+}
+
+// storeIf data on the storage that corresponds to the key if the revision matches
+func (app *Server) storeIf(_key string, data []byte, revision int64) (string, error) {
+	if key.Contains(app.InMemoryKeys, _key) {
+		return app.storage.MemSetIf(_key, string(data), revision)
+	}
+
+	return app.storage.SetIf(_key, string(data), revision)
+}
+
+// precondition of a conditional write, any matches every
+// existing object and a zero revision a key that doesn't exist
+type precondition struct {
+	any      bool
+	revision int64
+	created  int64
+}
+
+// match checks the precondition against a stored object
+func (match precondition) match(obj objects.Object) bool {
+	return match.any || (obj.Revision == match.revision && obj.Created == match.created)
+}
+
+// ifMatch parses the precondition of the If-Match header of a request:
+// an etag, * for any existing value or 0 for a key that doesn't exist
+func ifMatch(r *http.Request) (precondition, bool, error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" {
+		return precondition{}, false, nil
+	}
+
+	if header == "*" {
+		return precondition{any: true}, true, nil
+	}
+
+	value := strings.Trim(header, "\"")
+	if value == "0" {
+		return precondition{}, true, nil
+	}
+
+	parts := strings.Split(value, "-")
+	if len(parts) != 2 {
+		return precondition{}, true, errors.New("katamari: invalid If-Match header")
+	}
+	revision, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || revision <= 0 {
+		return precondition{}, true, errors.New("katamari: invalid If-Match header")
+	}
+	created, err := strconv.ParseInt(parts[1], 36, 64)
+	if err != nil {
+		return precondition{}, true, errors.New("katamari: invalid If-Match header")
+	}
+
+	return precondition{revision: revision, created: created}, true, nil
+}
+
+// storeMatch data on the storage that corresponds to the key if
+// the stored object matches the precondition
+func (app *Server) storeMatch(_key string, data []byte, match precondition) (string, error) {
+	if !match.any && match.revision == 0 {
+		return app.storeIf(_key, data, 0)
+	}
+
+	index, err := app.update(_key, func(obj objects.Object) (string, error) {
+		if !match.match(obj) {
+			return "", ErrRevisionMismatch
+		}
+		return string(data), nil
+	})
+	if notFound(err) {
+		return "", ErrRevisionMismatch
+	}
+
+	return index, err
+}
+
+// notFound checks if a storage error is a missing key
+func notFound(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	switch err.Error() {
+	case "katamari: not found", "leveldb: not found", "pebble: not found":
+		return true
+	default:
+		return false
+	}
+}
+
+// update a key on the storage that corresponds to it
+func (app *Server) update(_key string, updater Updater) (string, error) {
+	if key.Contains(app.InMemoryKeys, _key) {
+		return app.storage.MemUpdate(_key, updater)
+	}
+
+	return app.storage.Update(_key, updater)
+}
+
+// storeTTL data on the storage that corresponds to the key with a time to live
+func (app *Server) storeTTL(_key string, data []byte, ttl time.Duration) (string, error) {
+	if key.Contains(app.InMemoryKeys, _key) {
+		return app.storage.MemSetTTL(_key, string(data), ttl)
+	}
+
+	return app.storage.SetTTL(_key, string(data), ttl)
+}
+
+// ttl parses the time to live of a write from the X-TTL header or the ttl
+// query parameter, as seconds or a duration (ex: 30s, 5m)
+func ttl(r *http.Request) (time.Duration, error) {
+	value := r.Header.Get("X-TTL")
+	if value == "" {
+		value = r.URL.Query().Get("ttl")
+	}
+	if value == "" {
+		return 0, nil
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, errors.New("katamari: invalid ttl")
+	}
+
+	return duration, nil
+}
+
+// remove a key from the storage that corresponds to it
+func (app *Server) remove(_key string) error {
+	if key.Contains(app.InMemoryKeys, _key) {
+		return app.storage.MemDel(_key)
+	}
+
+	return app.storage.Del(_key)
+}
+
+func (app *Server) publish(w http.ResponseWriter, r *http.Request) {
+	vkey := mux.Vars(r)["key"]
+	var event messages.Message
+	var err error
+	if messages.IsRaw(r.Header.Get("Content-Type")) {
+		event, err = messages.DecodeRaw(r.Body)
+	} else {
+		event, err = messages.Decode(r.Body)
+	}
+	if !isWritable(vkey) {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "%s", errors.New("katamari: pathKeyError key is not valid"))
 		return
@@ -59,20 +246,55 @@ func (app *Server) publish(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	match, conditional, err := ifMatch(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	expire, err := ttl(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+
+	if conditional && expire > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", errors.New("katamari: a ttl can't be combined with If-Match"))
+		return
+	}
+
 	_key := key.Build(vkey)
-	data, err := app.filters.Write.check(_key, []byte(event.Data), app.Static)
+	if !app.auditKey(r, _key, ActionWrite) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "%s", errors.New("katamari: this request is not authorized"))
+		return
+	}
+
+	data, err := app.checkWrite(_key, []byte(event.Data))
 	if err != nil {
 		app.console.Err("setError["+_key+"]", err)
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(filterStatus(err, http.StatusBadRequest))
 		fmt.Fprintf(w, "%s", err)
 		return
 	}
 
 	index := ""
-	if key.Contains(app.InMemoryKeys, _key) {
-		index, err = app.Storage.MemSet(_key, string(data))
-	} else {
-		index, err = app.Storage.Set(_key, string(data))
+	switch {
+	case conditional:
+		index, err = app.storeMatch(_key, data, match)
+	case expire > 0:
+		index, err = app.storeTTL(_key, data, expire)
+	default:
+		index, err = app.store(_key, data)
+	}
+
+	if err == ErrRevisionMismatch {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintf(w, "%s", err)
+		return
 	}
 
 	if err != nil {
@@ -82,7 +304,7 @@ func (app *Server) publish(w http.ResponseWriter, r *http.Request) {
 	}
 
 	app.console.Log("publish", _key)
-	app.filters.After.check(_key)
+	app.filters.afterChain().check(_key)
 	w.Header().Set("Content-Type", "application/json")
 	fmt.Fprintf(w, "{"+
 		"\"index\": \""+index+"\""+
@@ -98,7 +320,7 @@ func (app *Server) read(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !app.Audit(r) {
+	if !app.Audit(r) || !app.auditKey(r, _key, ActionRead) {
 		w.WriteHeader(http.StatusUnauthorized)
 		fmt.Fprintf(w, "%s", errors.New("katamari: this request is not authorized"))
 		return
@@ -109,6 +331,11 @@ func (app *Server) read(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if isEventStream(r) {
+		app.events(w, r)
+		return
+	}
+
 	app.console.Log("read", _key)
 	entry := stream.Cache{}
 	var err error
@@ -117,8 +344,11 @@ func (app *Server) read(w http.ResponseWriter, r *http.Request) {
 	} else {
 		entry, err = app.ForceFetch(_key, _key)
 	}
+	if err == nil {
+		entry.Data, err = app.filters.scopedChain().check(_key, app.Identify(r), entry.Data)
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(filterStatus(err, http.StatusBadRequest))
 		fmt.Fprintf(w, "%s", err)
 		return
 	}
@@ -128,6 +358,25 @@ func (app *Server) read(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !strings.Contains(_key, "*") {
+		obj, err := objects.Decode(entry.Data)
+		if err == nil && obj.Revision > 0 {
+			w.Header().Set("ETag", objects.ETag(obj))
+		}
+	}
+
+	if messages.IsRaw(r.Header.Get("Accept")) {
+		data, err := objects.Expand(entry.Data)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "%s", err)
+			return
+		}
+		w.Header().Set("Content-Type", messages.RawType)
+		w.Write(data)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	fmt.Fprintf(w, string(entry.Data))
 }
@@ -140,31 +389,26 @@ func (app *Server) unpublish(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !app.Audit(r) {
+	if !app.Audit(r) || !app.auditKey(r, _key, ActionDelete) {
 		w.WriteHeader(http.StatusUnauthorized)
 		fmt.Fprintf(w, "%s", errors.New("katamari: this request is not authorized"))
 		return
 	}
 
-	err := app.filters.Delete.check(_key, app.Static)
+	err := app.filters.deleteChain().check(_key, app.Static)
 	if err != nil {
 		app.console.Err("detError["+_key+"]", err)
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(filterStatus(err, http.StatusBadRequest))
 		fmt.Fprintf(w, "%s", err)
 		return
 	}
 
 	app.console.Log("unpublish", _key)
 
-	if key.Contains(app.InMemoryKeys, _key) {
-		err = app.Storage.MemDel(_key)
-	} else {
-		err = app.Storage.Del(_key)
-	}
-
+	err = app.remove(_key)
 	if err != nil {
 		app.console.Err(err.Error())
-		if err.Error() == "leveldb: not found" || err.Error() == "katamari: not found" {
+		if notFound(err) {
 			w.WriteHeader(http.StatusNotFound)
 		} else {
 			w.WriteHeader(http.StatusInternalServerError)
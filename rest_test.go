@@ -6,7 +6,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/benitogf/katamari"
 	"github.com/benitogf/katamari/storages/level"
@@ -286,3 +288,94 @@ func TestRestDeleteInvalidKey(t *testing.T) {
 
 	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
 }
+
+func TestRestIfMatch(t *testing.T) {
+	t.Parallel()
+	app := katamari.Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	_, err := app.Storage.Set("test", "test")
+	require.NoError(t, err)
+
+	get := func() string {
+		req := httptest.NewRequest("GET", "/test", nil)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		resp := w.Result()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return resp.Header.Get("ETag")
+	}
+	post := func(match string) int {
+		req := httptest.NewRequest("POST", "/test", bytes.NewBuffer([]byte(`{"data":"dGVzdA=="}`)))
+		req.Header.Set("If-Match", match)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		return w.Result().StatusCode
+	}
+
+	first := get()
+	require.True(t, strings.HasPrefix(first, `"1-`))
+	require.Equal(t, http.StatusOK, post(first))
+	require.Equal(t, http.StatusPreconditionFailed, post(first))
+	require.Equal(t, http.StatusPreconditionFailed, post("0"))
+	require.Equal(t, http.StatusBadRequest, post(`one`))
+	require.Equal(t, http.StatusBadRequest, post(`"1"`))
+	second := get()
+	require.True(t, strings.HasPrefix(second, `"2-`))
+
+	// any existing value matches *
+	require.Equal(t, http.StatusOK, post("*"))
+	require.True(t, strings.HasPrefix(get(), `"3-`))
+
+	// the etag of a deleted key doesn't match the key created again
+	require.NoError(t, app.Storage.Del("test"))
+	require.Equal(t, http.StatusPreconditionFailed, post("*"))
+	require.Equal(t, http.StatusPreconditionFailed, post(first))
+	require.Equal(t, http.StatusOK, post("0"))
+	time.Sleep(time.Millisecond)
+	require.NoError(t, app.Storage.Del("test"))
+	require.Equal(t, http.StatusOK, post("0"))
+	require.True(t, strings.HasPrefix(get(), `"1-`))
+	require.NotEqual(t, first, get())
+	require.Equal(t, http.StatusPreconditionFailed, post(first))
+}
+
+func TestRestTTL(t *testing.T) {
+	t.Parallel()
+	app := katamari.Server{}
+	app.Silence = true
+	app.ExpireInterval = 10 * time.Millisecond
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	post := func(path string, header string, value string) *http.Response {
+		req := httptest.NewRequest("POST", path, bytes.NewBuffer([]byte(`{"data":"dGVzdA=="}`)))
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	resp := post("/test?ttl=soon", "", "")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = post("/test?ttl=-1", "", "")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = post("/test?ttl=1", "If-Match", "0")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = post("/test", "X-TTL", "50ms")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = post("/other?ttl=1", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err := app.Storage.Get("test")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		_, err := app.Storage.Get("test")
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = app.Storage.Get("other")
+	require.NoError(t, err)
+}
@@ -0,0 +1,253 @@
+package katamari
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/benitogf/katamari/key"
+	"github.com/benitogf/katamari/objects"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// SchemaError a value that doesn't match the schema
+//
+// Pointer: json pointer of the value
+//
+// Message: description of the failed constraint
+type SchemaError struct {
+	Pointer string `json:"pointer"`
+	Message string `json:"message"`
+}
+
+// ValidationError of a write that doesn't match the schemas of its key,
+// responded with a 422 status
+type ValidationError struct {
+	Key    string        `json:"key"`
+	Errors []SchemaError `json:"errors"`
+}
+
+func (err *ValidationError) Error() string {
+	data, _ := json.Marshal(err)
+	return string(data)
+}
+
+// StoredSchema document of the keys that match the schemas key
+//
+// Path: key glob validated by the schema
+//
+// Schema: json schema of the values
+type StoredSchema struct {
+	Path   string          `json:"path"`
+	Schema json.RawMessage `json:"schema"`
+}
+
+type schema struct {
+	path     string
+	compiled *gojsonschema.Schema
+}
+
+// schemas added with Schema and the compiled schemas stored under
+// the schemas key, loaded and indexed by their source
+type schemas struct {
+	mutex  sync.RWMutex
+	list   []schema
+	loaded []schema
+	stored map[string]schema
+}
+
+func compileSchema(source []byte) (*gojsonschema.Schema, error) {
+	if !json.Valid(source) {
+		return nil, errors.New("katamari: invalid schema, not json")
+	}
+
+	return gojsonschema.NewSchema(gojsonschema.NewBytesLoader(source))
+}
+
+// Schema validates the writes of keys that match the path against
+// a json schema, every matching schema must pass
+func (app *Server) Schema(path string, source []byte) error {
+	if !key.IsValid(path) {
+		return errors.New("katamari: invalid schema path " + path)
+	}
+	compiled, err := compileSchema(source)
+	if err != nil {
+		return err
+	}
+
+	app.schemas.mutex.Lock()
+	defer app.schemas.mutex.Unlock()
+	app.schemas.list = append(app.schemas.list, schema{path: path, compiled: compiled})
+	return nil
+}
+
+// storedSchema decodes and compiles a schema document
+func storedSchema(data []byte) (schema, []SchemaError) {
+	var doc StoredSchema
+	err := json.Unmarshal(data, &doc)
+	if err != nil {
+		return schema{}, []SchemaError{{Pointer: "", Message: err.Error()}}
+	}
+	if !key.IsValid(doc.Path) {
+		return schema{}, []SchemaError{{Pointer: "/path", Message: "katamari: invalid schema path " + doc.Path}}
+	}
+	compiled, err := compileSchema(doc.Schema)
+	if err != nil {
+		return schema{}, []SchemaError{{Pointer: "/schema", Message: err.Error()}}
+	}
+
+	return schema{path: doc.Path, compiled: compiled}, nil
+}
+
+// loadSchemas reads the schemas stored under the schemas key, compiling
+// only the documents that changed since the last read, called on start
+// and on the storage events of the schemas key
+func (app *Server) loadSchemas() {
+	var raw []byte
+	if key.Contains(app.InMemoryKeys, app.SchemasKey) {
+		raw, _ = app.storage.MemGet(app.SchemasKey)
+	} else {
+		raw, _ = app.storage.Get(app.SchemasKey)
+	}
+	objs, err := objects.DecodeList(raw)
+	if err != nil {
+		return
+	}
+
+	app.schemas.mutex.Lock()
+	defer app.schemas.mutex.Unlock()
+	result := []schema{}
+	stored := map[string]schema{}
+	for _, obj := range objs {
+		cached, ok := app.schemas.stored[obj.Data]
+		if !ok {
+			var errs []SchemaError
+			cached, errs = storedSchema([]byte(obj.Data))
+			if errs != nil {
+				app.console.Err("schemaError["+obj.Index+"]", errs[0].Message)
+				continue
+			}
+		}
+		stored[obj.Data] = cached
+		result = append(result, cached)
+	}
+	app.schemas.stored = stored
+	app.schemas.loaded = result
+}
+
+// schemaEvent reloads the stored schemas if the event is on the schemas key
+func (app *Server) schemaEvent(ev StorageEvent) {
+	if app.SchemasKey != "" && matches(app.SchemasKey, ev.Key) {
+		app.loadSchemas()
+	}
+}
+
+// auditSchemas refuses the writes and deletes of the schemas key unless
+// AuditSchemas approves them
+func (app *Server) auditSchemas(r *http.Request, _key string, action string) bool {
+	if action == ActionRead || app.SchemasKey == "" || !matches(app.SchemasKey, _key) {
+		return true
+	}
+
+	return app.AuditSchemas != nil && app.AuditSchemas(r)
+}
+
+// matchSchemas returns the schemas of a key
+func (app *Server) matchSchemas(_key string) []schema {
+	app.schemas.mutex.RLock()
+	all := append(append([]schema{}, app.schemas.list...), app.schemas.loaded...)
+	app.schemas.mutex.RUnlock()
+
+	result := []schema{}
+	for _, s := range all {
+		if matches(s.path, _key) {
+			result = append(result, s)
+		}
+	}
+
+	return result
+}
+
+// pointer converts a validation context to a json pointer
+func pointer(context *gojsonschema.JsonContext, property string) string {
+	tokens := strings.Split(context.String("\x00"), "\x00")[1:]
+	if property != "" {
+		tokens = append(tokens, property)
+	}
+	result := ""
+	for _, token := range tokens {
+		result += "/" + strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+	}
+
+	return result
+}
+
+// validate the encoded data of a write against the schemas of the key,
+// documents written to the schemas key must be valid schemas
+func (app *Server) validate(_key string, data []byte) error {
+	if app.SchemasKey != "" && matches(app.SchemasKey, _key) {
+		decoded, err := base64.StdEncoding.DecodeString(string(data))
+		if err != nil {
+			return err
+		}
+		_, errs := storedSchema(decoded)
+		if errs != nil {
+			return &ValidationError{Key: _key, Errors: errs}
+		}
+		return nil
+	}
+
+	list := app.matchSchemas(_key)
+	if len(list) == 0 {
+		return nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return err
+	}
+	document := gojsonschema.NewBytesLoader(decoded)
+	errs := []SchemaError{}
+	for _, s := range list {
+		result, err := s.compiled.Validate(document)
+		if err != nil {
+			errs = append(errs, SchemaError{Pointer: "", Message: err.Error()})
+			continue
+		}
+		for _, failure := range result.Errors() {
+			property := ""
+			if failure.Type() == "required" {
+				property, _ = failure.Details()["property"].(string)
+			}
+			errs = append(errs, SchemaError{
+				Pointer: pointer(failure.Context(), property),
+				Message: failure.Description(),
+			})
+		}
+	}
+
+	if len(errs) > 0 {
+		return &ValidationError{Key: _key, Errors: errs}
+	}
+
+	return nil
+}
+
+// checkWrite passes the data through the write filters and validates
+// the result against the schemas of the key
+func (app *Server) checkWrite(_key string, data []byte) ([]byte, error) {
+	data, err := app.filters.writeChain().check(_key, data, app.Static)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.validate(_key, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
@@ -0,0 +1,158 @@
+package katamari
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+const bookSchema = `{
+	"type": "object",
+	"required": ["title", "pages"],
+	"properties": {
+		"title": {"type": "string"},
+		"pages": {"type": "integer", "minimum": 1},
+		"tags": {"type": "array", "items": {"type": "string"}}
+	}
+}`
+
+func publish(app *Server, path string, data string) (int, []byte) {
+	var jsonStr = []byte(`{"data":"` + messages.Encode([]byte(data)) + `"}`)
+	req := httptest.NewRequest("POST", path, bytes.NewBuffer(jsonStr))
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, body
+}
+
+func TestSchema(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	require.Error(t, app.Schema("books/*", []byte(`{"type": 1}`)))
+	require.Error(t, app.Schema("books/*", []byte(`not json`)))
+	require.NoError(t, app.Schema("books/*", []byte(bookSchema)))
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	status, _ := publish(&app, "/books/1", `{"title":"test","pages":10}`)
+	require.Equal(t, http.StatusOK, status)
+	status, _ = publish(&app, "/other/1", `{"title":1}`)
+	require.Equal(t, http.StatusOK, status)
+
+	status, body := publish(&app, "/books/2", `{"pages":0,"tags":["a",2]}`)
+	require.Equal(t, http.StatusUnprocessableEntity, status)
+	var validation ValidationError
+	require.NoError(t, json.Unmarshal(body, &validation))
+	require.Equal(t, "books/2", validation.Key)
+	pointers := []string{}
+	for _, failure := range validation.Errors {
+		pointers = append(pointers, failure.Pointer)
+		require.NotEmpty(t, failure.Message)
+	}
+	require.ElementsMatch(t, []string{"/title", "/pages", "/tags/1"}, pointers)
+
+	// websocket writes reply with the validation error
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/books/3"}
+	wsClient, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer wsClient.Close()
+	err = wsClient.WriteJSON(messages.Command{
+		ID:   "1",
+		Op:   "set",
+		Key:  "books/3",
+		Data: messages.Encode([]byte(`{"title":"test"}`)),
+	})
+	require.NoError(t, err)
+	var reply messages.Reply
+	for reply.ID != "1" {
+		require.NoError(t, wsClient.ReadJSON(&reply))
+	}
+	require.NoError(t, json.Unmarshal([]byte(reply.Error), &validation))
+	require.Equal(t, []SchemaError{{Pointer: "/pages", Message: "pages is required"}}, validation.Errors)
+	_, err = app.Storage.Get("books/3")
+	require.Error(t, err)
+}
+
+func TestStoredSchema(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.SchemasKey = "schemas/*"
+	app.AuditSchemas = func(r *http.Request) bool {
+		return r.Header.Get("Authorization") != "Bearer none"
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	status, _ := publish(&app, "/books/1", `{"title":1}`)
+	require.Equal(t, http.StatusOK, status)
+
+	status, body := publish(&app, "/schemas/books", `{"path":"books/*","schema":{"type":1}}`)
+	require.Equal(t, http.StatusUnprocessableEntity, status)
+	var validation ValidationError
+	require.NoError(t, json.Unmarshal(body, &validation))
+	require.Equal(t, "/schema", validation.Errors[0].Pointer)
+
+	status, _ = publish(&app, "/schemas/books", `{"path":"books/*","schema":`+bookSchema+`}`)
+	require.Equal(t, http.StatusOK, status)
+
+	// the schemas are loaded from the storage events
+	require.Eventually(t, func() bool {
+		status, body = publish(&app, "/books/2", `{"title":1,"pages":1}`)
+		return status == http.StatusUnprocessableEntity
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, json.Unmarshal(body, &validation))
+	require.Equal(t, "/title", validation.Errors[0].Pointer)
+	status, _ = publish(&app, "/books/2", `{"title":"test","pages":1}`)
+	require.Equal(t, http.StatusOK, status)
+
+	// removing the stored schema removes the validation
+	req := httptest.NewRequest("DELETE", "/schemas/books", nil)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+	require.Eventually(t, func() bool {
+		status, _ = publish(&app, "/books/2", `{"title":1}`)
+		return status == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+
+	// the schemas key requires the approval of AuditSchemas
+	req = httptest.NewRequest("POST", "/schemas/books", bytes.NewBufferString(`{"data":"`+messages.Encode([]byte(`{"path":"books/*","schema":{}}`))+`"}`))
+	req.Header.Set("Authorization", "Bearer none")
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+	_, err := app.Storage.Set("schemas/books", messages.Encode([]byte(`{"path":"books/*","schema":{}}`)))
+	require.NoError(t, err)
+	req = httptest.NewRequest("DELETE", "/schemas/books", nil)
+	req.Header.Set("Authorization", "Bearer none")
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+}
+
+func TestStoredSchemaRefused(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.SchemasKey = "schemas/*"
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	status, _ := publish(&app, "/schemas/books", `{"path":"books/*","schema":`+bookSchema+`}`)
+	require.Equal(t, http.StatusUnauthorized, status)
+	status, _ = publish(&app, "/books/1", `{"title":1}`)
+	require.Equal(t, http.StatusOK, status)
+}
@@ -0,0 +1,36 @@
+package katamari
+
+import (
+	"context"
+	"time"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/stream"
+)
+
+// checkSessions closes the connections which session ended until the server closes
+func (app *Server) checkSessions() {
+	ticker := time.NewTicker(app.SessionInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !app.Active() {
+			return
+		}
+
+		app.Stream.CheckSessions()
+	}
+}
+
+// renew the session of a websocket connection with the token of the command,
+// the request that opened the connection is kept with the new credentials
+func (app *Server) renew(client *stream.Conn, command messages.Command) {
+	reply := messages.Reply{ID: command.ID, Key: command.Key}
+	r := client.Request().Clone(context.Background())
+	r.Header.Del("Sec-WebSocket-Protocol")
+	r.Header.Set("Authorization", "Bearer "+command.Data)
+	err := app.Stream.Renew(client, r)
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	app.Stream.WriteReply(client, reply)
+}
@@ -0,0 +1,216 @@
+package katamari
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/stream"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+type testSession struct {
+	account string
+	expires time.Time
+}
+
+func TestSession(t *testing.T) {
+	t.Parallel()
+	var mutex sync.Mutex
+	sessions := map[string]testSession{
+		"short": {"alice", time.Now().Add(200 * time.Millisecond)},
+		"long":  {"alice", time.Now().Add(time.Minute)},
+		"mux":   {"bob", time.Now().Add(time.Minute)},
+	}
+	app := Server{}
+	app.Silence = true
+	app.SessionInterval = 20 * time.Millisecond
+	app.Session = func(r *http.Request) (string, time.Time, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		session, ok := sessions[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+		if !ok {
+			return "", time.Time{}, errors.New("invalid token")
+		}
+		return session.account, session.expires, nil
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	dial := func(path string, token string) *websocket.Conn {
+		u := url.URL{Scheme: "ws", Host: app.Address, Path: path}
+		c, _, err := websocket.DefaultDialer.Dial(u.String(), http.Header{"Authorization": []string{"Bearer " + token}})
+		require.NoError(t, err)
+		return c
+	}
+	closeCode := func(c *websocket.Conn) int {
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			_, _, err := c.ReadMessage()
+			if err != nil {
+				closeErr, ok := err.(*websocket.CloseError)
+				require.True(t, ok, err.Error())
+				return closeErr.Code
+			}
+		}
+	}
+
+	// expired
+	expiring := dial("/test", "short")
+	defer expiring.Close()
+	require.Equal(t, stream.CloseExpired, closeCode(expiring))
+
+	// revoked, multiplexed connections don't need to join a pool
+	multiplexed := dial("/_mux", "mux")
+	defer multiplexed.Close()
+	time.Sleep(50 * time.Millisecond)
+	mutex.Lock()
+	delete(sessions, "mux")
+	mutex.Unlock()
+	require.Equal(t, stream.CloseRevoked, closeCode(multiplexed))
+
+	// renewed
+	mutex.Lock()
+	sessions["short"] = testSession{"alice", time.Now().Add(300 * time.Millisecond)}
+	sessions["other"] = testSession{"bob", time.Now().Add(time.Minute)}
+	mutex.Unlock()
+	renewed := dial("/test", "short")
+	defer renewed.Close()
+	_, _, err := renewed.ReadMessage()
+	require.NoError(t, err)
+	reply := messages.Reply{}
+	require.NoError(t, renewed.WriteJSON(messages.Command{ID: "1", Op: "auth", Data: "other"}))
+	require.NoError(t, renewed.ReadJSON(&reply))
+	require.Equal(t, "1", reply.ID)
+	require.Contains(t, reply.Error, "identity")
+	require.NoError(t, renewed.WriteJSON(messages.Command{ID: "2", Op: "auth", Data: "invalid"}))
+	require.NoError(t, renewed.ReadJSON(&reply))
+	require.Equal(t, "invalid token", reply.Error)
+	require.NoError(t, renewed.WriteJSON(messages.Command{ID: "3", Op: "auth", Data: "long"}))
+	reply = messages.Reply{}
+	require.NoError(t, renewed.ReadJSON(&reply))
+	require.Equal(t, "3", reply.ID)
+	require.Empty(t, reply.Error)
+	time.Sleep(400 * time.Millisecond)
+	require.NoError(t, renewed.WriteJSON(messages.Command{ID: "4", Op: "set", Key: "renewed", Data: messages.Encode([]byte("renewed"))}))
+	reply = messages.Reply{}
+	require.NoError(t, renewed.ReadJSON(&reply))
+	require.Equal(t, "4", reply.ID)
+	require.Empty(t, reply.Error)
+	mutex.Lock()
+	delete(sessions, "long")
+	mutex.Unlock()
+	require.Equal(t, stream.CloseRevoked, closeCode(renewed))
+}
+
+func TestSessionTimer(t *testing.T) {
+	t.Parallel()
+	var mutex sync.Mutex
+	checks := 0
+	app := Server{}
+	app.Silence = true
+	app.SessionInterval = time.Hour
+	expires := time.Now().Add(200 * time.Millisecond)
+	app.Session = func(r *http.Request) (string, time.Time, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		checks++
+		switch r.Header.Get("Authorization") {
+		case "":
+			return "", time.Time{}, nil
+		case "Bearer short":
+			return "alice", expires, nil
+		}
+		return "", time.Time{}, errors.New("invalid token")
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	dial := func(token string) *websocket.Conn {
+		header := http.Header{}
+		if token != "" {
+			header.Set("Authorization", "Bearer "+token)
+		}
+		u := url.URL{Scheme: "ws", Host: app.Address, Path: "/test"}
+		c, _, err := websocket.DefaultDialer.Dial(u.String(), header)
+		require.NoError(t, err)
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		return c
+	}
+	closeCode := func(c *websocket.Conn) int {
+		for {
+			_, _, err := c.ReadMessage()
+			if err != nil {
+				closeErr, ok := err.(*websocket.CloseError)
+				require.True(t, ok, err.Error())
+				return closeErr.Code
+			}
+		}
+	}
+
+	// credentials that are not valid when the connection opens
+	invalid := dial("invalid")
+	defer invalid.Close()
+	require.Equal(t, stream.CloseRevoked, closeCode(invalid))
+
+	// anonymous connections stay open
+	anonymous := dial("")
+	defer anonymous.Close()
+	_, _, err := anonymous.ReadMessage()
+	require.NoError(t, err)
+
+	// expired by the timer of the connection without polling the session
+	expiring := dial("short")
+	defer expiring.Close()
+	require.Equal(t, stream.CloseExpired, closeCode(expiring))
+	mutex.Lock()
+	require.Equal(t, 3, checks)
+	mutex.Unlock()
+	anonymous.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err = anonymous.ReadMessage()
+	netErr, ok := err.(net.Error)
+	require.True(t, ok)
+	require.True(t, netErr.Timeout())
+}
+
+func TestSessionInvalid(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.Session = func(r *http.Request) (string, time.Time, error) {
+		return "", time.Time{}, errors.New("invalid token")
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	// closed before joining a pool or sending the snapshot
+	for _, path := range []string{"/test", "/_mux"} {
+		u := url.URL{Scheme: "ws", Host: app.Address, Path: path}
+		c, _, err := websocket.DefaultDialer.Dial(u.String(), http.Header{"Authorization": []string{"Bearer invalid"}})
+		require.NoError(t, err)
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, _, err = c.ReadMessage()
+		closeErr, ok := err.(*websocket.CloseError)
+		require.True(t, ok)
+		require.Equal(t, stream.CloseRevoked, closeErr.Code)
+	}
+
+	req, err := http.NewRequest("GET", "http://"+app.Address+"/test", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", stream.EventStreamType)
+	req.Header.Set("Authorization", "Bearer invalid")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Equal(t, 0, app.Stream.Connections()["test"])
+}
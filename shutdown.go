@@ -0,0 +1,180 @@
+package katamari
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// ShutdownReport of what was dropped by a server shutdown
+//
+// Connections: websocket and event stream connections closed
+//
+// Broadcasts: broadcasts still running when the deadline expired
+//
+// Events: storage events received after the broadcasts stopped
+//
+// Forced: the deadline expired with requests still running
+type ShutdownReport struct {
+	Connections int
+	Broadcasts  int64
+	Events      int64
+	Forced      bool
+}
+
+// Report callback of a shutdown
+type Report func(report ShutdownReport)
+
+// String summary of the report
+func (report ShutdownReport) String() string {
+	return "connections[" + strconv.Itoa(report.Connections) +
+		"] broadcasts[" + strconv.FormatInt(report.Broadcasts, 10) +
+		"] events[" + strconv.FormatInt(report.Events, 10) +
+		"] forced[" + strconv.FormatBool(report.Forced) + "]"
+}
+
+// broadcasts in flight, new broadcasts are dropped once draining
+type broadcasts struct {
+	mutex    sync.Mutex
+	wg       sync.WaitGroup
+	draining bool
+	pending  int64
+	dropped  int64
+}
+
+// dispatch a broadcast of the key unless the server is shutting down
+func (b *broadcasts) dispatch(broadcast func(string), key string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.draining {
+		atomic.AddInt64(&b.dropped, 1)
+		return
+	}
+	b.wg.Add(1)
+	atomic.AddInt64(&b.pending, 1)
+	go func() {
+		defer b.wg.Done()
+		defer atomic.AddInt64(&b.pending, -1)
+		broadcast(key)
+	}()
+}
+
+// reset the state after a shutdown
+func (b *broadcasts) reset() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.draining = false
+	atomic.StoreInt64(&b.dropped, 0)
+}
+
+// drain stops new broadcasts and waits for the pending ones until the
+// context is done, returns the number of broadcasts that didn't finish
+func (b *broadcasts) drain(ctx context.Context) int64 {
+	b.mutex.Lock()
+	b.draining = true
+	b.mutex.Unlock()
+	if wait(ctx, &b.wg) {
+		return 0
+	}
+
+	return atomic.LoadInt64(&b.pending)
+}
+
+// commands of the websocket connections in flight, new
+// commands are rejected once draining
+type commands struct {
+	mutex    sync.Mutex
+	wg       sync.WaitGroup
+	draining bool
+}
+
+// start a command unless the server is shutting down
+func (c *commands) start() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.draining {
+		return false
+	}
+	c.wg.Add(1)
+	return true
+}
+
+// done marks a started command as finished
+func (c *commands) done() {
+	c.wg.Done()
+}
+
+// reset the state after a shutdown
+func (c *commands) reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.draining = false
+}
+
+// drain stops new commands and waits for the pending ones until the
+// context is done, returns false if the context expired first
+func (c *commands) drain(ctx context.Context) bool {
+	c.mutex.Lock()
+	c.draining = true
+	c.mutex.Unlock()
+	return wait(ctx, &c.wg)
+}
+
+// wait for a wait group until the context is done,
+// returns false if the context expired first
+func wait(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// shutdown in order: stop accepting requests, flush the pending broadcasts,
+// close the subscriptions with a close frame, wait for the requests and the
+// websocket commands, stop the workers and close the storage
+func (app *Server) shutdown(sig os.Signal) ShutdownReport {
+	report := ShutdownReport{}
+	ctx, cancel := context.WithTimeout(context.Background(), app.ShutdownTimeout)
+	defer cancel()
+
+	requests := make(chan error, 1)
+	if app.server != nil {
+		go func() {
+			requests <- app.server.Shutdown(ctx)
+		}()
+	} else {
+		requests <- nil
+	}
+
+	report.Broadcasts = app.broadcasts.drain(ctx)
+	report.Connections = app.Stream.Shutdown("katamari: server shutdown")
+	err := <-requests
+	if err != nil {
+		report.Forced = true
+		app.server.Close()
+	}
+
+	// hijacked connections are not tracked by the http server
+	if !app.commands.drain(ctx) {
+		report.Forced = true
+	}
+
+	// the workers drop the remaining events and exit once the storage closes the channels
+	app.Storage.Close()
+	if !wait(ctx, &app.workers) {
+		app.console.Err("shutdown workers timeout")
+	}
+	report.Events = atomic.LoadInt64(&app.broadcasts.dropped)
+	app.console.Err("shutdown", sig, report)
+	return report
+}
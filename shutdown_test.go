@@ -0,0 +1,131 @@
+package katamari
+
+import (
+	"bufio"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdown(t *testing.T) {
+	t.Parallel()
+	reports := make(chan ShutdownReport, 1)
+	app := Server{}
+	app.Silence = true
+	app.OnClose = func(report ShutdownReport) {
+		reports <- report
+	}
+	app.Start("localhost:0")
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/test"}
+	wsClient, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer wsClient.Close()
+	_, _, err = wsClient.ReadMessage()
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("GET", "http://"+app.Address+"/test", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	events := bufio.NewReader(resp.Body)
+	_, err = events.ReadString('\n')
+	require.NoError(t, err)
+
+	// multiplexed connections without subscriptions are closed too
+	u = url.URL{Scheme: "ws", Host: app.Address, Path: "/_mux"}
+	multiplexed, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer multiplexed.Close()
+	require.NoError(t, multiplexed.WriteJSON(messages.Command{Op: "unknown"}))
+	_, _, err = multiplexed.ReadMessage()
+	require.NoError(t, err)
+
+	app.Close(os.Interrupt)
+	report := <-reports
+	require.Equal(t, 3, report.Connections)
+	require.Equal(t, int64(0), report.Broadcasts)
+	require.False(t, report.Forced)
+
+	_, _, err = wsClient.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	require.True(t, ok)
+	require.Equal(t, websocket.CloseGoingAway, closeErr.Code)
+	require.Equal(t, "katamari: server shutdown", closeErr.Text)
+	_, _, err = multiplexed.ReadMessage()
+	closeErr, ok = err.(*websocket.CloseError)
+	require.True(t, ok)
+	require.Equal(t, websocket.CloseGoingAway, closeErr.Code)
+	require.False(t, app.Storage.Active())
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	t.Parallel()
+	reports := make(chan ShutdownReport, 1)
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	app := Server{}
+	app.Silence = true
+	app.ShutdownTimeout = 50 * time.Millisecond
+	app.OnClose = func(report ShutdownReport) {
+		reports <- report
+	}
+	app.Router = mux.NewRouter()
+	app.Router.HandleFunc("/_slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	app.Start("localhost:0")
+
+	go http.Get("http://" + app.Address + "/_slow")
+	<-started
+	app.Close(os.Interrupt)
+	report := <-reports
+	require.True(t, report.Forced)
+}
+
+func TestShutdownCommands(t *testing.T) {
+	t.Parallel()
+	reports := make(chan ShutdownReport, 1)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	app := Server{}
+	app.Silence = true
+	app.OnClose = func(report ShutdownReport) {
+		reports <- report
+	}
+	app.WriteFilter("slow", func(key string, data []byte) ([]byte, error) {
+		close(started)
+		<-release
+		return data, nil
+	})
+	app.Start("localhost:0")
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/test"}
+	wsClient, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer wsClient.Close()
+	_, _, err = wsClient.ReadMessage()
+	require.NoError(t, err)
+	require.NoError(t, wsClient.WriteJSON(messages.Command{Op: "set", Key: "slow", Data: messages.Encode([]byte(`{}`))}))
+	<-started
+
+	// the storage stays open until the command is done
+	go app.Close(os.Interrupt)
+	time.Sleep(50 * time.Millisecond)
+	require.True(t, app.Storage.Active())
+	close(release)
+	report := <-reports
+	require.False(t, report.Forced)
+	require.False(t, app.Storage.Active())
+}
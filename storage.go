@@ -1,9 +1,18 @@
 package katamari
 
 import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benitogf/katamari/key"
 	"github.com/benitogf/katamari/objects"
 )
 
+// ErrRevisionMismatch returned by SetIf when the stored revision doesn't match
+var ErrRevisionMismatch = errors.New("katamari: revision mismatch")
+
 // StorageChan an operation events channel
 type StorageChan chan StorageEvent
 
@@ -13,10 +22,35 @@ type StorageEvent struct {
 	Operation string
 }
 
+// BatchOperation a set or del operation of a batch
+type BatchOperation struct {
+	Op   string
+	Key  string
+	Data string
+}
+
+// BatchWrite a resolved write of a batch, a nil value deletes the key
+type BatchWrite struct {
+	Key   string
+	Value []byte
+}
+
+// Updater receives the stored object of a key and returns the data to store
+type Updater func(obj objects.Object) (string, error)
+
 // StorageOpt options of the storage instance
+//
+// ExpireInterval: time interval between sweeps of the expired keys
 type StorageOpt struct {
 	NoBroadcastKeys []string
 	DbOpt           interface{}
+	ExpireInterval  time.Duration
+}
+
+// Expirations index of the keys with a time to live
+type Expirations struct {
+	mutex sync.Mutex
+	keys  map[string]int64
 }
 
 // Database interface to be implemented by storages
@@ -37,11 +71,19 @@ type StorageOpt struct {
 //
 // Set(key, data): store data under the provided key, key cannot not include glob pattern
 //
+// SetTTL(key, data, ttl): store data under the provided key, the key will expire after the ttl
+//
+// SetIf(key, data, revision): store data only if the stored revision of the key matches (0 if the key doesn't exist)
+//
+// Update(key, updater): store the data returned by the updater, it's called with the current object of an existing key while holding the write lock
+//
 // Del(key): Delete a key from the storage
 //
+// Batch(operations): apply a list of set/del operations atomically, keys cannot include glob patterns
+//
 // Clear: will clear all keys from the storage (used for testing)
 //
-// Watch: returns a channel that will receive any set or del operation
+// Watch: returns a channel that will receive any set, del or expire operation
 type Database interface {
 	Active() bool
 	Start(StorageOpt) error
@@ -56,9 +98,17 @@ type Database interface {
 	GetObjList(path string) ([]objects.Object, error)
 	Set(key string, data string) (string, error)
 	MemSet(key string, data string) (string, error)
+	SetTTL(key string, data string, ttl time.Duration) (string, error)
+	MemSetTTL(key string, data string, ttl time.Duration) (string, error)
+	SetIf(key string, data string, revision int64) (string, error)
+	MemSetIf(key string, data string, revision int64) (string, error)
+	Update(key string, updater Updater) (string, error)
+	MemUpdate(key string, updater Updater) (string, error)
 	Pivot(key string, data string, created, updated int64) (string, error)
 	Del(key string) error
 	MemDel(key string) error
+	Batch(operations []BatchOperation) ([]string, error)
+	MemBatch(operations []BatchOperation) ([]string, error)
 	Clear()
 	Watch() StorageChan
 	MemWatch() StorageChan
@@ -75,6 +125,146 @@ type Stats struct {
 	Keys []string `json:"keys"`
 }
 
+// Set the expiration time of a key, 0 will remove the key from the index
+func (e *Expirations) Set(key string, expires int64) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.keys == nil {
+		e.keys = map[string]int64{}
+	}
+	if expires == 0 {
+		delete(e.keys, key)
+		return
+	}
+	e.keys[key] = expires
+}
+
+// Del a key or glob pattern from the index
+func (e *Expirations) Del(path string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for k := range e.keys {
+		if k == path || key.Match(path, k) {
+			delete(e.keys, k)
+		}
+	}
+}
+
+// Clear the index
+func (e *Expirations) Clear() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.keys = map[string]int64{}
+}
+
+// Expired list the keys that expire before or at the provided time
+func (e *Expirations) Expired(now int64) []string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	expired := []string{}
+	for k, expires := range e.keys {
+		if expires <= now {
+			expired = append(expired, k)
+		}
+	}
+
+	return expired
+}
+
+// Expires returns the expiration time for a ttl, 0 if the ttl is not positive
+func Expires(now int64, ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+
+	return now + ttl.Nanoseconds()
+}
+
+// Expired checks if a stored value passed its expiration time, an expired
+// value isn't readable even if the sweep didn't delete it yet
+func Expired(expires int64, now int64) bool {
+	return expires != 0 && expires <= now
+}
+
+// Sweep will call expire on every interval until the stop channel is closed,
+// the done channel is closed when the sweep finishes
+func Sweep(interval time.Duration, stop chan struct{}, done chan struct{}, expire func()) {
+	if interval <= 0 {
+		interval = 1 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer close(done)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			expire()
+		}
+	}
+}
+
+// PlanBatch validates a list of operations and resolves the values to write,
+// get should return the stored value of a key or nil if it doesn't exist,
+// returns the writes in order and the index of every operation
+func PlanBatch(operations []BatchOperation, get func(key string) []byte) ([]BatchWrite, []string, error) {
+	if len(operations) == 0 {
+		return nil, nil, errors.New("katamari: empty batch")
+	}
+
+	now := time.Now().UTC().UnixNano()
+	writes := []BatchWrite{}
+	indexes := []string{}
+	pending := map[string][]byte{}
+	current := func(_key string) []byte {
+		value, found := pending[_key]
+		if found {
+			return value
+		}
+		return get(_key)
+	}
+	for _, operation := range operations {
+		if !key.IsValid(operation.Key) || strings.Contains(operation.Key, "*") {
+			return nil, nil, errors.New("katamari: pathKeyError key is not valid")
+		}
+
+		switch operation.Op {
+		case "set":
+			created, updated, revision := now, int64(0), int64(0)
+			previous := current(operation.Key)
+			if previous != nil {
+				oldObject, err := objects.Decode(previous)
+				if err == nil {
+					created, updated, revision = oldObject.Created, now, oldObject.Revision
+				}
+			}
+			index := key.LastIndex(operation.Key)
+			value := objects.New(&objects.Object{
+				Created:  created,
+				Updated:  updated,
+				Revision: revision + 1,
+				Index:    index,
+				Data:     operation.Data,
+			})
+			pending[operation.Key] = value
+			writes = append(writes, BatchWrite{Key: operation.Key, Value: value})
+			indexes = append(indexes, index)
+		case "del":
+			if current(operation.Key) == nil {
+				return nil, nil, errors.New("katamari: not found")
+			}
+			pending[operation.Key] = nil
+			writes = append(writes, BatchWrite{Key: operation.Key})
+			indexes = append(indexes, "")
+		default:
+			return nil, nil, errors.New("katamari: unknown operation " + operation.Op)
+		}
+	}
+
+	return writes, indexes, nil
+}
+
 // WatchStorageNoop a noop reader of the watch channel
 func WatchStorageNoop(dataStore Database) {
 	for {
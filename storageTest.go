@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -42,6 +43,254 @@ func StorageObjectTest(app *Server, t *testing.T) {
 	require.Empty(t, dataDel)
 }
 
+// StorageSetIfTest testing storage function
+func StorageSetIfTest(app *Server, t *testing.T) {
+	app.Storage.Clear()
+	_, err := app.Storage.SetIf("test", "test", 1)
+	require.Equal(t, ErrRevisionMismatch, err)
+	index, err := app.Storage.SetIf("test", "test", 0)
+	require.NoError(t, err)
+	require.Equal(t, "test", index)
+	data, err := app.Storage.Get("test")
+	require.NoError(t, err)
+	testObject, err := objects.Decode(data)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), testObject.Revision)
+	_, err = app.Storage.Set("test", "test_update")
+	require.NoError(t, err)
+	_, err = app.Storage.SetIf("test", "test_conflict", 1)
+	require.Equal(t, ErrRevisionMismatch, err)
+	_, err = app.Storage.SetIf("test", "test_match", 2)
+	require.NoError(t, err)
+	data, err = app.Storage.Get("test")
+	require.NoError(t, err)
+	testObject, err = objects.Decode(data)
+	require.NoError(t, err)
+	require.Equal(t, "test_match", testObject.Data)
+	require.Equal(t, int64(3), testObject.Revision)
+	err = app.Storage.Del("test")
+	require.NoError(t, err)
+	_, err = app.Storage.SetIf("test", "test", 3)
+	require.Equal(t, ErrRevisionMismatch, err)
+
+	_, err = app.Storage.MemSetIf("mem", "mem", 0)
+	require.NoError(t, err)
+	_, err = app.Storage.MemSetIf("mem", "mem", 0)
+	require.Equal(t, ErrRevisionMismatch, err)
+	data, err = app.Storage.MemGet("mem")
+	require.NoError(t, err)
+	testObject, err = objects.Decode(data)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), testObject.Revision)
+	err = app.Storage.MemDel("mem")
+	require.NoError(t, err)
+}
+
+// StorageBatchTest testing storage function
+func StorageBatchTest(app *Server, t *testing.T) {
+	app.Storage.Clear()
+	_, err := app.Storage.Set("stock/1", "10")
+	require.NoError(t, err)
+	indexes, err := app.Storage.Batch([]BatchOperation{
+		{Op: "set", Key: "orders/1", Data: "order"},
+		{Op: "set", Key: "stock/1", Data: "9"},
+		{Op: "del", Key: "missing"},
+	})
+	require.Error(t, err)
+	require.Nil(t, indexes)
+	_, err = app.Storage.Get("orders/1")
+	require.Error(t, err)
+
+	indexes, err = app.Storage.Batch([]BatchOperation{
+		{Op: "set", Key: "orders/1", Data: "order"},
+		{Op: "set", Key: "stock/1", Data: "9"},
+		{Op: "set", Key: "stock/1", Data: "8"},
+		{Op: "set", Key: "tmp", Data: "tmp"},
+		{Op: "del", Key: "tmp"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "1", "1", "tmp", ""}, indexes)
+	data, err := app.Storage.Get("stock/1")
+	require.NoError(t, err)
+	testObject, err := objects.Decode(data)
+	require.NoError(t, err)
+	require.Equal(t, "8", testObject.Data)
+	require.Equal(t, int64(3), testObject.Revision)
+	require.NotEqual(t, int64(0), testObject.Updated)
+	data, err = app.Storage.Get("orders/1")
+	require.NoError(t, err)
+	testObject, err = objects.Decode(data)
+	require.NoError(t, err)
+	require.Equal(t, "order", testObject.Data)
+	_, err = app.Storage.Get("tmp")
+	require.Error(t, err)
+
+	_, err = app.Storage.Batch([]BatchOperation{{Op: "set", Key: "orders/*", Data: "order"}})
+	require.Error(t, err)
+	_, err = app.Storage.Batch([]BatchOperation{})
+	require.Error(t, err)
+
+	indexes, err = app.Storage.MemBatch([]BatchOperation{
+		{Op: "set", Key: "mem/1", Data: base64.StdEncoding.EncodeToString([]byte("one"))},
+		{Op: "set", Key: "mem/2", Data: base64.StdEncoding.EncodeToString([]byte("two"))},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "2"}, indexes)
+	objs, err := app.Storage.MemGetN("mem/*", 10)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(objs))
+	err = app.Storage.MemDel("mem/*")
+	require.NoError(t, err)
+}
+
+// StorageUpdateTest testing storage function
+func StorageUpdateTest(app *Server, t *testing.T) {
+	app.Storage.Clear()
+	_, err := app.Storage.Update("test", func(obj objects.Object) (string, error) {
+		return "test", nil
+	})
+	require.Error(t, err)
+	_, err = app.Storage.Set("test", "test")
+	require.NoError(t, err)
+	_, err = app.Storage.Update("test", func(obj objects.Object) (string, error) {
+		return "", errors.New("update failed")
+	})
+	require.Error(t, err)
+	_, err = app.Storage.Update("test/*", func(obj objects.Object) (string, error) {
+		return "test", nil
+	})
+	require.Error(t, err)
+	index, err := app.Storage.Update("test", func(obj objects.Object) (string, error) {
+		require.Equal(t, "test", obj.Data)
+		require.Equal(t, int64(1), obj.Revision)
+		return obj.Data + "_update", nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "test", index)
+	data, err := app.Storage.Get("test")
+	require.NoError(t, err)
+	testObject, err := objects.Decode(data)
+	require.NoError(t, err)
+	require.Equal(t, "test_update", testObject.Data)
+	require.Equal(t, int64(2), testObject.Revision)
+	require.NotEqual(t, int64(0), testObject.Updated)
+
+	_, err = app.Storage.MemSet("mem", "mem")
+	require.NoError(t, err)
+	_, err = app.Storage.MemUpdate("mem", func(obj objects.Object) (string, error) {
+		return obj.Data + "_update", nil
+	})
+	require.NoError(t, err)
+	data, err = app.Storage.MemGet("mem")
+	require.NoError(t, err)
+	testObject, err = objects.Decode(data)
+	require.NoError(t, err)
+	require.Equal(t, "mem_update", testObject.Data)
+	err = app.Storage.MemDel("mem")
+	require.NoError(t, err)
+}
+
+// StorageTTLTest testing storage function
+func StorageTTLTest(app *Server, t *testing.T) {
+	app.Storage.Clear()
+	_, err := app.Storage.SetTTL("test", "test", 0)
+	require.Error(t, err)
+	_, err = app.Storage.SetTTL("test", "test", 100*time.Millisecond)
+	require.NoError(t, err)
+	_, err = app.Storage.SetTTL("renewed", "renewed", 100*time.Millisecond)
+	require.NoError(t, err)
+	_, err = app.Storage.Set("renewed", "renewed")
+	require.NoError(t, err)
+	_, err = app.Storage.MemSetTTL("mem", "mem", 100*time.Millisecond)
+	require.NoError(t, err)
+	data, err := app.Storage.Get("test")
+	require.NoError(t, err)
+	testObject, err := objects.Decode(data)
+	require.NoError(t, err)
+	require.NotEqual(t, int64(0), testObject.Expires)
+
+	require.Eventually(t, func() bool {
+		_, err := app.Storage.Get("test")
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		_, err := app.Storage.MemGet("mem")
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	data, err = app.Storage.Get("renewed")
+	require.NoError(t, err)
+	testObject, err = objects.Decode(data)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), testObject.Expires)
+	err = app.Storage.Del("renewed")
+	require.NoError(t, err)
+}
+
+// StorageExpiredTest testing storage function, the expired keys
+// shouldn't be readable or writable before the sweep deletes them
+func StorageExpiredTest(app *Server, t *testing.T) {
+	app.Storage.Clear()
+	_, err := app.Storage.SetTTL("expired/1", "test", 10*time.Millisecond)
+	require.NoError(t, err)
+	_, err = app.Storage.Set("expired/2", "test")
+	require.NoError(t, err)
+	_, err = app.Storage.MemSetTTL("mem", "mem", 10*time.Millisecond)
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+
+	_, err = app.Storage.Get("expired/1")
+	require.Error(t, err)
+	_, err = app.Storage.MemGet("mem")
+	require.Error(t, err)
+	data, err := app.Storage.Get("expired/*")
+	require.NoError(t, err)
+	list, err := objects.DecodeList(data)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(list))
+	require.Equal(t, "2", list[0].Index)
+	objs, err := app.Storage.GetN("expired/*", 10)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(objs))
+	keys := func() []string {
+		var stats Stats
+		data, err := app.Storage.Keys()
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(data, &stats))
+		return stats.Keys
+	}
+	require.Equal(t, []string{"expired/2"}, keys())
+
+	updater := func(obj objects.Object) (string, error) {
+		return "updated", nil
+	}
+	_, err = app.Storage.Update("expired/1", updater)
+	require.Error(t, err)
+	_, err = app.Storage.MemUpdate("mem", updater)
+	require.Error(t, err)
+	err = app.Storage.Del("expired/1")
+	require.Error(t, err)
+	err = app.Storage.MemDel("mem")
+	require.Error(t, err)
+	_, err = app.Storage.SetIf("expired/1", "test", 0)
+	require.NoError(t, err)
+	_, err = app.Storage.MemSetIf("mem", "mem", 0)
+	require.NoError(t, err)
+	data, err = app.Storage.Get("expired/1")
+	require.NoError(t, err)
+	obj, err := objects.Decode(data)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), obj.Revision)
+	require.Equal(t, int64(0), obj.Expires)
+	data, err = app.Storage.MemGet("mem")
+	require.NoError(t, err)
+	obj, err = objects.Decode(data)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), obj.Revision)
+
+	app.Storage.Clear()
+	require.Equal(t, []string{}, keys())
+}
+
 // StorageListTest testing storage function
 func StorageListTest(app *Server, t *testing.T, testData string) {
 	app.Storage.Clear()
@@ -20,11 +20,16 @@ type Storage struct {
 	Path            string
 	mem             sync.Map
 	noBroadcastKeys []string
+	writeMutex      sync.Mutex
 	client          *leveldb.DB
 	mutex           sync.RWMutex
 	watcher         katamari.StorageChan
 	memWatcher      katamari.StorageChan
 	storage         *katamari.Storage
+	expirations     katamari.Expirations
+	memExpirations  katamari.Expirations
+	stop            chan struct{}
+	done            chan struct{}
 }
 
 // Active provides access to the status of the storage client
@@ -62,6 +67,10 @@ func (db *Storage) Start(storageOpt katamari.StorageOpt) error {
 	}
 	if err == nil {
 		db.storage.Active = true
+		db.index()
+		db.stop = make(chan struct{})
+		db.done = make(chan struct{})
+		go katamari.Sweep(storageOpt.ExpireInterval, db.stop, db.done, db.expire)
 	}
 	db.noBroadcastKeys = storageOpt.NoBroadcastKeys
 	return err
@@ -69,6 +78,11 @@ func (db *Storage) Start(storageOpt katamari.StorageOpt) error {
 
 // Close the storage client
 func (db *Storage) Close() {
+	if db.stop != nil {
+		close(db.stop)
+		<-db.done
+		db.stop = nil
+	}
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 	db.storage.Active = false
@@ -81,21 +95,30 @@ func (db *Storage) Close() {
 
 // Clear all keys in the storage
 func (db *Storage) Clear() {
+	db.expirations.Clear()
+	db.memExpirations.Clear()
 	iter := db.client.NewIterator(nil, nil)
 	for iter.Next() {
 		_ = db.client.Delete(iter.Key(), nil)
 	}
 	iter.Release()
+	db.mem.Range(func(key interface{}, value interface{}) bool {
+		db.mem.Delete(key)
+		return true
+	})
 }
 
 // Keys list all the keys in the storage
 func (db *Storage) Keys() ([]byte, error) {
+	now := time.Now().UTC().UnixNano()
 	iter := db.client.NewIterator(nil, &opt.ReadOptions{
 		DontFillCache: true,
 	})
 	stats := katamari.Stats{}
 	for iter.Next() {
-		stats.Keys = append(stats.Keys, string(iter.Key()))
+		if !katamari.Expired(expires(iter.Value()), now) {
+			stats.Keys = append(stats.Keys, string(iter.Key()))
+		}
 	}
 	iter.Release()
 	err := iter.Error()
@@ -112,6 +135,7 @@ func (db *Storage) Keys() ([]byte, error) {
 
 // KeysRange list keys in a path and time range
 func (db *Storage) KeysRange(path string, from, to int64) ([]string, error) {
+	now := time.Now().UTC().UnixNano()
 	keys := []string{}
 	if !strings.Contains(path, "*") {
 		return keys, errors.New("katamari: invalid pattern")
@@ -143,6 +167,9 @@ func (db *Storage) KeysRange(path string, from, to int64) ([]string, error) {
 		if created > to {
 			continue
 		}
+		if katamari.Expired(expires(iter.Value()), now) {
+			continue
+		}
 		keys = append(keys, current)
 	}
 
@@ -157,6 +184,7 @@ func (db *Storage) KeysRange(path string, from, to int64) ([]string, error) {
 
 // GetN get last N elements of a pattern related value(s)
 func (db *Storage) GetN(path string, limit int) ([]objects.Object, error) {
+	now := time.Now().UTC().UnixNano()
 	res := []objects.Object{}
 	if !strings.Contains(path, "*") {
 		return res, errors.New("katamari: invalid pattern")
@@ -182,11 +210,17 @@ func (db *Storage) GetN(path string, limit int) ([]objects.Object, error) {
 	}
 	for count < limit {
 		if !key.Match(path, string(iter.Key())) {
+			if !iter.Prev() {
+				break
+			}
 			continue
 		}
 
 		newObject, err := objects.DecodeFull(iter.Value())
-		if err != nil {
+		if err != nil || katamari.Expired(newObject.Expires, now) {
+			if !iter.Prev() {
+				break
+			}
 			continue
 		}
 
@@ -207,6 +241,7 @@ func (db *Storage) GetN(path string, limit int) ([]objects.Object, error) {
 
 // GetNRange get last N elements of a pattern related value(s)
 func (db *Storage) GetNRange(path string, limit int, from, to int64) ([]objects.Object, error) {
+	now := time.Now().UTC().UnixNano()
 	res := []objects.Object{}
 	if !strings.Contains(path, "*") {
 		return res, errors.New("katamari: invalid pattern")
@@ -258,7 +293,7 @@ func (db *Storage) GetNRange(path string, limit int, from, to int64) ([]objects.
 		}
 
 		newObject, err := objects.DecodeFull(iter.Value())
-		if err != nil {
+		if err != nil || katamari.Expired(newObject.Expires, now) {
 			if !iter.Prev() {
 				break
 			}
@@ -282,6 +317,7 @@ func (db *Storage) GetNRange(path string, limit int, from, to int64) ([]objects.
 
 // MemGetN get last N elements of a path related value(s)
 func (db *Storage) MemGetN(path string, limit int) ([]objects.Object, error) {
+	now := time.Now().UTC().UnixNano()
 	res := []objects.Object{}
 	if !strings.Contains(path, "*") {
 		return res, errors.New("katamari: invalid pattern")
@@ -297,7 +333,7 @@ func (db *Storage) MemGetN(path string, limit int) ([]objects.Object, error) {
 		}
 
 		newObject, err := objects.DecodeFull(value.([]byte))
-		if err != nil {
+		if err != nil || katamari.Expired(newObject.Expires, now) {
 			return true
 		}
 
@@ -316,11 +352,15 @@ func (db *Storage) MemGetN(path string, limit int) ([]objects.Object, error) {
 
 // Get a key/pattern related value(s)
 func (db *Storage) Get(path string) ([]byte, error) {
+	now := time.Now().UTC().UnixNano()
 	if !strings.Contains(path, "*") {
 		data, err := db.client.Get([]byte(path), nil)
 		if err != nil {
 			return []byte(""), err
 		}
+		if katamari.Expired(expires(data), now) {
+			return []byte(""), leveldb.ErrNotFound
+		}
 
 		return data, nil
 	}
@@ -338,7 +378,7 @@ func (db *Storage) Get(path string) ([]byte, error) {
 		}
 
 		newObject, err := objects.Decode(iter.Value())
-		if err != nil {
+		if err != nil || katamari.Expired(newObject.Expires, now) {
 			continue
 		}
 
@@ -357,9 +397,10 @@ func (db *Storage) Get(path string) ([]byte, error) {
 
 // MemGet a key/pattern related value(s)
 func (db *Storage) MemGet(path string) ([]byte, error) {
+	now := time.Now().UTC().UnixNano()
 	if !strings.Contains(path, "*") {
 		data, found := db.mem.Load(path)
-		if !found {
+		if !found || katamari.Expired(expires(data.([]byte)), now) {
 			return []byte(""), errors.New("katamari: not found")
 		}
 
@@ -373,7 +414,7 @@ func (db *Storage) MemGet(path string) ([]byte, error) {
 		}
 
 		newObject, err := objects.Decode(value.([]byte))
-		if err != nil {
+		if err != nil || katamari.Expired(newObject.Expires, now) {
 			return true
 		}
 
@@ -388,6 +429,7 @@ func (db *Storage) MemGet(path string) ([]byte, error) {
 
 // GetObjList bypass encoding and single objects reads
 func (db *Storage) GetObjList(path string) ([]objects.Object, error) {
+	now := time.Now().UTC().UnixNano()
 	res := []objects.Object{}
 	if !strings.Contains(path, "*") {
 		return res, errors.New("katamari: invalid pattern")
@@ -401,11 +443,17 @@ func (db *Storage) GetObjList(path string) ([]objects.Object, error) {
 	iter := db.client.NewIterator(rangeKey, nil)
 	for iter.Next() {
 		if !key.Match(path, string(iter.Key())) {
+			if !iter.Prev() {
+				break
+			}
 			continue
 		}
 
 		newObject, err := objects.DecodeFull(iter.Value())
-		if err != nil {
+		if err != nil || katamari.Expired(newObject.Expires, now) {
+			if !iter.Prev() {
+				break
+			}
 			continue
 		}
 
@@ -422,32 +470,67 @@ func (db *Storage) GetObjList(path string) ([]objects.Object, error) {
 
 // Peek a value timestamps
 func (db *Storage) Peek(key string, now int64) (int64, int64) {
-	previous, err := db.client.Get([]byte(key), nil)
-	if err != nil {
-		return now, 0
+	created, updated, _ := db.peek(key, now)
+	return created, updated
+}
+
+// peek a value timestamps and revision
+func (db *Storage) peek(key string, now int64) (int64, int64, int64) {
+	previous := db.lookup(key)
+	if previous == nil {
+		return now, 0, 0
 	}
 
 	oldObject, err := objects.Decode(previous)
 	if err != nil {
-		return now, 0
+		return now, 0, 0
 	}
 
-	return oldObject.Created, now
+	return oldObject.Created, now, oldObject.Revision
 }
 
 // Set a value
 func (db *Storage) Set(path string, data string) (string, error) {
+	return db.set(path, data, 0, false, 0)
+}
+
+// SetTTL a value that will expire after the ttl
+func (db *Storage) SetTTL(path string, data string, ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		return "", errors.New("katamari: invalid ttl")
+	}
+
+	return db.set(path, data, 0, false, katamari.Expires(time.Now().UTC().UnixNano(), ttl))
+}
+
+// SetIf a value if the stored revision matches (0 for a key that doesn't exist)
+func (db *Storage) SetIf(path string, data string, revision int64) (string, error) {
+	return db.set(path, data, revision, true, 0)
+}
+
+func (db *Storage) set(path string, data string, revision int64, check bool, expires int64) (string, error) {
 	now := time.Now().UTC().UnixNano()
 	index := key.LastIndex(path)
-	created, updated := db.Peek(path, now)
+	db.writeMutex.Lock()
+	created, updated, current := db.peek(path, now)
+	if check && current != revision {
+		db.writeMutex.Unlock()
+		return "", katamari.ErrRevisionMismatch
+	}
 	err := db.client.Put(
 		[]byte(path),
 		objects.New(&objects.Object{
-			Created: created,
-			Updated: updated,
-			Index:   index,
-			Data:    data,
+			Created:  created,
+			Updated:  updated,
+			Revision: current + 1,
+			Expires:  expires,
+			Index:    index,
+			Data:     data,
 		}), nil)
+	if err == nil {
+		db.expirations.Set(path, expires)
+	}
+	db.writeMutex.Unlock()
 
 	if err != nil {
 		return "", err
@@ -461,30 +544,147 @@ func (db *Storage) Set(path string, data string) (string, error) {
 
 // MemPeek a value timestamps
 func (db *Storage) MemPeek(key string, now int64) (int64, int64) {
-	previous, found := db.mem.Load(key)
-	if !found {
-		return now, 0
+	created, updated, _ := db.memPeek(key, now)
+	return created, updated
+}
+
+// memPeek a value timestamps and revision
+func (db *Storage) memPeek(key string, now int64) (int64, int64, int64) {
+	previous := db.memLookup(key)
+	if previous == nil {
+		return now, 0, 0
 	}
 
-	oldObject, err := objects.Decode(previous.([]byte))
+	oldObject, err := objects.Decode(previous)
 	if err != nil {
-		return now, 0
+		return now, 0, 0
 	}
 
-	return oldObject.Created, now
+	return oldObject.Created, now, oldObject.Revision
 }
 
 // MemSet a value
 func (db *Storage) MemSet(path string, data string) (string, error) {
+	return db.memSet(path, data, 0, false, 0)
+}
+
+// MemSetTTL a value that will expire after the ttl
+func (db *Storage) MemSetTTL(path string, data string, ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		return "", errors.New("katamari: invalid ttl")
+	}
+
+	return db.memSet(path, data, 0, false, katamari.Expires(time.Now().UTC().UnixNano(), ttl))
+}
+
+// MemSetIf a value if the stored revision matches (0 for a key that doesn't exist)
+func (db *Storage) MemSetIf(path string, data string, revision int64) (string, error) {
+	return db.memSet(path, data, revision, true, 0)
+}
+
+func (db *Storage) memSet(path string, data string, revision int64, check bool, expires int64) (string, error) {
 	now := time.Now().UTC().UnixNano()
 	index := key.LastIndex(path)
-	created, updated := db.MemPeek(path, now)
+	db.writeMutex.Lock()
+	created, updated, current := db.memPeek(path, now)
+	if check && current != revision {
+		db.writeMutex.Unlock()
+		return "", katamari.ErrRevisionMismatch
+	}
 	db.mem.Store(path, objects.New(&objects.Object{
-		Created: created,
-		Updated: updated,
-		Index:   index,
-		Data:    data,
+		Created:  created,
+		Updated:  updated,
+		Revision: current + 1,
+		Expires:  expires,
+		Index:    index,
+		Data:     data,
 	}))
+	db.memExpirations.Set(path, expires)
+	db.writeMutex.Unlock()
+
+	db.memWatcher <- katamari.StorageEvent{Key: path, Operation: "set"}
+	return index, nil
+}
+
+// Update a value with the data returned by the updater
+func (db *Storage) Update(path string, updater katamari.Updater) (string, error) {
+	if strings.Contains(path, "*") {
+		return "", errors.New("katamari: pathKeyError key is not valid")
+	}
+
+	now := time.Now().UTC().UnixNano()
+	index := key.LastIndex(path)
+	db.writeMutex.Lock()
+	previous := db.lookup(path)
+	if previous == nil {
+		db.writeMutex.Unlock()
+		return "", errors.New("katamari: not found")
+	}
+	oldObject, err := objects.Decode(previous)
+	if err != nil {
+		db.writeMutex.Unlock()
+		return "", err
+	}
+	data, err := updater(oldObject)
+	if err != nil {
+		db.writeMutex.Unlock()
+		return "", err
+	}
+	err = db.client.Put(
+		[]byte(path),
+		objects.New(&objects.Object{
+			Created:  oldObject.Created,
+			Updated:  now,
+			Revision: oldObject.Revision + 1,
+			Expires:  oldObject.Expires,
+			Index:    index,
+			Data:     data,
+		}), nil)
+	db.writeMutex.Unlock()
+
+	if err != nil {
+		return "", err
+	}
+
+	if !key.Contains(db.noBroadcastKeys, path) {
+		db.watcher <- katamari.StorageEvent{Key: path, Operation: "set"}
+	}
+	return index, nil
+}
+
+// MemUpdate a value with the data returned by the updater
+func (db *Storage) MemUpdate(path string, updater katamari.Updater) (string, error) {
+	if strings.Contains(path, "*") {
+		return "", errors.New("katamari: pathKeyError key is not valid")
+	}
+
+	now := time.Now().UTC().UnixNano()
+	index := key.LastIndex(path)
+	db.writeMutex.Lock()
+	previous := db.memLookup(path)
+	if previous == nil {
+		db.writeMutex.Unlock()
+		return "", errors.New("katamari: not found")
+	}
+	oldObject, err := objects.Decode(previous)
+	if err != nil {
+		db.writeMutex.Unlock()
+		return "", err
+	}
+	data, err := updater(oldObject)
+	if err != nil {
+		db.writeMutex.Unlock()
+		return "", err
+	}
+	db.mem.Store(path, objects.New(&objects.Object{
+		Created:  oldObject.Created,
+		Updated:  now,
+		Revision: oldObject.Revision + 1,
+		Expires:  oldObject.Expires,
+		Index:    index,
+		Data:     data,
+	}))
+	db.writeMutex.Unlock()
 
 	db.memWatcher <- katamari.StorageEvent{Key: path, Operation: "set"}
 	return index, nil
@@ -493,14 +693,21 @@ func (db *Storage) MemSet(path string, data string) (string, error) {
 // Pivot set entries on a pivot instance (force created/updated values)
 func (db *Storage) Pivot(path string, data string, created int64, updated int64) (string, error) {
 	index := key.LastIndex(path)
+	db.writeMutex.Lock()
+	_, _, revision := db.peek(path, 0)
 	err := db.client.Put(
 		[]byte(path),
 		objects.New(&objects.Object{
-			Created: created,
-			Updated: updated,
-			Index:   index,
-			Data:    data,
+			Created:  created,
+			Updated:  updated,
+			Revision: revision + 1,
+			Index:    index,
+			Data:     data,
 		}), nil)
+	if err == nil {
+		db.expirations.Set(path, 0)
+	}
+	db.writeMutex.Unlock()
 
 	if err != nil {
 		return "", err
@@ -516,16 +723,27 @@ func (db *Storage) Pivot(path string, data string, created int64, updated int64)
 func (db *Storage) Del(path string) error {
 	var err error
 	if !strings.Contains(path, "*") {
-		_, err = db.client.Get([]byte(path), nil)
+		db.writeMutex.Lock()
+		var data []byte
+		data, err = db.client.Get([]byte(path), nil)
+		if err == nil && katamari.Expired(expires(data), time.Now().UTC().UnixNano()) {
+			err = leveldb.ErrNotFound
+		}
 		if err != nil && err.Error() == "leveldb: not found" {
+			db.writeMutex.Unlock()
 			return errors.New("katamari: not found")
 		}
 
 		if err != nil {
+			db.writeMutex.Unlock()
 			return err
 		}
 
 		err = db.client.Delete([]byte(path), nil)
+		if err == nil {
+			db.expirations.Set(path, 0)
+		}
+		db.writeMutex.Unlock()
 		if err != nil {
 			return err
 		}
@@ -559,20 +777,132 @@ func (db *Storage) Del(path string) error {
 		return err
 	}
 
+	db.expirations.Del(path)
 	if !key.Contains(db.noBroadcastKeys, path) {
 		db.watcher <- katamari.StorageEvent{Key: path, Operation: "del"}
 	}
 	return nil
 }
 
+// load a stored value, nil if the key doesn't exist
+func (db *Storage) load(path string) []byte {
+	data, err := db.client.Get([]byte(path), nil)
+	if err != nil {
+		return nil
+	}
+
+	return data
+}
+
+// lookup a stored value, nil if the key doesn't exist or expired
+func (db *Storage) lookup(path string) []byte {
+	data := db.load(path)
+	if katamari.Expired(expires(data), time.Now().UTC().UnixNano()) {
+		return nil
+	}
+
+	return data
+}
+
+// Batch apply a list of set/del operations atomically
+func (db *Storage) Batch(operations []katamari.BatchOperation) ([]string, error) {
+	db.writeMutex.Lock()
+	writes, indexes, err := katamari.PlanBatch(operations, db.lookup)
+	if err != nil {
+		db.writeMutex.Unlock()
+		return nil, err
+	}
+	batch := new(leveldb.Batch)
+	for _, write := range writes {
+		if write.Value == nil {
+			batch.Delete([]byte(write.Key))
+			continue
+		}
+		batch.Put([]byte(write.Key), write.Value)
+	}
+	err = db.client.Write(batch, nil)
+	if err == nil {
+		for _, write := range writes {
+			db.expirations.Set(write.Key, 0)
+		}
+	}
+	db.writeMutex.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	db.notify(db.watcher, writes)
+	return indexes, nil
+}
+
+// memLoad a stored value, nil if the key doesn't exist
+func (db *Storage) memLoad(path string) []byte {
+	data, found := db.mem.Load(path)
+	if !found {
+		return nil
+	}
+
+	return data.([]byte)
+}
+
+// memLookup a stored value, nil if the key doesn't exist or expired
+func (db *Storage) memLookup(path string) []byte {
+	data := db.memLoad(path)
+	if katamari.Expired(expires(data), time.Now().UTC().UnixNano()) {
+		return nil
+	}
+
+	return data
+}
+
+// MemBatch apply a list of set/del operations atomically
+func (db *Storage) MemBatch(operations []katamari.BatchOperation) ([]string, error) {
+	db.writeMutex.Lock()
+	writes, indexes, err := katamari.PlanBatch(operations, db.memLookup)
+	if err != nil {
+		db.writeMutex.Unlock()
+		return nil, err
+	}
+	for _, write := range writes {
+		db.memExpirations.Set(write.Key, 0)
+		if write.Value == nil {
+			db.mem.Delete(write.Key)
+			continue
+		}
+		db.mem.Store(write.Key, write.Value)
+	}
+	db.writeMutex.Unlock()
+
+	db.notify(db.memWatcher, writes)
+	return indexes, nil
+}
+
+// notify the watcher of the writes of a batch
+func (db *Storage) notify(watcher katamari.StorageChan, writes []katamari.BatchWrite) {
+	for _, write := range writes {
+		if key.Contains(db.noBroadcastKeys, write.Key) {
+			continue
+		}
+		if write.Value == nil {
+			watcher <- katamari.StorageEvent{Key: write.Key, Operation: "del"}
+			continue
+		}
+		watcher <- katamari.StorageEvent{Key: write.Key, Operation: "set"}
+	}
+}
+
 // MemDel a key/pattern value(s)
 func (db *Storage) MemDel(path string) error {
 	if !strings.Contains(path, "*") {
-		_, found := db.mem.Load(path)
-		if !found {
+		db.writeMutex.Lock()
+		if db.memLookup(path) == nil {
+			db.writeMutex.Unlock()
 			return errors.New("katamari: not found")
 		}
 		db.mem.Delete(path)
+		db.memExpirations.Set(path, 0)
+		db.writeMutex.Unlock()
 		db.memWatcher <- katamari.StorageEvent{Key: path, Operation: "del"}
 		return nil
 	}
@@ -583,16 +913,80 @@ func (db *Storage) MemDel(path string) error {
 		}
 		return true
 	})
+	db.memExpirations.Del(path)
 	db.memWatcher <- katamari.StorageEvent{Key: path, Operation: "del"}
 	return nil
 }
 
-// Watch the storage set/del events
+// index the keys with a ttl stored on a previous run
+func (db *Storage) index() {
+	iter := db.client.NewIterator(nil, nil)
+	for iter.Next() {
+		obj, err := objects.Decode(iter.Value())
+		if err == nil && obj.Expires > 0 {
+			db.expirations.Set(string(iter.Key()), obj.Expires)
+		}
+	}
+	iter.Release()
+}
+
+// expires of a stored value, 0 if it doesn't exist or has no ttl
+func expires(data []byte) int64 {
+	if data == nil {
+		return 0
+	}
+	obj, err := objects.Decode(data)
+	if err != nil {
+		return 0
+	}
+
+	return obj.Expires
+}
+
+// expire the keys with a ttl that passed
+func (db *Storage) expire() {
+	now := time.Now().UTC().UnixNano()
+	for _, path := range db.expirations.Expired(now) {
+		db.writeMutex.Lock()
+		current := expires(db.load(path))
+		if current == 0 || current > now {
+			db.expirations.Set(path, current)
+			db.writeMutex.Unlock()
+			continue
+		}
+		err := db.client.Delete([]byte(path), nil)
+		if err == nil {
+			db.expirations.Set(path, 0)
+		}
+		db.writeMutex.Unlock()
+
+		if err == nil && !key.Contains(db.noBroadcastKeys, path) {
+			db.watcher <- katamari.StorageEvent{Key: path, Operation: "expire"}
+		}
+	}
+
+	for _, path := range db.memExpirations.Expired(now) {
+		db.writeMutex.Lock()
+		current := expires(db.memLoad(path))
+		if current == 0 || current > now {
+			db.memExpirations.Set(path, current)
+			db.writeMutex.Unlock()
+			continue
+		}
+		db.mem.Delete(path)
+		db.memExpirations.Set(path, 0)
+		db.writeMutex.Unlock()
+
+		db.memWatcher <- katamari.StorageEvent{Key: path, Operation: "expire"}
+	}
+}
+
+// Watch the storage set/del/expire events
 func (db *Storage) Watch() katamari.StorageChan {
 	return db.watcher
 }
 
-// MemWatch the storage set/del events
+// MemWatch the storage set/del/expire events
 func (db *Storage) MemWatch() katamari.StorageChan {
 	return db.memWatcher
 }
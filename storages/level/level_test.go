@@ -3,6 +3,7 @@ package level
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/benitogf/katamari"
 	"github.com/benitogf/katamari/messages"
@@ -27,12 +28,28 @@ func TestStorageLeveldb(t *testing.T) {
 	app := &katamari.Server{}
 	app.Silence = true
 	app.Storage = &Storage{Path: "test/db"}
+	app.ExpireInterval = 10 * time.Millisecond
 	app.Start("localhost:0")
 	defer app.Close(os.Interrupt)
 	for i := range units {
 		katamari.StorageListTest(app, t, messages.Encode([]byte(units[i])))
 	}
 	katamari.StorageObjectTest(app, t)
+	katamari.StorageSetIfTest(app, t)
+	katamari.StorageBatchTest(app, t)
+	katamari.StorageUpdateTest(app, t)
+	katamari.StorageTTLTest(app, t)
+}
+
+func TestStorageLeveldbExpired(t *testing.T) {
+	t.Parallel()
+	app := &katamari.Server{}
+	app.Silence = true
+	app.Storage = &Storage{Path: "test/db" + katamari.Time()}
+	app.ExpireInterval = time.Hour
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	katamari.StorageExpiredTest(app, t)
 }
 
 func TestStreamBroadcastLevel(t *testing.T) {
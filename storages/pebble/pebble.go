@@ -18,11 +18,16 @@ type Storage struct {
 	Path            string
 	mem             sync.Map
 	noBroadcastKeys []string
+	writeMutex      sync.Mutex
 	client          *pebble.DB
 	mutex           sync.RWMutex
 	watcher         katamari.StorageChan
 	memWatcher      katamari.StorageChan
 	storage         *katamari.Storage
+	expirations     katamari.Expirations
+	memExpirations  katamari.Expirations
+	stop            chan struct{}
+	done            chan struct{}
 }
 
 // Active provides access to the status of the storage client
@@ -54,6 +59,10 @@ func (db *Storage) Start(storageOpt katamari.StorageOpt) error {
 	}
 	if err == nil {
 		db.storage.Active = true
+		db.index()
+		db.stop = make(chan struct{})
+		db.done = make(chan struct{})
+		go katamari.Sweep(storageOpt.ExpireInterval, db.stop, db.done, db.expire)
 	}
 	db.noBroadcastKeys = storageOpt.NoBroadcastKeys
 	return err
@@ -61,6 +70,11 @@ func (db *Storage) Start(storageOpt katamari.StorageOpt) error {
 
 // Close the storage client
 func (db *Storage) Close() {
+	if db.stop != nil {
+		close(db.stop)
+		<-db.done
+		db.stop = nil
+	}
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 	db.storage.Active = false
@@ -73,6 +87,8 @@ func (db *Storage) Close() {
 
 // Clear all keys in the storage
 func (db *Storage) Clear() {
+	db.expirations.Clear()
+	db.memExpirations.Clear()
 	iter := db.client.NewIter(&pebble.IterOptions{})
 	iter.First()
 	for iter.Valid() {
@@ -80,16 +96,23 @@ func (db *Storage) Clear() {
 		iter.Next()
 	}
 	iter.Close()
+	db.mem.Range(func(key interface{}, value interface{}) bool {
+		db.mem.Delete(key)
+		return true
+	})
 }
 
 // Keys list all the keys in the storage
 func (db *Storage) Keys() ([]byte, error) {
+	now := time.Now().UTC().UnixNano()
 	iter := db.client.NewIter(&pebble.IterOptions{})
 	stats := katamari.Stats{}
 
 	iter.First()
 	for iter.Valid() {
-		stats.Keys = append(stats.Keys, string(iter.Key()))
+		if !katamari.Expired(expires(iter.Value()), now) {
+			stats.Keys = append(stats.Keys, string(iter.Key()))
+		}
 		iter.Next()
 	}
 
@@ -107,6 +130,7 @@ func (db *Storage) Keys() ([]byte, error) {
 
 // KeysRange list keys in a path and time range
 func (db *Storage) KeysRange(path string, from, to int64) ([]string, error) {
+	now := time.Now().UTC().UnixNano()
 	keys := []string{}
 	if !strings.Contains(path, "*") {
 		return keys, errors.New("katamari: invalid pattern")
@@ -141,6 +165,10 @@ func (db *Storage) KeysRange(path string, from, to int64) ([]string, error) {
 			iter.Next()
 			continue
 		}
+		if katamari.Expired(expires(iter.Value()), now) {
+			iter.Next()
+			continue
+		}
 		keys = append(keys, current)
 		iter.Next()
 	}
@@ -155,6 +183,7 @@ func (db *Storage) KeysRange(path string, from, to int64) ([]string, error) {
 
 // GetN get last N elements of a pattern related value(s)
 func (db *Storage) GetN(path string, limit int) ([]objects.Object, error) {
+	now := time.Now().UTC().UnixNano()
 	res := []objects.Object{}
 	if !strings.Contains(path, "*") {
 		return res, errors.New("katamari: invalid pattern")
@@ -179,11 +208,17 @@ func (db *Storage) GetN(path string, limit int) ([]objects.Object, error) {
 	}
 	for count < limit {
 		if !key.Match(path, string(iter.Key())) {
+			if !iter.Prev() {
+				break
+			}
 			continue
 		}
 
 		newObject, err := objects.DecodeFull(iter.Value())
-		if err != nil {
+		if err != nil || katamari.Expired(newObject.Expires, now) {
+			if !iter.Prev() {
+				break
+			}
 			continue
 		}
 
@@ -204,6 +239,7 @@ func (db *Storage) GetN(path string, limit int) ([]objects.Object, error) {
 
 // GetNRange get last N elements of a pattern related value(s)
 func (db *Storage) GetNRange(path string, limit int, from, to int64) ([]objects.Object, error) {
+	now := time.Now().UTC().UnixNano()
 	res := []objects.Object{}
 	lookupCount := 0
 	lookupLimit := 800000
@@ -266,7 +302,7 @@ func (db *Storage) GetNRange(path string, limit int, from, to int64) ([]objects.
 		}
 
 		newObject, err := objects.DecodeFull(iter.Value())
-		if err != nil {
+		if err != nil || katamari.Expired(newObject.Expires, now) {
 			if !iter.Prev() {
 				break
 			}
@@ -290,6 +326,7 @@ func (db *Storage) GetNRange(path string, limit int, from, to int64) ([]objects.
 
 // MemGetN get last N elements of a path related value(s)
 func (db *Storage) MemGetN(path string, limit int) ([]objects.Object, error) {
+	now := time.Now().UTC().UnixNano()
 	res := []objects.Object{}
 	if !strings.Contains(path, "*") {
 		return res, errors.New("katamari: invalid pattern")
@@ -305,7 +342,7 @@ func (db *Storage) MemGetN(path string, limit int) ([]objects.Object, error) {
 		}
 
 		newObject, err := objects.DecodeFull(value.([]byte))
-		if err != nil {
+		if err != nil || katamari.Expired(newObject.Expires, now) {
 			return true
 		}
 
@@ -324,6 +361,7 @@ func (db *Storage) MemGetN(path string, limit int) ([]objects.Object, error) {
 
 // Get a key/pattern related value(s)
 func (db *Storage) Get(path string) ([]byte, error) {
+	now := time.Now().UTC().UnixNano()
 	if !strings.Contains(path, "*") {
 		data, closer, err := db.client.Get([]byte(path))
 		if err != nil {
@@ -336,6 +374,9 @@ func (db *Storage) Get(path string) ([]byte, error) {
 		if err != nil {
 			return []byte(""), err
 		}
+		if katamari.Expired(expires(result), now) {
+			return []byte(""), pebble.ErrNotFound
+		}
 		return result, nil
 	}
 
@@ -356,7 +397,7 @@ func (db *Storage) Get(path string) ([]byte, error) {
 		}
 
 		newObject, err := objects.Decode(iter.Value())
-		if err != nil {
+		if err != nil || katamari.Expired(newObject.Expires, now) {
 			iter.Next()
 			continue
 		}
@@ -377,9 +418,10 @@ func (db *Storage) Get(path string) ([]byte, error) {
 
 // MemGet a key/pattern related value(s)
 func (db *Storage) MemGet(path string) ([]byte, error) {
+	now := time.Now().UTC().UnixNano()
 	if !strings.Contains(path, "*") {
 		data, found := db.mem.Load(path)
-		if !found {
+		if !found || katamari.Expired(expires(data.([]byte)), now) {
 			return []byte(""), errors.New("katamari: not found")
 		}
 
@@ -393,7 +435,7 @@ func (db *Storage) MemGet(path string) ([]byte, error) {
 		}
 
 		newObject, err := objects.Decode(value.([]byte))
-		if err != nil {
+		if err != nil || katamari.Expired(newObject.Expires, now) {
 			return true
 		}
 
@@ -408,6 +450,7 @@ func (db *Storage) MemGet(path string) ([]byte, error) {
 
 // GetObjList bypass encoding and single objects reads
 func (db *Storage) GetObjList(path string) ([]objects.Object, error) {
+	now := time.Now().UTC().UnixNano()
 	res := []objects.Object{}
 	if !strings.Contains(path, "*") {
 		return res, errors.New("katamari: invalid pattern")
@@ -429,7 +472,7 @@ func (db *Storage) GetObjList(path string) ([]objects.Object, error) {
 		}
 
 		newObject, err := objects.DecodeFull(iter.Value())
-		if err != nil {
+		if err != nil || katamari.Expired(newObject.Expires, now) {
 			iter.Next()
 			continue
 		}
@@ -443,36 +486,67 @@ func (db *Storage) GetObjList(path string) ([]objects.Object, error) {
 
 // Peek a value timestamps
 func (db *Storage) Peek(key string, now int64) (int64, int64) {
-	previous, closer, err := db.client.Get([]byte(key))
-	if err != nil {
-		return now, 0
+	created, updated, _ := db.peek(key, now)
+	return created, updated
+}
+
+// peek a value timestamps and revision
+func (db *Storage) peek(key string, now int64) (int64, int64, int64) {
+	previous := db.lookup(key)
+	if previous == nil {
+		return now, 0, 0
 	}
 
 	oldObject, err := objects.Decode(previous)
 	if err != nil {
-		return now, 0
+		return now, 0, 0
 	}
 
-	err = closer.Close()
-	if err != nil {
-		return now, 0
-	}
-	return oldObject.Created, now
+	return oldObject.Created, now, oldObject.Revision
 }
 
 // Set a value
 func (db *Storage) Set(path string, data string) (string, error) {
+	return db.set(path, data, 0, false, 0)
+}
+
+// SetTTL a value that will expire after the ttl
+func (db *Storage) SetTTL(path string, data string, ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		return "", errors.New("katamari: invalid ttl")
+	}
+
+	return db.set(path, data, 0, false, katamari.Expires(time.Now().UTC().UnixNano(), ttl))
+}
+
+// SetIf a value if the stored revision matches (0 for a key that doesn't exist)
+func (db *Storage) SetIf(path string, data string, revision int64) (string, error) {
+	return db.set(path, data, revision, true, 0)
+}
+
+func (db *Storage) set(path string, data string, revision int64, check bool, expires int64) (string, error) {
 	now := time.Now().UTC().UnixNano()
 	index := key.LastIndex(path)
-	created, updated := db.Peek(path, now)
+	db.writeMutex.Lock()
+	created, updated, current := db.peek(path, now)
+	if check && current != revision {
+		db.writeMutex.Unlock()
+		return "", katamari.ErrRevisionMismatch
+	}
 	err := db.client.Set(
 		[]byte(path),
 		objects.New(&objects.Object{
-			Created: created,
-			Updated: updated,
-			Index:   index,
-			Data:    data,
+			Created:  created,
+			Updated:  updated,
+			Revision: current + 1,
+			Expires:  expires,
+			Index:    index,
+			Data:     data,
 		}), pebble.Sync)
+	if err == nil {
+		db.expirations.Set(path, expires)
+	}
+	db.writeMutex.Unlock()
 
 	if err != nil {
 		return "", err
@@ -486,30 +560,147 @@ func (db *Storage) Set(path string, data string) (string, error) {
 
 // MemPeek a value timestamps
 func (db *Storage) MemPeek(key string, now int64) (int64, int64) {
-	previous, found := db.mem.Load(key)
-	if !found {
-		return now, 0
+	created, updated, _ := db.memPeek(key, now)
+	return created, updated
+}
+
+// memPeek a value timestamps and revision
+func (db *Storage) memPeek(key string, now int64) (int64, int64, int64) {
+	previous := db.memLookup(key)
+	if previous == nil {
+		return now, 0, 0
 	}
 
-	oldObject, err := objects.Decode(previous.([]byte))
+	oldObject, err := objects.Decode(previous)
 	if err != nil {
-		return now, 0
+		return now, 0, 0
 	}
 
-	return oldObject.Created, now
+	return oldObject.Created, now, oldObject.Revision
 }
 
 // MemSet a value
 func (db *Storage) MemSet(path string, data string) (string, error) {
+	return db.memSet(path, data, 0, false, 0)
+}
+
+// MemSetTTL a value that will expire after the ttl
+func (db *Storage) MemSetTTL(path string, data string, ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		return "", errors.New("katamari: invalid ttl")
+	}
+
+	return db.memSet(path, data, 0, false, katamari.Expires(time.Now().UTC().UnixNano(), ttl))
+}
+
+// MemSetIf a value if the stored revision matches (0 for a key that doesn't exist)
+func (db *Storage) MemSetIf(path string, data string, revision int64) (string, error) {
+	return db.memSet(path, data, revision, true, 0)
+}
+
+func (db *Storage) memSet(path string, data string, revision int64, check bool, expires int64) (string, error) {
 	now := time.Now().UTC().UnixNano()
 	index := key.LastIndex(path)
-	created, updated := db.MemPeek(path, now)
+	db.writeMutex.Lock()
+	created, updated, current := db.memPeek(path, now)
+	if check && current != revision {
+		db.writeMutex.Unlock()
+		return "", katamari.ErrRevisionMismatch
+	}
 	db.mem.Store(path, objects.New(&objects.Object{
-		Created: created,
-		Updated: updated,
-		Index:   index,
-		Data:    data,
+		Created:  created,
+		Updated:  updated,
+		Revision: current + 1,
+		Expires:  expires,
+		Index:    index,
+		Data:     data,
 	}))
+	db.memExpirations.Set(path, expires)
+	db.writeMutex.Unlock()
+
+	db.memWatcher <- katamari.StorageEvent{Key: path, Operation: "set"}
+	return index, nil
+}
+
+// Update a value with the data returned by the updater
+func (db *Storage) Update(path string, updater katamari.Updater) (string, error) {
+	if strings.Contains(path, "*") {
+		return "", errors.New("katamari: pathKeyError key is not valid")
+	}
+
+	now := time.Now().UTC().UnixNano()
+	index := key.LastIndex(path)
+	db.writeMutex.Lock()
+	previous := db.lookup(path)
+	if previous == nil {
+		db.writeMutex.Unlock()
+		return "", errors.New("katamari: not found")
+	}
+	oldObject, err := objects.Decode(previous)
+	if err != nil {
+		db.writeMutex.Unlock()
+		return "", err
+	}
+	data, err := updater(oldObject)
+	if err != nil {
+		db.writeMutex.Unlock()
+		return "", err
+	}
+	err = db.client.Set(
+		[]byte(path),
+		objects.New(&objects.Object{
+			Created:  oldObject.Created,
+			Updated:  now,
+			Revision: oldObject.Revision + 1,
+			Expires:  oldObject.Expires,
+			Index:    index,
+			Data:     data,
+		}), pebble.Sync)
+	db.writeMutex.Unlock()
+
+	if err != nil {
+		return "", err
+	}
+
+	if !key.Contains(db.noBroadcastKeys, path) {
+		db.watcher <- katamari.StorageEvent{Key: path, Operation: "set"}
+	}
+	return index, nil
+}
+
+// MemUpdate a value with the data returned by the updater
+func (db *Storage) MemUpdate(path string, updater katamari.Updater) (string, error) {
+	if strings.Contains(path, "*") {
+		return "", errors.New("katamari: pathKeyError key is not valid")
+	}
+
+	now := time.Now().UTC().UnixNano()
+	index := key.LastIndex(path)
+	db.writeMutex.Lock()
+	previous := db.memLookup(path)
+	if previous == nil {
+		db.writeMutex.Unlock()
+		return "", errors.New("katamari: not found")
+	}
+	oldObject, err := objects.Decode(previous)
+	if err != nil {
+		db.writeMutex.Unlock()
+		return "", err
+	}
+	data, err := updater(oldObject)
+	if err != nil {
+		db.writeMutex.Unlock()
+		return "", err
+	}
+	db.mem.Store(path, objects.New(&objects.Object{
+		Created:  oldObject.Created,
+		Updated:  now,
+		Revision: oldObject.Revision + 1,
+		Expires:  oldObject.Expires,
+		Index:    index,
+		Data:     data,
+	}))
+	db.writeMutex.Unlock()
 
 	db.memWatcher <- katamari.StorageEvent{Key: path, Operation: "set"}
 	return index, nil
@@ -518,14 +709,21 @@ func (db *Storage) MemSet(path string, data string) (string, error) {
 // Pivot set entries on a pivot instance (force created/updated values)
 func (db *Storage) Pivot(path string, data string, created int64, updated int64) (string, error) {
 	index := key.LastIndex(path)
+	db.writeMutex.Lock()
+	_, _, revision := db.peek(path, 0)
 	err := db.client.Set(
 		[]byte(path),
 		objects.New(&objects.Object{
-			Created: created,
-			Updated: updated,
-			Index:   index,
-			Data:    data,
+			Created:  created,
+			Updated:  updated,
+			Revision: revision + 1,
+			Index:    index,
+			Data:     data,
 		}), pebble.Sync)
+	if err == nil {
+		db.expirations.Set(path, 0)
+	}
+	db.writeMutex.Unlock()
 
 	if err != nil {
 		return "", err
@@ -541,16 +739,23 @@ func (db *Storage) Pivot(path string, data string, created int64, updated int64)
 func (db *Storage) Del(path string) error {
 	var err error
 	if !strings.Contains(path, "*") {
+		db.writeMutex.Lock()
 		_, err = db.Get(path)
 		if err != nil && err.Error() == "pebble: not found" {
+			db.writeMutex.Unlock()
 			return errors.New("katamari: not found")
 		}
 
 		if err != nil {
+			db.writeMutex.Unlock()
 			return err
 		}
 
 		err = db.client.Delete([]byte(path), nil)
+		if err == nil {
+			db.expirations.Set(path, 0)
+		}
+		db.writeMutex.Unlock()
 		if err != nil {
 			return err
 		}
@@ -588,20 +793,144 @@ func (db *Storage) Del(path string) error {
 		return err
 	}
 
+	db.expirations.Del(path)
 	if !key.Contains(db.noBroadcastKeys, path) {
 		db.watcher <- katamari.StorageEvent{Key: path, Operation: "del"}
 	}
 	return nil
 }
 
+// load a stored value, nil if the key doesn't exist
+func (db *Storage) load(path string) []byte {
+	data, closer, err := db.client.Get([]byte(path))
+	if err != nil {
+		return nil
+	}
+
+	result := make([]byte, len(data))
+	copy(result, data)
+	err = closer.Close()
+	if err != nil {
+		return nil
+	}
+
+	return result
+}
+
+// lookup a stored value, nil if the key doesn't exist or expired
+func (db *Storage) lookup(path string) []byte {
+	data := db.load(path)
+	if katamari.Expired(expires(data), time.Now().UTC().UnixNano()) {
+		return nil
+	}
+
+	return data
+}
+
+// Batch apply a list of set/del operations atomically
+func (db *Storage) Batch(operations []katamari.BatchOperation) ([]string, error) {
+	db.writeMutex.Lock()
+	writes, indexes, err := katamari.PlanBatch(operations, db.lookup)
+	if err != nil {
+		db.writeMutex.Unlock()
+		return nil, err
+	}
+	batch := db.client.NewBatch()
+	for _, write := range writes {
+		if write.Value == nil {
+			err = batch.Delete([]byte(write.Key), nil)
+		} else {
+			err = batch.Set([]byte(write.Key), write.Value, nil)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = batch.Commit(pebble.Sync)
+	}
+	if err == nil {
+		for _, write := range writes {
+			db.expirations.Set(write.Key, 0)
+		}
+	}
+	db.writeMutex.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	db.notify(db.watcher, writes)
+	return indexes, nil
+}
+
+// memLoad a stored value, nil if the key doesn't exist
+func (db *Storage) memLoad(path string) []byte {
+	data, found := db.mem.Load(path)
+	if !found {
+		return nil
+	}
+
+	return data.([]byte)
+}
+
+// memLookup a stored value, nil if the key doesn't exist or expired
+func (db *Storage) memLookup(path string) []byte {
+	data := db.memLoad(path)
+	if katamari.Expired(expires(data), time.Now().UTC().UnixNano()) {
+		return nil
+	}
+
+	return data
+}
+
+// MemBatch apply a list of set/del operations atomically
+func (db *Storage) MemBatch(operations []katamari.BatchOperation) ([]string, error) {
+	db.writeMutex.Lock()
+	writes, indexes, err := katamari.PlanBatch(operations, db.memLookup)
+	if err != nil {
+		db.writeMutex.Unlock()
+		return nil, err
+	}
+	for _, write := range writes {
+		db.memExpirations.Set(write.Key, 0)
+		if write.Value == nil {
+			db.mem.Delete(write.Key)
+			continue
+		}
+		db.mem.Store(write.Key, write.Value)
+	}
+	db.writeMutex.Unlock()
+
+	db.notify(db.memWatcher, writes)
+	return indexes, nil
+}
+
+// notify the watcher of the writes of a batch
+func (db *Storage) notify(watcher katamari.StorageChan, writes []katamari.BatchWrite) {
+	for _, write := range writes {
+		if key.Contains(db.noBroadcastKeys, write.Key) {
+			continue
+		}
+		if write.Value == nil {
+			watcher <- katamari.StorageEvent{Key: write.Key, Operation: "del"}
+			continue
+		}
+		watcher <- katamari.StorageEvent{Key: write.Key, Operation: "set"}
+	}
+}
+
 // MemDel a key/pattern value(s)
 func (db *Storage) MemDel(path string) error {
 	if !strings.Contains(path, "*") {
-		_, found := db.mem.Load(path)
-		if !found {
+		db.writeMutex.Lock()
+		if db.memLookup(path) == nil {
+			db.writeMutex.Unlock()
 			return errors.New("katamari: not found")
 		}
 		db.mem.Delete(path)
+		db.memExpirations.Set(path, 0)
+		db.writeMutex.Unlock()
 		db.memWatcher <- katamari.StorageEvent{Key: path, Operation: "del"}
 		return nil
 	}
@@ -612,16 +941,82 @@ func (db *Storage) MemDel(path string) error {
 		}
 		return true
 	})
+	db.memExpirations.Del(path)
 	db.memWatcher <- katamari.StorageEvent{Key: path, Operation: "del"}
 	return nil
 }
 
-// Watch the storage set/del events
+// index the keys with a ttl stored on a previous run
+func (db *Storage) index() {
+	iter := db.client.NewIter(&pebble.IterOptions{})
+	iter.First()
+	for iter.Valid() {
+		obj, err := objects.Decode(iter.Value())
+		if err == nil && obj.Expires > 0 {
+			db.expirations.Set(string(iter.Key()), obj.Expires)
+		}
+		iter.Next()
+	}
+	iter.Close()
+}
+
+// expires of a stored value, 0 if it doesn't exist or has no ttl
+func expires(data []byte) int64 {
+	if data == nil {
+		return 0
+	}
+	obj, err := objects.Decode(data)
+	if err != nil {
+		return 0
+	}
+
+	return obj.Expires
+}
+
+// expire the keys with a ttl that passed
+func (db *Storage) expire() {
+	now := time.Now().UTC().UnixNano()
+	for _, path := range db.expirations.Expired(now) {
+		db.writeMutex.Lock()
+		current := expires(db.load(path))
+		if current == 0 || current > now {
+			db.expirations.Set(path, current)
+			db.writeMutex.Unlock()
+			continue
+		}
+		err := db.client.Delete([]byte(path), pebble.Sync)
+		if err == nil {
+			db.expirations.Set(path, 0)
+		}
+		db.writeMutex.Unlock()
+
+		if err == nil && !key.Contains(db.noBroadcastKeys, path) {
+			db.watcher <- katamari.StorageEvent{Key: path, Operation: "expire"}
+		}
+	}
+
+	for _, path := range db.memExpirations.Expired(now) {
+		db.writeMutex.Lock()
+		current := expires(db.memLoad(path))
+		if current == 0 || current > now {
+			db.memExpirations.Set(path, current)
+			db.writeMutex.Unlock()
+			continue
+		}
+		db.mem.Delete(path)
+		db.memExpirations.Set(path, 0)
+		db.writeMutex.Unlock()
+
+		db.memWatcher <- katamari.StorageEvent{Key: path, Operation: "expire"}
+	}
+}
+
+// Watch the storage set/del/expire events
 func (db *Storage) Watch() katamari.StorageChan {
 	return db.watcher
 }
 
-// MemWatch the storage set/del events
+// MemWatch the storage set/del/expire events
 func (db *Storage) MemWatch() katamari.StorageChan {
 	return db.memWatcher
 }
@@ -30,7 +30,7 @@ func (sm *Pools) getCache(poolIndex int) Cache {
 func (sm *Pools) SetCache(key string, data []byte) int64 {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
-	poolIndex := sm.findPool(key, key)
+	poolIndex := sm.findPool(key, key, "")
 	now := time.Now().UTC().UnixNano()
 	if poolIndex == -1 {
 		// create a pool
@@ -57,7 +57,7 @@ func (sm *Pools) SetCache(key string, data []byte) int64 {
 func (sm *Pools) GetCache(key string) (Cache, error) {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
-	poolIndex := sm.findPool(key, key)
+	poolIndex := sm.findPool(key, key, "")
 	if poolIndex == -1 {
 		return Cache{}, errors.New("stream pool not found")
 	}
@@ -0,0 +1,84 @@
+package stream
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventStreamType media type of server sent events
+const EventStreamType = "text/event-stream"
+
+// event formats a message as a server sent event
+func event(message []byte, id string) []byte {
+	data := "data: " + strings.Replace(string(message), "\n", "\ndata: ", -1) + "\n\n"
+	if id != "" {
+		return []byte("id: " + id + "\n" + data)
+	}
+
+	return []byte(data)
+}
+
+// Events stream on a key using server sent events
+func (sm *Pools) Events(key string, filter string, w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("katamari: event streams are not supported")
+	}
+
+	// the stream outlives the write timeout of the server,
+	// each write of the connection renews the deadline
+	controller := http.NewResponseController(w)
+	err := controller.SetWriteDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	err = sm.OnSubscribe(key)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &Conn{
+		mutex:      sync.Mutex{},
+		raw:        isRaw(r),
+		principal:  sm.identify(r),
+		request:    r,
+		events:     w,
+		controller: controller,
+		flusher:    flusher,
+		done:       make(chan struct{}),
+	}
+	err = sm.register(client)
+	if err != nil {
+		go sm.OnUnsubscribe(key)
+		return nil, err
+	}
+
+	w.Header().Set("Content-Type", EventStreamType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.join(key, filter, client)
+	return client, nil
+}
+
+// Wait will keep the event stream open until the request is done or the connection
+// is closed, no messages will be written on the stream after it returns
+func (sm *Pools) Wait(key string, filter string, client *Conn, r *http.Request) {
+	select {
+	case <-r.Context().Done():
+	case <-client.done:
+	}
+
+	client.mutex.Lock()
+	client.closed = true
+	client.mutex.Unlock()
+	sm.Close(key, filter, client)
+}
@@ -0,0 +1,170 @@
+package stream
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// close codes sent to the connections which session ended
+const (
+	CloseExpired = 4001
+	CloseRevoked = 4003
+)
+
+// Session : identity and expiry of the credentials of a request, an error
+// means the credentials are not valid anymore, requests without credentials
+// have an empty identity
+type Session func(r *http.Request) (string, time.Time, error)
+
+// Identity returns the identity of the session of the connection
+func (client *Conn) Identity() string {
+	client.sessionMutex.RLock()
+	defer client.sessionMutex.RUnlock()
+	return client.identity
+}
+
+// Expires returns the expiry of the session of the connection, zero if it doesn't expire
+func (client *Conn) Expires() time.Time {
+	client.sessionMutex.RLock()
+	defer client.sessionMutex.RUnlock()
+	return client.expires
+}
+
+// register a connection and its session, a connection which credentials
+// are not valid anymore is closed without being registered
+func (sm *Pools) register(client *Conn) error {
+	if sm.Session != nil && client.request != nil {
+		identity, expires, err := sm.Session(client.request)
+		if err != nil {
+			sm.Console.Log("sessionRevoked", err)
+			client.end(CloseRevoked, "katamari: session revoked")
+			return err
+		}
+		client.sessionMutex.Lock()
+		client.identity = identity
+		client.expires = expires
+		sm.schedule(client)
+		client.sessionMutex.Unlock()
+	}
+
+	sm.sessions.Lock()
+	defer sm.sessions.Unlock()
+	if sm.connections == nil {
+		sm.connections = map[*Conn]bool{}
+	}
+	sm.connections[client] = true
+	return nil
+}
+
+// unregister a closed connection
+func (sm *Pools) unregister(client *Conn) {
+	client.sessionMutex.Lock()
+	if client.timer != nil {
+		client.timer.Stop()
+	}
+	client.sessionMutex.Unlock()
+
+	sm.sessions.Lock()
+	defer sm.sessions.Unlock()
+	delete(sm.connections, client)
+}
+
+// schedule the close of the connection once its session expires,
+// the session mutex of the connection should be locked
+func (sm *Pools) schedule(client *Conn) {
+	if client.timer != nil {
+		client.timer.Stop()
+	}
+	if client.expires.IsZero() {
+		client.timer = nil
+		return
+	}
+	client.timer = time.AfterFunc(time.Until(client.expires), func() {
+		sm.expire(client)
+	})
+}
+
+// expire closes the connection unless its session was renewed
+func (sm *Pools) expire(client *Conn) {
+	if time.Now().Before(client.Expires()) {
+		return
+	}
+	sm.Console.Log("sessionExpired", client.Identity())
+	client.end(CloseExpired, "katamari: session expired")
+}
+
+// Renew the session of a connection with the credentials of a request,
+// the identity of the session can't change
+func (sm *Pools) Renew(client *Conn, r *http.Request) error {
+	if sm.Session == nil {
+		return errors.New("katamari: sessions are not enabled")
+	}
+
+	identity, expires, err := sm.Session(r)
+	if err != nil {
+		return err
+	}
+
+	client.sessionMutex.Lock()
+	defer client.sessionMutex.Unlock()
+	if identity != client.identity {
+		return errors.New("katamari: the session identity doesn't match")
+	}
+	client.request = r
+	client.expires = expires
+	sm.schedule(client)
+	return nil
+}
+
+// end sends a close frame with the code and reason and closes the connection
+func (client *Conn) end(code int, reason string) {
+	if client.events == nil {
+		client.mutex.Lock()
+		client.conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(code, reason),
+			time.Now().Add(time.Second))
+		client.mutex.Unlock()
+	}
+	client.close()
+}
+
+// CheckSessions closes the connections which session was revoked, the expired
+// sessions are closed by their timer, returns the number of connections closed
+func (sm *Pools) CheckSessions() int {
+	if sm.Session == nil {
+		return 0
+	}
+
+	sm.sessions.Lock()
+	clients := []*Conn{}
+	for client := range sm.connections {
+		clients = append(clients, client)
+	}
+	sm.sessions.Unlock()
+
+	closed := 0
+	for _, client := range clients {
+		if client.Identity() == "" {
+			continue
+		}
+		_, _, err := sm.Session(client.Request())
+		if err == nil {
+			continue
+		}
+		closed++
+		expires := client.Expires()
+		if !expires.IsZero() && time.Now().After(expires) {
+			sm.Console.Log("sessionExpired", client.Identity())
+			client.end(CloseExpired, "katamari: session expired")
+			continue
+		}
+		sm.Console.Log("sessionRevoked", client.Identity())
+		client.end(CloseRevoked, "katamari: session revoked")
+	}
+
+	return closed
+}
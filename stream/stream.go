@@ -1,13 +1,17 @@
 package stream
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/benitogf/katamari/key"
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/objects"
 
 	"github.com/benitogf/jsonpatch"
 
@@ -23,18 +27,56 @@ type Subscribe func(key string) error
 // Unsubscribe : function callback on subscription closing
 type Unsubscribe func(key string)
 
+// Command : function callback on commands received from a connection
+type Command func(client *Conn, command messages.Command)
+
+// Identify : principal of the request that opens a connection
+type Identify func(r *http.Request) string
+
+// Scoped : keys which pools are grouped by the principal of the connections
+type Scoped func(key string) bool
+
 // Conn extends the websocket connection with a mutex
 // https://godoc.org/github.com/gorilla/websocket#hdr-Concurrency
+//
+// multiplex connections can join many pools and tag their messages with the key
+//
+// raw connections receive the data as json instead of base64
+//
+// event connections use server sent events instead of a websocket
+//
+// principal identifies the caller that opened the connection
+//
+// request is the request that opened the connection or renewed its session, used to audit its commands
+//
+// identity and expires describe the session of the credentials of the request,
+// the timer closes the connection once it expires
 type Conn struct {
-	mutex sync.Mutex
-	conn  *websocket.Conn
+	mutex        sync.Mutex
+	conn         *websocket.Conn
+	multiplex    bool
+	raw          bool
+	principal    string
+	sessionMutex sync.RWMutex
+	request      *http.Request
+	identity     string
+	expires      time.Time
+	timer        *time.Timer
+	events       http.ResponseWriter
+	controller   *http.ResponseController
+	flusher      http.Flusher
+	closed       bool
+	once         sync.Once
+	done         chan struct{}
 }
 
-// Pool of key filtered connections
+// Pool of key filtered connections, pools of scoped keys
+// have a pool for each principal
 type Pool struct {
 	// mutex       sync.RWMutex
 	Key         string
 	Filter      string
+	Scope       string
 	cache       Cache
 	connections []*Conn
 }
@@ -44,15 +86,21 @@ type Pools struct {
 	mutex         sync.RWMutex
 	OnSubscribe   Subscribe
 	OnUnsubscribe Unsubscribe
+	OnCommand     Command
+	Identify      Identify
+	Session       Session
+	Scoped        Scoped
 	ForcePatch    bool
 	Pools         []*Pool
 	Console       *coat.Console
+	sessions      sync.Mutex
+	connections   map[*Conn]bool
 }
 
-func (sm *Pools) findPool(key string, filter string) int {
+func (sm *Pools) findPool(key string, filter string, scope string) int {
 	poolIndex := -1
 	for i := range sm.Pools {
-		if sm.Pools[i].Key == key && sm.Pools[i].Filter == filter {
+		if sm.Pools[i].Key == key && sm.Pools[i].Filter == filter && sm.Pools[i].Scope == scope {
 			poolIndex = i
 			break
 		}
@@ -72,29 +120,135 @@ func (sm *Pools) UseConnections(path string, callback func(int)) {
 	}
 }
 
-// Close client connection
-func (sm *Pools) Close(key string, filter string, client *Conn) {
+// Connections returns the number of connections of each pool by key
+func (sm *Pools) Connections() map[string]int {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	count := map[string]int{}
+	for i := range sm.Pools {
+		count[sm.Pools[i].Key] += len(sm.Pools[i].connections)
+	}
+
+	return count
+}
+
+// scope of a connection on the pools of a key
+func (sm *Pools) scope(key string, client *Conn) string {
+	if sm.Scoped != nil && sm.Scoped(key) {
+		return client.principal
+	}
+
+	return ""
+}
+
+// identify the principal of a request
+func (sm *Pools) identify(r *http.Request) string {
+	if sm.Identify == nil {
+		return ""
+	}
+
+	return sm.Identify(r)
+}
+
+// Principal returns the identity of the caller that opened the connection
+func (client *Conn) Principal() string {
+	return client.principal
+}
+
+// Request returns the request that opened the connection or renewed its session
+func (client *Conn) Request() *http.Request {
+	client.sessionMutex.RLock()
+	defer client.sessionMutex.RUnlock()
+	return client.request
+}
+
+// Multiplexed returns true if the connection can join many pools
+func (client *Conn) Multiplexed() bool {
+	return client.multiplex
+}
+
+// Raw returns true if the connection receives the data as json
+func (client *Conn) Raw() bool {
+	return client.raw
+}
+
+// isRaw checks if a websocket request negotiates the raw json mode
+// with the raw query parameter or the Accept header
+func isRaw(r *http.Request) bool {
+	return r.FormValue("raw") != "" || messages.IsRaw(r.Header.Get("Accept"))
+}
+
+// remove a client from a pool, returns false if the client wasn't part of the pool,
+// scoped pools are removed once their last connection leaves
+func (sm *Pools) remove(poolIndex int, client *Conn) bool {
 	// auxiliar clients array
 	na := []*Conn{}
+	found := false
 
 	// loop to remove this client
-	sm.mutex.Lock()
-	poolIndex := sm.findPool(key, filter)
 	for _, v := range sm.Pools[poolIndex].connections {
 		if v != client {
 			na = append(na, v)
+			continue
 		}
+		found = true
 	}
 
 	// replace clients array with the auxiliar
 	sm.Pools[poolIndex].connections = na
+	if len(na) == 0 && sm.Pools[poolIndex].Scope != "" {
+		sm.Pools = append(sm.Pools[:poolIndex], sm.Pools[poolIndex+1:]...)
+	}
+	return found
+}
+
+// Close client connection
+func (sm *Pools) Close(key string, filter string, client *Conn) {
+	sm.mutex.Lock()
+	poolIndex := sm.findPool(key, filter, sm.scope(key, client))
+	if poolIndex != -1 {
+		sm.remove(poolIndex, client)
+	}
 	sm.mutex.Unlock()
 	go sm.OnUnsubscribe(key)
-	client.conn.Close()
+	sm.unregister(client)
+	client.close()
 }
 
-// New stream on a key
-func (sm *Pools) New(key string, filter string, w http.ResponseWriter, r *http.Request) (*Conn, error) {
+// closeAll removes a client from every pool it joined and closes the connection
+func (sm *Pools) closeAll(client *Conn) {
+	sm.mutex.Lock()
+	// backwards since removing a client can remove its scoped pools
+	for i := len(sm.Pools) - 1; i >= 0; i-- {
+		key := sm.Pools[i].Key
+		if sm.remove(i, client) {
+			go sm.OnUnsubscribe(key)
+		}
+	}
+	sm.mutex.Unlock()
+	sm.unregister(client)
+	client.close()
+}
+
+// Shutdown sends a close frame with the reason to every registered connection,
+// including the multiplexed ones that didn't join a pool, and closes them,
+// returns the number of connections
+func (sm *Pools) Shutdown(reason string) int {
+	sm.sessions.Lock()
+	clients := []*Conn{}
+	for client := range sm.connections {
+		clients = append(clients, client)
+	}
+	sm.sessions.Unlock()
+
+	for _, client := range clients {
+		client.end(websocket.CloseGoingAway, reason)
+	}
+
+	return len(clients)
+}
+
+func (sm *Pools) upgrade(key string, w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
 	upgrader := websocket.Upgrader{
 		// define the upgrade success
 		CheckOrigin: func(r *http.Request) bool {
@@ -110,24 +264,65 @@ func (sm *Pools) New(key string, filter string, w http.ResponseWriter, r *http.R
 		return nil, err
 	}
 
+	return wsClient, nil
+}
+
+// New stream on a key
+func (sm *Pools) New(key string, filter string, w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	wsClient, err := sm.upgrade(key, w, r)
+	if err != nil {
+		return nil, err
+	}
+
 	err = sm.OnSubscribe(key)
 	if err != nil {
 		return nil, err
 	}
 
-	return sm.Open(key, filter, wsClient), nil
+	client := &Conn{
+		conn:      wsClient,
+		mutex:     sync.Mutex{},
+		raw:       isRaw(r),
+		principal: sm.identify(r),
+		request:   r,
+	}
+	err = sm.register(client)
+	if err != nil {
+		go sm.OnUnsubscribe(key)
+		return nil, err
+	}
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.join(key, filter, client)
+	return client, nil
 }
 
-// Open a connection for a key
-func (sm *Pools) Open(key string, filter string, wsClient *websocket.Conn) *Conn {
+// Multiplex stream, the connection will not be part of any pool until it joins one
+func (sm *Pools) Multiplex(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	wsClient, err := sm.upgrade("multiplex", w, r)
+	if err != nil {
+		return nil, err
+	}
+
 	client := &Conn{
-		conn:  wsClient,
-		mutex: sync.Mutex{},
+		conn:      wsClient,
+		mutex:     sync.Mutex{},
+		multiplex: true,
+		raw:       isRaw(r),
+		principal: sm.identify(r),
+		request:   r,
+	}
+	err = sm.register(client)
+	if err != nil {
+		return nil, err
 	}
+	return client, nil
+}
 
-	sm.mutex.Lock()
-	defer sm.mutex.Unlock()
-	poolIndex := sm.findPool(key, filter)
+// join adds a client to the pool of a key, creating the pool if needed
+func (sm *Pools) join(key string, filter string, client *Conn) {
+	scope := sm.scope(key, client)
+	poolIndex := sm.findPool(key, filter, scope)
 	if poolIndex == -1 {
 		// create a pool
 		sm.Pools = append(
@@ -135,18 +330,64 @@ func (sm *Pools) Open(key string, filter string, wsClient *websocket.Conn) *Conn
 			&Pool{
 				Key:         key,
 				Filter:      filter,
+				Scope:       scope,
 				connections: []*Conn{client}})
 		poolIndex = len(sm.Pools) - 1
 	} else {
 		// use existing pool
+		for _, v := range sm.Pools[poolIndex].connections {
+			if v == client {
+				return
+			}
+		}
 		sm.Pools[poolIndex].connections = append(
 			sm.Pools[poolIndex].connections,
 			client)
 	}
 	sm.Console.Log("connections["+key+"]: ", len(sm.Pools[poolIndex].connections))
+}
+
+// Open a connection for a key
+func (sm *Pools) Open(key string, filter string, wsClient *websocket.Conn) *Conn {
+	client := &Conn{
+		conn:  wsClient,
+		mutex: sync.Mutex{},
+	}
+	// without a request there's no session to check
+	_ = sm.register(client)
+
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.join(key, filter, client)
 	return client
 }
 
+// Join a multiplexed connection to the pool of a key
+func (sm *Pools) Join(key string, filter string, client *Conn) error {
+	err := sm.OnSubscribe(key)
+	if err != nil {
+		return err
+	}
+
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.join(key, filter, client)
+	return nil
+}
+
+// Leave the pool of a key without closing the multiplexed connection
+func (sm *Pools) Leave(key string, filter string, client *Conn) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	poolIndex := sm.findPool(key, filter, sm.scope(key, client))
+	if poolIndex == -1 {
+		return
+	}
+	if sm.remove(poolIndex, client) {
+		go sm.OnUnsubscribe(key)
+	}
+}
+
 // Patch will return either the snapshot or the patch
 //
 // patch, false (patch)
@@ -174,40 +415,197 @@ func (sm *Pools) Patch(poolIndex int, data []byte) ([]byte, bool, int64) {
 	return operations, false, version
 }
 
-// Write will write data to a ws connection
-func (sm *Pools) Write(client *Conn, data string, snapshot bool, version int64) {
+// write a message using the transport of the connection, id is the
+// version of the message used on event streams
+func (client *Conn) write(message []byte, id string) error {
 	client.mutex.Lock()
 	defer client.mutex.Unlock()
+	if client.events != nil {
+		if client.closed {
+			return errors.New("katamari: event stream closed")
+		}
+		err := client.controller.SetWriteDeadline(time.Now().Add(timeout))
+		if err != nil {
+			client.closed = true
+			return err
+		}
+		_, err = client.events.Write(event(message, id))
+		if err != nil {
+			client.closed = true
+			return err
+		}
+		client.flusher.Flush()
+		return nil
+	}
+
 	client.conn.SetWriteDeadline(time.Now().Add(timeout))
-	err := client.conn.WriteMessage(websocket.BinaryMessage, []byte("{"+
-		"\"snapshot\": "+strconv.FormatBool(snapshot)+","+
-		"\"version\": \""+strconv.FormatInt(version, 16)+"\","+
-		"\"data\": \""+data+"\""+
-		"}"))
+	return client.conn.WriteMessage(websocket.BinaryMessage, message)
+}
+
+// close the transport of the connection
+func (client *Conn) close() {
+	if client.events != nil {
+		client.once.Do(func() {
+			close(client.done)
+		})
+		return
+	}
 
+	client.conn.Close()
+}
+
+func (sm *Pools) send(client *Conn, message []byte, id string) {
+	err := client.write(message, id)
 	if err != nil {
-		client.conn.Close()
+		client.close()
 		sm.Console.Log("writeStreamErr: ", err)
 	}
 }
 
-// Broadcast message
-func (sm *Pools) Broadcast(poolIndex int, data string, snapshot bool, version int64) {
+// frame of a ws message, data should be a json value
+func frame(key string, data string, snapshot bool, version int64) []byte {
+	keyField := ""
+	if key != "" {
+		keyField = "\"key\": \"" + key + "\","
+	}
+	return []byte("{" +
+		keyField +
+		"\"snapshot\": " + strconv.FormatBool(snapshot) + "," +
+		"\"version\": \"" + strconv.FormatInt(version, 16) + "\"," +
+		"\"data\": " + data +
+		"}")
+}
+
+// expand base64 encoded data of a snapshot or patch into json for raw connections
+func (sm *Pools) expand(data string, snapshot bool) string {
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		sm.Console.Err("raw decode failed", err)
+		return "\"" + data + "\""
+	}
+	var expanded []byte
+	if snapshot {
+		expanded, err = objects.Expand(decoded)
+	} else {
+		expanded, err = objects.ExpandPatch(decoded)
+	}
+	if err != nil {
+		sm.Console.Err("raw expand failed", err)
+		return string(decoded)
+	}
+
+	return string(expanded)
+}
+
+func (sm *Pools) write(client *Conn, key string, data string, snapshot bool, version int64) {
+	if client.raw {
+		sm.send(client, frame(key, sm.expand(data, snapshot), snapshot, version), strconv.FormatInt(version, 16))
+		return
+	}
+	sm.send(client, frame(key, "\""+data+"\"", snapshot, version), strconv.FormatInt(version, 16))
+}
+
+// Write will write data to a ws connection
+func (sm *Pools) Write(client *Conn, data string, snapshot bool, version int64) {
+	sm.write(client, "", data, snapshot, version)
+}
+
+// WriteKey will write data tagged with the key to a multiplexed ws connection
+func (sm *Pools) WriteKey(client *Conn, key string, data string, snapshot bool, version int64) {
+	sm.write(client, key, data, snapshot, version)
+}
+
+// WriteError will write an error related to a key to a ws connection
+func (sm *Pools) WriteError(client *Conn, key string, err error) {
+	message, _ := json.Marshal(messages.Message{
+		Key:   key,
+		Error: err.Error(),
+	})
+	sm.send(client, message, "")
+}
+
+// WriteReply will write the reply of a command to a ws connection
+func (sm *Pools) WriteReply(client *Conn, reply messages.Reply) {
+	message, _ := json.Marshal(reply)
+	sm.send(client, message, "")
+}
+
+// Broadcast message, the wait group is done once the message
+// is written to every connection of the pool
+func (sm *Pools) Broadcast(poolIndex int, data string, snapshot bool, version int64) *sync.WaitGroup {
+	key := sm.Pools[poolIndex].Key
 	connections := sm.Pools[poolIndex].connections
+	encoded := "\"" + data + "\""
+	expanded := ""
+	id := strconv.FormatInt(version, 16)
 
+	delivery := &sync.WaitGroup{}
+	delivery.Add(len(connections))
 	for _, client := range connections {
-		go sm.Write(client, data, snapshot, version)
+		message := encoded
+		if client.raw {
+			// expand once for all the raw connections of the pool
+			if expanded == "" {
+				expanded = sm.expand(data, snapshot)
+			}
+			message = expanded
+		}
+		tag := ""
+		if client.multiplex {
+			tag = key
+		}
+		go func(client *Conn, message []byte) {
+			defer delivery.Done()
+			sm.send(client, message, id)
+		}(client, frame(tag, message, snapshot, version))
 	}
+
+	return delivery
 }
 
-// Read will keep alive the ws connection
+// Read will keep alive the ws connection and pass the commands received to OnCommand
 func (sm *Pools) Read(key string, filter string, client *Conn) {
 	for {
-		_, _, err := client.conn.NextReader()
+		_, data, err := client.conn.ReadMessage()
 		if err != nil {
 			sm.Console.Err("readSocketError["+key+"]", err)
 			sm.Close(key, filter, client)
 			break
 		}
+
+		sm.command(client, data)
 	}
 }
+
+// Listen will read the commands of a multiplexed ws connection
+// until it closes, leaving all the joined pools
+func (sm *Pools) Listen(client *Conn) {
+	for {
+		_, data, err := client.conn.ReadMessage()
+		if err != nil {
+			sm.Console.Err("readSocketError[multiplex]", err)
+			sm.closeAll(client)
+			break
+		}
+
+		sm.command(client, data)
+	}
+}
+
+func (sm *Pools) command(client *Conn, data []byte) {
+	if sm.OnCommand == nil {
+		return
+	}
+
+	decode := messages.DecodeCommand
+	if client.raw {
+		decode = messages.DecodeRawCommand
+	}
+	command, err := decode(data)
+	if err != nil {
+		sm.WriteReply(client, messages.Reply{ID: command.ID, Key: command.Key, Error: err.Error()})
+		return
+	}
+
+	sm.OnCommand(client, command)
+}
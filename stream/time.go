@@ -1,11 +1,5 @@
 package stream
 
-import (
-	"time"
-
-	"github.com/gorilla/websocket"
-)
-
 // BroadcastTime sends time to all the subscribers
 func (sm *Pools) BroadcastTime(data string) {
 	sm.mutex.RLock()
@@ -19,12 +13,9 @@ func (sm *Pools) BroadcastTime(data string) {
 
 // WriteTime sends time to a subscriber
 func (sm *Pools) WriteTime(client *Conn, data string) {
-	client.mutex.Lock()
-	defer client.mutex.Unlock()
-	client.conn.SetWriteDeadline(time.Now().Add(timeout))
-	err := client.conn.WriteMessage(websocket.BinaryMessage, []byte(data))
+	err := client.write([]byte(data), "")
 	if err != nil {
-		client.conn.Close()
+		client.close()
 		sm.Console.Log("writeTimeStreamErr: ", err)
 	}
 }
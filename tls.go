@@ -0,0 +1,185 @@
+package katamari
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certificate keeps a key pair and the certificate authorities of the
+// clients loaded from files, reloading them when the files are modified
+type certificate struct {
+	mutex      sync.Mutex
+	certFile   string
+	keyFile    string
+	caFile     string
+	modified   time.Time
+	caModified time.Time
+	cert       *tls.Certificate
+	clientCAs  *x509.CertPool
+}
+
+// modTime of the most recently modified file of the pair
+func (c *certificate) modTime() (time.Time, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+
+	return certInfo.ModTime(), nil
+}
+
+// get the current certificate, a failed reload keeps the previous one
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	modified, err := c.modTime()
+	if err != nil {
+		if c.cert != nil {
+			return c.cert, nil
+		}
+		return nil, err
+	}
+
+	if c.cert != nil && !modified.After(c.modified) {
+		return c.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			return c.cert, nil
+		}
+		return nil, err
+	}
+
+	c.cert = &cert
+	c.modified = modified
+	return c.cert, nil
+}
+
+// pool of the current client certificate authorities, a failed reload keeps the previous one
+func (c *certificate) pool() (*x509.CertPool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	info, err := os.Stat(c.caFile)
+	if err != nil {
+		if c.clientCAs != nil {
+			return c.clientCAs, nil
+		}
+		return nil, err
+	}
+
+	if c.clientCAs != nil && !info.ModTime().After(c.caModified) {
+		return c.clientCAs, nil
+	}
+
+	pool, err := loadPool(c.caFile)
+	if err != nil {
+		if c.clientCAs != nil {
+			return c.clientCAs, nil
+		}
+		return nil, err
+	}
+
+	c.clientCAs = pool
+	c.caModified = info.ModTime()
+	return c.clientCAs, nil
+}
+
+// configFor returns the configuration of each handshake with
+// the current client certificate authorities
+func (c *certificate) configFor(config *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		pool, err := c.pool()
+		if err != nil {
+			return nil, err
+		}
+		current := config.Clone()
+		current.ClientCAs = pool
+		return current, nil
+	}
+}
+
+// loadPool of certificate authorities from a pem file
+func loadPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("katamari: invalid client ca file")
+	}
+
+	return pool, nil
+}
+
+// tlsConfig builds the tls configuration of the server, returns nil
+// if the server should not use tls
+func (app *Server) tlsConfig() (*tls.Config, error) {
+	if app.TLSConfig == nil && app.CertFile == "" && app.KeyFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+	if app.TLSConfig != nil {
+		config = app.TLSConfig.Clone()
+	}
+
+	cert := &certificate{certFile: app.CertFile, keyFile: app.KeyFile, caFile: app.ClientCAFile}
+	if app.CertFile != "" || app.KeyFile != "" {
+		_, err := cert.get(nil)
+		if err != nil {
+			return nil, err
+		}
+		config.GetCertificate = cert.get
+	}
+
+	if len(config.Certificates) == 0 && config.GetCertificate == nil {
+		return nil, errors.New("katamari: tls requires a certificate")
+	}
+
+	if app.ClientCAFile != "" {
+		pool, err := cert.pool()
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	// websockets can't be upgraded over http2
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"http/1.1"}
+	}
+
+	// the client certificate authorities are reloaded on each handshake like the certificate
+	if app.ClientCAFile != "" && config.GetConfigForClient == nil {
+		config.GetConfigForClient = cert.configFor(config.Clone())
+	}
+
+	return config, nil
+}
+
+// PeerIdentity returns the common name of the verified client
+// certificate of a request, empty if there's none
+func PeerIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
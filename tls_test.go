@@ -0,0 +1,185 @@
+package katamari_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benitogf/katamari"
+	"github.com/benitogf/katamari/client"
+	"github.com/benitogf/katamari/objects"
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, serial int64, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) write(t *testing.T, certFile string, keyFile string) {
+	err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)
+	require.NoError(t, err)
+	if keyFile == "" {
+		return
+	}
+	der, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	require.NoError(t, err)
+}
+
+func (c *testCert) pair() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestTLS(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "katamari")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "ca", 1, nil, x509.ExtKeyUsageAny)
+	server := newTestCert(t, "server", 2, ca, x509.ExtKeyUsageServerAuth)
+	peer := newTestCert(t, "peer", 3, ca, x509.ExtKeyUsageClientAuth)
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	caFile := filepath.Join(dir, "ca.crt")
+	server.write(t, certFile, keyFile)
+	ca.write(t, caFile, "")
+
+	var mutex sync.Mutex
+	identities := []string{}
+	app := katamari.Server{}
+	app.Silence = true
+	app.CertFile = certFile
+	app.KeyFile = keyFile
+	app.ClientCAFile = caFile
+	app.Audit = func(r *http.Request) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		identities = append(identities, katamari.PeerIdentity(r))
+		return true
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	config := &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{peer.pair()}}
+
+	// without a client certificate the handshake fails
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	_, err = anonymous.Get("https://" + app.Address)
+	require.Error(t, err)
+
+	secure := client.New(app.Address)
+	secure.TLS = config
+	_, err = secure.Set("test", []byte(`{"name":"test"}`))
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	sub, err := secure.Subscribe("test", func(objs []objects.Object) {
+		wg.Done()
+	})
+	require.NoError(t, err)
+	wg.Wait()
+	sub.Close()
+
+	mutex.Lock()
+	require.Equal(t, []string{"peer", "peer"}, identities)
+	mutex.Unlock()
+
+	// a new certificate is served once the files are modified
+	reloaded := newTestCert(t, "reloaded", 4, ca, x509.ExtKeyUsageServerAuth)
+	reloaded.write(t, certFile, keyFile)
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+	require.NoError(t, os.Chtimes(keyFile, future, future))
+	fresh := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	resp, err := fresh.Get("https://" + app.Address)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "reloaded", resp.TLS.PeerCertificates[0].Subject.CommonName)
+
+	// the client certificate authorities are reloaded as well
+	other := newTestCert(t, "other", 5, nil, x509.ExtKeyUsageAny)
+	otherPeer := newTestCert(t, "other peer", 6, other, x509.ExtKeyUsageClientAuth)
+	other.write(t, caFile, "")
+	require.NoError(t, os.Chtimes(caFile, future, future))
+	previous := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	_, err = previous.Get("https://" + app.Address)
+	require.Error(t, err)
+	rotated := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{otherPeer.pair()},
+	}}}
+	resp, err = rotated.Get("https://" + app.Address)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	mutex.Lock()
+	require.Equal(t, "other peer", identities[len(identities)-1])
+	mutex.Unlock()
+}
+
+func TestTLSConfig(t *testing.T) {
+	t.Parallel()
+	ca := newTestCert(t, "ca", 1, nil, x509.ExtKeyUsageAny)
+	server := newTestCert(t, "server", 2, ca, x509.ExtKeyUsageServerAuth)
+	app := katamari.Server{}
+	app.Silence = true
+	app.TLSConfig = &tls.Config{Certificates: []tls.Certificate{server.pair()}}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	secure := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	resp, err := secure.Get("https://" + app.Address)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "server", resp.TLS.PeerCertificates[0].Subject.CommonName)
+}
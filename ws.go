@@ -1,6 +1,7 @@
 package katamari
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
@@ -10,6 +11,24 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// fetch the cached entry of a key from the corresponding storage
+// scoped for the principal
+func (app *Server) fetch(_key string, principal string) (stream.Cache, error) {
+	var entry stream.Cache
+	var err error
+	if key.Contains(app.InMemoryKeys, _key) {
+		entry, err = app.MemFetch(_key, _key)
+	} else {
+		entry, err = app.Fetch(_key, _key)
+	}
+	if err != nil {
+		return entry, err
+	}
+
+	entry.Data, err = app.filters.scopedChain().check(_key, principal, entry.Data)
+	return entry, err
+}
+
 func (app *Server) ws(w http.ResponseWriter, r *http.Request) {
 	_key := mux.Vars(r)["key"]
 	version := r.FormValue("v")
@@ -19,24 +38,136 @@ func (app *Server) ws(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	entry := stream.Cache{}
 	// send initial msg
-	if key.Contains(app.InMemoryKeys, _key) {
-		entry, err = app.MemFetch(_key, _key)
-		if err != nil {
-			app.console.Err("katamari: filtered route", err)
+	entry, err := app.fetch(_key, client.Principal())
+	if err != nil {
+		app.console.Err("katamari: filtered route", err)
+		return
+	}
+
+	if version != strconv.FormatInt(entry.Version, 16) {
+		go app.Stream.Write(client, messages.Encode(entry.Data), true, entry.Version)
+	}
+	app.Stream.Read(_key, _key, client)
+}
+
+// methods of the rest requests equivalent to the actions of a command
+var actionMethods = map[string]string{
+	ActionRead:   "GET",
+	ActionWrite:  "POST",
+	ActionDelete: "DELETE",
+}
+
+// auditCommand audits the action of a command on a key with Audit, using a copy
+// of the request with the method and path of the equivalent rest request, and AuditKey
+func (app *Server) auditCommand(r *http.Request, _key string, action string) bool {
+	req := r.Clone(r.Context())
+	req.Method = actionMethods[action]
+	req.URL.Path = "/" + _key
+	req.URL.RawPath = ""
+	req = mux.SetURLVars(req, map[string]string{"key": _key})
+	return app.Audit(req) && app.auditKey(r, _key, action)
+}
+
+// auditKey audits the action of a request on a key with AuditKey, and
+// AuditSchemas for the writes and deletes of the schemas key
+func (app *Server) auditKey(r *http.Request, _key string, action string) bool {
+	return app.auditSchemas(r, _key, action) && app.AuditKey(r, _key, action)
+}
+
+// command handles the operations received on a websocket connection
+func (app *Server) command(client *stream.Conn, command messages.Command) {
+	if !app.commands.start() {
+		app.Stream.WriteReply(client, messages.Reply{ID: command.ID, Key: command.Key, Error: "katamari: server shutdown"})
+		return
+	}
+	defer app.commands.done()
+
+	switch command.Op {
+	case "set":
+		app.wsPublish(client, command)
+	case "del":
+		app.wsUnpublish(client, command)
+	case "auth":
+		app.renew(client, command)
+	case "subscribe", "unsubscribe":
+		if !client.Multiplexed() {
+			app.Stream.WriteError(client, command.Key, errors.New("katamari: subscriptions require a multiplexed connection"))
 			return
 		}
-	} else {
-		entry, err = app.Fetch(_key, _key)
-		if err != nil {
-			app.console.Err("katamari: filtered route", err)
+		if command.Op == "subscribe" {
+			app.subscribe(client, command)
 			return
 		}
+		app.Stream.Leave(command.Key, command.Key, client)
+	default:
+		app.Stream.WriteError(client, command.Key, errors.New("katamari: unknown operation "+command.Op))
 	}
+}
 
-	if version != strconv.FormatInt(entry.Version, 16) {
-		go app.Stream.Write(client, messages.Encode(entry.Data), true, entry.Version)
+func (app *Server) wsPublish(client *stream.Conn, command messages.Command) {
+	reply := messages.Reply{ID: command.ID, Key: command.Key}
+	if !isWritable(command.Key) {
+		reply.Error = "katamari: pathKeyError key is not valid"
+		app.Stream.WriteReply(client, reply)
+		return
 	}
-	app.Stream.Read(_key, _key, client)
+
+	_key := key.Build(command.Key)
+	if !app.auditCommand(client.Request(), _key, ActionWrite) {
+		reply.Error = errUnauthorized.Error()
+		app.Stream.WriteReply(client, reply)
+		return
+	}
+
+	data, err := app.checkWrite(_key, []byte(command.Data))
+	if err != nil {
+		app.console.Err("setError["+_key+"]", err)
+		reply.Error = err.Error()
+		app.Stream.WriteReply(client, reply)
+		return
+	}
+
+	reply.Index, err = app.store(_key, data)
+	if err != nil {
+		reply.Error = err.Error()
+		app.Stream.WriteReply(client, reply)
+		return
+	}
+
+	app.console.Log("publish", _key)
+	app.filters.afterChain().check(_key)
+	reply.Key = _key
+	app.Stream.WriteReply(client, reply)
+}
+
+func (app *Server) wsUnpublish(client *stream.Conn, command messages.Command) {
+	reply := messages.Reply{ID: command.ID, Key: command.Key}
+	_key := command.Key
+	if !key.IsValid(_key) {
+		reply.Error = "katamari: pathKeyError key is not valid"
+		app.Stream.WriteReply(client, reply)
+		return
+	}
+
+	if !app.auditCommand(client.Request(), _key, ActionDelete) {
+		reply.Error = errUnauthorized.Error()
+		app.Stream.WriteReply(client, reply)
+		return
+	}
+
+	err := app.filters.deleteChain().check(_key, app.Static)
+	if err != nil {
+		app.console.Err("detError["+_key+"]", err)
+		reply.Error = err.Error()
+		app.Stream.WriteReply(client, reply)
+		return
+	}
+
+	app.console.Log("unpublish", _key)
+	err = app.remove(_key)
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	app.Stream.WriteReply(client, reply)
 }
@@ -1,12 +1,17 @@
 package katamari
 
 import (
+	"encoding/json"
+	"errors"
+	"net/http"
 	"net/url"
 	"os"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/objects"
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/require"
 )
@@ -54,3 +59,114 @@ func TestWsTime(t *testing.T) {
 	err = c1.Close()
 	require.NoError(t, err)
 }
+
+func TestWsWrite(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.WriteFilter("test", NoopFilter)
+	app.WriteFilter("things/*", NoopFilter)
+	app.ReadFilter("test", NoopFilter)
+	app.DeleteFilter("things/*", func(key string) error {
+		return errors.New("can't delete " + key)
+	})
+	app.Static = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/test"}
+	wsClient, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer wsClient.Close()
+	readReply := func() messages.Reply {
+		for {
+			var reply messages.Reply
+			_, message, err := wsClient.ReadMessage()
+			require.NoError(t, err)
+			require.NoError(t, json.Unmarshal(message, &reply))
+			if reply.ID != "" {
+				return reply
+			}
+		}
+	}
+
+	err = wsClient.WriteJSON(messages.Command{ID: "1", Op: "set", Key: "test", Data: messages.Encode([]byte("test"))})
+	require.NoError(t, err)
+	reply := readReply()
+	require.Equal(t, "1", reply.ID)
+	require.Equal(t, "test", reply.Index)
+	require.Empty(t, reply.Error)
+	data, err := app.Storage.Get("test")
+	require.NoError(t, err)
+	obj, err := objects.DecodeFull(data)
+	require.NoError(t, err)
+	require.Equal(t, "test", obj.Data)
+
+	err = wsClient.WriteJSON(messages.Command{ID: "2", Op: "set", Key: "things/*", Data: messages.Encode([]byte("thing"))})
+	require.NoError(t, err)
+	reply = readReply()
+	require.Equal(t, "2", reply.ID)
+	require.Empty(t, reply.Error)
+	require.Equal(t, "things/"+reply.Index, reply.Key)
+
+	err = wsClient.WriteJSON(messages.Command{ID: "3", Op: "set", Key: "other", Data: messages.Encode([]byte("other"))})
+	require.NoError(t, err)
+	reply = readReply()
+	require.Equal(t, "3", reply.ID)
+	require.Contains(t, reply.Error, "static mode")
+
+	err = wsClient.WriteJSON(messages.Command{ID: "4", Op: "del", Key: "things/*"})
+	require.NoError(t, err)
+	reply = readReply()
+	require.Equal(t, "4", reply.ID)
+	require.Equal(t, "can't delete things/*", reply.Error)
+
+	err = wsClient.WriteJSON(messages.Command{ID: "5", Op: "set", Key: "test", Data: ""})
+	require.NoError(t, err)
+	reply = readReply()
+	require.Equal(t, "5", reply.ID)
+	require.Equal(t, "katamari: empty post data", reply.Error)
+
+	err = wsClient.WriteJSON(messages.Command{ID: "6", Op: "subscribe", Key: "things/*"})
+	require.NoError(t, err)
+	_, message, err := wsClient.ReadMessage()
+	require.NoError(t, err)
+	require.Contains(t, string(message), "multiplexed connection")
+}
+
+func TestWsWriteAudit(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.Audit = func(r *http.Request) bool {
+		return r.URL.Path == "/open" || (r.URL.Path == "/public" && r.Method != "DELETE")
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/open"}
+	wsClient, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer wsClient.Close()
+	readReply := func() messages.Reply {
+		for {
+			var reply messages.Reply
+			_, message, err := wsClient.ReadMessage()
+			require.NoError(t, err)
+			require.NoError(t, json.Unmarshal(message, &reply))
+			if reply.ID != "" {
+				return reply
+			}
+		}
+	}
+
+	// the commands are audited with the method and path of their key
+	require.NoError(t, wsClient.WriteJSON(messages.Command{ID: "1", Op: "set", Key: "secret", Data: messages.Encode([]byte("secret"))}))
+	require.Equal(t, errUnauthorized.Error(), readReply().Error)
+	require.NoError(t, wsClient.WriteJSON(messages.Command{ID: "2", Op: "set", Key: "public", Data: messages.Encode([]byte("public"))}))
+	require.Empty(t, readReply().Error)
+	require.NoError(t, wsClient.WriteJSON(messages.Command{ID: "3", Op: "del", Key: "public"}))
+	require.Equal(t, errUnauthorized.Error(), readReply().Error)
+	_, err = app.Storage.Get("secret")
+	require.Error(t, err)
+	_, err = app.Storage.Get("public")
+	require.NoError(t, err)
+}